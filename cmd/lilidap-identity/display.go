@@ -27,12 +27,12 @@ func displayServerInfo(host string, port int, keyPath string, keyType string, fi
 }
 
 // displayCredentials shows LDAP credentials
-func displayCredentials(pubKey ssh.PublicKey, host string, port int) {
+func displayCredentials(pubKey ssh.PublicKey, scheme *derived.Scheme, host string, port int) {
 	// Normalize the public key
 	normalizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey)))
 
 	// Construct the DN
-	dn := fmt.Sprintf("cn=%s,ou=campers,dc=0_1_0,dc=bivvi", normalizedKey)
+	dn := fmt.Sprintf("cn=%s,ou=campers,dc=%s,dc=bivvi", normalizedKey, scheme.DC())
 	password := fmt.Sprintf("%s:%d", host, port)
 
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
@@ -57,11 +57,43 @@ func displayDerivedIdentity(attrs *derived.UserAttributes) {
 	fmt.Printf("Friendly Name:   %-13s (for display, caller ID)\n", attrs.DisplayName("en"))
 	fmt.Printf("Phone Number:    %-13s (for VoIP)\n", attrs.PhoneNumber())
 	fmt.Printf("User ID:         %-13d (numeric UID)\n", attrs.PosixUserID())
+	fmt.Printf("Accent Color:    %-13s (for highlighting you in chats)\n", attrs.AccentColor())
+	fmt.Println()
+	fmt.Println("Key Words (read these aloud to prove it is you):")
+	words := attrs.FingerprintWords()
+	for i := 0; i < len(words); i += 8 {
+		fmt.Println("   " + strings.Join(words[i:i+4], " ") + "  " + strings.Join(words[i+4:i+8], " "))
+	}
+	fmt.Println()
+	fmt.Println("Avatar (as chat and VoIP clients show it):")
+	fmt.Println()
+	for _, line := range strings.Split(strings.TrimSuffix(attrs.Avatar().BlockArt(), "\n"), "\n") {
+		fmt.Println("   " + line)
+	}
 	fmt.Println()
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println()
 }
 
+// displaySafetyNumber shows the safety number shared with another person
+func displaySafetyNumber(mine, theirs *derived.UserAttributes, number string) {
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Println("🤝 SAFETY NUMBER:")
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Println()
+	fmt.Printf("You:   %-13s (%s)\n", mine.DisplayName("en"), mine.Username())
+	fmt.Printf("Them:  %-13s (%s)\n", theirs.DisplayName("en"), theirs.Username())
+	fmt.Println()
+	groups := strings.Fields(number)
+	for i := 0; i < len(groups); i += 4 {
+		fmt.Println("   " + strings.Join(groups[i:i+4], "  "))
+	}
+	fmt.Println()
+	fmt.Println("Read the number to each other, in person or on a call you trust.")
+	fmt.Println("If it matches, each of you has the other's real key.")
+	fmt.Println()
+}
+
 // displayReadyMessage shows the final ready message
 func displayReadyMessage() {
 	fmt.Println("✅ Ready to authenticate! Use these credentials with any LDAP-enabled service.")
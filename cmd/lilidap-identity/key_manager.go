@@ -130,3 +130,23 @@ func expandPath(path string) (string, error) {
 
 	return path, nil
 }
+
+// parsePublicKey reads another person's public key, given either as an
+// authorized_keys line, a lilidap DN, or the path of a file holding one
+func parsePublicKey(arg string) (ssh.PublicKey, error) {
+	text := strings.TrimSpace(arg)
+	if path, err := expandPath(text); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			text = strings.TrimSpace(string(data))
+		}
+	}
+	// Accept a DN copied from an LDAP client: cn=<key>,ou=campers,...
+	if cn, ok := strings.CutPrefix(text, "cn="); ok {
+		text, _, _ = strings.Cut(cn, ",")
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("not a public key, DN or key file: %w", err)
+	}
+	return pubKey, nil
+}
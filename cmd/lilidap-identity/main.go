@@ -18,8 +18,30 @@ func main() {
 	keyPath := flag.String("key", "~/.lilidap/identity", "Path to SSH private key")
 	sshHost := flag.String("ssh-host", "127.0.0.1", "SSH server host")
 	sshPort := flag.Int("ssh-port", 0, "SSH server port (0=auto)")
+	version := flag.String("scheme", derived.DefaultScheme.DC(), "Derivation scheme version to show the identity for")
+	saltFile := flag.String("salt-file", "", "File holding the salt of a network that derives pseudonymous identities, to show yours there (default: $"+derived.SaltEnv+")")
+	compare := flag.String("compare", "", "Show the safety number shared with another person's public key (authorized_keys line, DN or .pub file) and exit")
 	flag.Parse()
 
+	scheme, ok := derived.LookupScheme(*version)
+	if !ok {
+		log.Fatalf("❌ Unknown derivation scheme %s", *version)
+	}
+
+	// The salt is a secret, so it never goes on the command line
+	var salt []byte
+	if *saltFile != "" {
+		var err error
+		if salt, err = derived.ReadSaltFile(*saltFile); err != nil {
+			log.Fatalf("❌ Invalid --salt-file: %v", err)
+		}
+	} else if value := os.Getenv(derived.SaltEnv); value != "" {
+		salt = []byte(value)
+		if err := derived.CheckSalt(salt); err != nil {
+			log.Fatalf("❌ Invalid %s: %v", derived.SaltEnv, err)
+		}
+	}
+
 	// Show banner
 	displayBanner()
 
@@ -36,6 +58,19 @@ func main() {
 		log.Fatalf("❌ Key management error: %v", err)
 	}
 
+	// Comparing keys needs no SSH server
+	if *compare != "" {
+		other, err := parsePublicKey(*compare)
+		if err != nil {
+			log.Fatalf("❌ Invalid --compare key: %v", err)
+		}
+		if derived.SameKey(pubKey, other) {
+			log.Fatalf("❌ That is your own key: compare with someone else's")
+		}
+		displaySafetyNumber(scheme.Derive(pubKey).WithSalt(salt), scheme.Derive(other).WithSalt(salt), derived.SafetyNumber(pubKey, other))
+		return
+	}
+
 	// Find a free port (or use specified)
 	fmt.Println("🔍 Finding available port...")
 	port, err := getPort(*sshHost, *sshPort)
@@ -58,11 +93,11 @@ func main() {
 	displayServerInfo(*sshHost, port, expandedKeyPath, keyType, fingerprint)
 
 	// Display LDAP credentials
-	displayCredentials(pubKey, *sshHost, port)
+	displayCredentials(pubKey, scheme, *sshHost, port)
 
 	// Derive and display identity attributes
 	fmt.Println("🧮 Deriving identity attributes...")
-	attrs := derived.FromPublicKey(pubKey)
+	attrs := scheme.Derive(pubKey).WithSalt(salt)
 	displayDerivedIdentity(attrs)
 
 	// Show ready message
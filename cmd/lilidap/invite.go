@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"lilidap/internal/invite"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runInvite mints a signed invitation token with an admin's SSH key
+func runInvite(args []string) {
+	flags := flag.NewFlagSet("invite", flag.ExitOnError)
+	keyPath := flags.String("key", "~/.ssh/id_ed25519", "Admin SSH private key to sign the invitation with")
+	network := flags.String("network", "", "Name of the network the invitation admits to, as in the server's --network")
+	uses := flags.Int("uses", 1, "Number of keys the invitation may admit (0=unlimited)")
+	validFor := flags.Duration("valid-for", 7*24*time.Hour, "How long the invitation can be redeemed")
+	expires := flags.String("expires", "", "Expiry date (YYYY-MM-DD or RFC 3339), overrides --valid-for")
+	note := flags.String("note", "", "Free text note stored in the invitation")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: lilidap invite [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Mints an invitation token admitting new keys to a closed community.\n")
+		fmt.Fprintf(flags.Output(), "The signing key must be listed in the server's --invite-admins file.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *network == "" {
+		log.Fatalf("❌ --network is required: an invitation only admits to the network it names")
+	}
+
+	expiry := time.Now().Add(*validFor)
+	if *expires != "" {
+		var err error
+		expiry, err = parseExpiry(*expires)
+		if err != nil {
+			log.Fatalf("❌ Invalid expiry: %v", err)
+		}
+	}
+
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to load admin key: %v", err)
+	}
+
+	token, details, err := invite.Mint(signer, *network, *uses, expiry, *note)
+	if closer, ok := signer.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to mint invitation: %v", err)
+	}
+
+	usesText := fmt.Sprintf("%d", details.MaxUses)
+	if details.MaxUses == 0 {
+		usesText = "unlimited"
+	}
+	fmt.Fprintf(os.Stderr, "🎟️  Invitation %s\n", details.ID)
+	fmt.Fprintf(os.Stderr, "   Issuer:  %s\n", ssh.FingerprintSHA256(signer.PublicKey()))
+	fmt.Fprintf(os.Stderr, "   Network: %s\n", details.Network)
+	fmt.Fprintf(os.Stderr, "   Uses:    %s\n", usesText)
+	fmt.Fprintf(os.Stderr, "   Expires: %s\n", details.Expires.Local().Format(time.RFC1123))
+	fmt.Fprintf(os.Stderr, "\n📋 The newcomer appends the token to their password: <host>:<port> <token>\n\n")
+	fmt.Println(token)
+}
+
+// parseExpiry accepts a plain date (end of that day, local time) or an RFC 3339 timestamp
+func parseExpiry(value string) (time.Time, error) {
+	if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return day.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// loadSigner loads an SSH private key, falling back to ssh-agent for
+// passphrase-protected keys. Signers from the agent are io.Closers, to be
+// closed once signing is done.
+func loadSigner(keyPath string) (ssh.Signer, error) {
+	if strings.HasPrefix(keyPath, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		keyPath = filepath.Join(homeDir, keyPath[2:])
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && missing.PublicKey != nil {
+		signer, err := agentSigner(missing.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return signer, nil
+}
+
+// agentKeySigner signs with a key held by ssh-agent, over a connection to
+// the agent that stays open until it is closed
+type agentKeySigner struct {
+	ssh.Signer
+	conn net.Conn
+}
+
+func (s *agentKeySigner) Close() error {
+	return s.conn.Close()
+}
+
+// agentSigner finds the signer for the public key in the running ssh-agent.
+// The signer keeps the connection to the agent open, since it signs through
+// it; close it once signing is done.
+func agentSigner(pubKey ssh.PublicKey) (*agentKeySigner, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("key is passphrase-protected: add it to ssh-agent first")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %w", err)
+	}
+	for _, signer := range signers {
+		if string(signer.PublicKey().Marshal()) == string(pubKey.Marshal()) {
+			return &agentKeySigner{signer, conn}, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("key is passphrase-protected and not loaded in ssh-agent")
+}
@@ -1,20 +1,289 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"lilidap/internal/allowlist"
+	"lilidap/internal/attrmap"
+	"lilidap/internal/derived"
+	"lilidap/internal/invite"
 	"lilidap/internal/ldapserver"
+	"lilidap/internal/registry"
+	"lilidap/internal/revocation"
 	"log"
+	"os"
+	"strings"
+	"time"
 )
 
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	// Subcommands come before any server flags
+	if len(os.Args) > 1 && os.Args[1] == "invite" {
+		runInvite(os.Args[2:])
+		return
+	}
+
 	var host string
 	var port int
+	var revokedKeys string
+	var allowedKeys stringList
+	var inviteAdmins string
+	var inviteStore string
+	var network string
+	var registryPath string
+	var anonymousListing bool
+	var onCollision string
+	var collisionLog string
+	var uidRange string
+	var gidRange string
+	var schemeList string
+	var saltFile string
+	var entryNames string
+	var serviceAccounts string
+	var phoneFormat derived.PhoneFormat
+	var sipDomain string
+	var extensionRange string
+	var attributeMap string
+	var languageDir string
 
 	flag.StringVar(&host, "host", "", "IP address to bind to (default: all interfaces)")
 	flag.IntVar(&port, "port", 389, "Port to listen on")
+	flag.StringVar(&revokedKeys, "revoked-keys", "", "Blocklist (authorized_keys format) or OpenSSH KRL of revoked keys")
+	flag.Var(&allowedKeys, "allowed-keys", "authorized_keys file of the only keys permitted (repeatable; enables closed-community mode)")
+	flag.StringVar(&inviteAdmins, "invite-admins", "", "authorized_keys file of admins whose invitations admit new keys")
+	flag.StringVar(&inviteStore, "invite-store", "lilidap-invitations.json", "File recording redeemed invitations")
+	flag.StringVar(&network, "network", "", "Name of this network, which invitations must be minted for (lilidap invite --network)")
+	flag.BoolVar(&anonymousListing, "anonymous-listing", false, "Let anonymous clients list every camper, not just look them up by uid or name")
+	flag.StringVar(&registryPath, "registry", "", "File remembering every verified key across restarts (default: in memory only)")
+	flag.StringVar(&onCollision, "on-collision", "suffix", "What to do when a newcomer's derived identity collides with a known key: suffix or reject")
+	flag.StringVar(&collisionLog, "collision-log", "", "File to append detected collisions to, as JSON lines, for admins to review")
+	flag.StringVar(&uidRange, "uid-range", "", fmt.Sprintf("Range (min-max) derived uidNumbers are mapped into, e.g. %s (default: key bits + %d)", derived.RecommendedUIDRange, derived.LegacyUIDBase))
+	flag.StringVar(&gidRange, "gid-range", "", fmt.Sprintf("Range (min-max) of per-user gidNumbers (default: %d for everyone)", derived.DefaultGID))
+	flag.StringVar(&schemeList, "schemes", "", "Comma-separated derivation scheme versions to serve, the first detecting collisions (default: all)")
+	flag.StringVar(&saltFile, "salt-file", "", "File holding a per-deployment salt giving keys pseudonymous identities, unlinkable to those they have on other networks (default: $"+derived.SaltEnv+", or the global identity)")
+	flag.StringVar(&phoneFormat.Prefix, "phone-prefix", derived.DefaultPhoneFormat.Prefix, "Digits dialled before the derived part of telephone numbers")
+	flag.IntVar(&phoneFormat.Digits, "phone-digits", 0, "Fixed number of derived digits in telephone numbers (default: all of the hash)")
+	flag.BoolVar(&phoneFormat.CheckDigit, "phone-check-digit", false, "Append a Luhn check digit to telephone numbers")
+	flag.StringVar(&phoneFormat.CountryCode, "phone-country-code", "", "Country calling code for publishing telephone numbers in E.164 form, e.g. 44")
+	flag.StringVar(&sipDomain, "sip-domain", "", "SIP domain for publishing telephone numbers as sipURI and labeledURI")
+	flag.StringVar(&extensionRange, "extensions", "", "Range (first-last) of short extensions given out on first bind, e.g. 200-999")
+	flag.StringVar(&attributeMap, "attribute-map", "", "YAML file of templated attributes to add to, or change in, user entries")
+	flag.StringVar(&entryNames, "entry-names", "", "What user entries are named by in DNs: key, or uid or fingerprint to show full keys only to their owners and --service-accounts (default: key, or uid with a salt)")
+	flag.StringVar(&serviceAccounts, "service-accounts", "", "authorized_keys file of service accounts, such as sshd hosts, that may see every full key when entries are not named by key")
+	flag.StringVar(&languageDir, "languages", "", "Directory of YAML or JSON language files to generate display names in, besides the built-in ones")
 	flag.Parse()
 
+	var opts []ldapserver.Option
+
+	// Generate names in the operator's languages too
+	var languages []string
+	if languageDir != "" {
+		loaded, tags, err := derived.LoadLanguages(languageDir)
+		if err != nil {
+			log.Fatalf("❌ Failed to load languages: %v", err)
+		}
+		languages = tags
+		opts = append(opts, ldapserver.WithLanguages(loaded))
+	}
+
+	// Remember verified keys across restarts
+	if registryPath != "" {
+		reg, err := registry.Open(registryPath)
+		if err != nil {
+			log.Fatalf("❌ Failed to open registry: %v", err)
+		}
+		defer reg.Close()
+		opts = append(opts, ldapserver.WithRegistry(reg))
+	}
+	if anonymousListing {
+		opts = append(opts, ldapserver.WithAnonymousListing())
+	}
+
+	// Serve each derivation scheme under its own naming context
+	schemes := derived.Schemes()
+	if schemeList != "" {
+		var err error
+		schemes, err = derived.ParseSchemes(schemeList)
+		if err != nil {
+			log.Fatalf("❌ Invalid --schemes: %v", err)
+		}
+	}
+	opts = append(opts, ldapserver.WithSchemes(schemes...))
+
+	// Keep numeric IDs where POSIX systems accept them
+	if uidRange != "" {
+		uids, err := derived.ParseIDRange(uidRange)
+		if err != nil {
+			log.Fatalf("❌ Invalid --uid-range: %v", err)
+		}
+		opts = append(opts, ldapserver.WithUIDRange(uids))
+	}
+	if gidRange != "" {
+		gids, err := derived.ParseIDRange(gidRange)
+		if err != nil {
+			log.Fatalf("❌ Invalid --gid-range: %v", err)
+		}
+		opts = append(opts, ldapserver.WithGIDRange(gids))
+	}
+
+	// Derive telephone numbers that the local phone system can route
+	if err := phoneFormat.Validate(); err != nil {
+		log.Fatalf("❌ Invalid phone format: %v", err)
+	}
+	opts = append(opts, ldapserver.WithPhoneFormat(phoneFormat))
+
+	// Keep this network's identities apart from every other one's, with a
+	// salt kept off the command line, where anyone on the host can read it
+	var salt []byte
+	if saltFile != "" {
+		var err error
+		if salt, err = derived.ReadSaltFile(saltFile); err != nil {
+			log.Fatalf("❌ Invalid --salt-file: %v", err)
+		}
+	} else if value := os.Getenv(derived.SaltEnv); value != "" {
+		salt = []byte(value)
+		if err := derived.CheckSalt(salt); err != nil {
+			log.Fatalf("❌ Invalid %s: %v", derived.SaltEnv, err)
+		}
+	}
+	if len(salt) > 0 {
+		opts = append(opts, ldapserver.WithSalt(salt))
+	}
+	if sipDomain != "" {
+		opts = append(opts, ldapserver.WithSIPDomain(sipDomain))
+	}
+
+	if extensionRange != "" {
+		extensions, err := ldapserver.ParseExtensionRange(extensionRange)
+		if err != nil {
+			log.Fatalf("❌ Invalid --extensions: %v", err)
+		}
+		if err := extensions.CheckDialPlan(phoneFormat); err != nil {
+			log.Fatalf("❌ Invalid --extensions: %v", err)
+		}
+		opts = append(opts, ldapserver.WithExtensions(extensions))
+	}
+
+	// Let the operator shape entries for their services
+	if attributeMap != "" {
+		mapping, err := attrmap.Load(attributeMap)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		opts = append(opts, ldapserver.WithAttributeMap(mapping))
+	}
+
+	// Resolve collisions of derived identities, and tell admins about them
+	policy, err := ldapserver.ParseCollisionPolicy(onCollision)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	opts = append(opts, ldapserver.WithCollisionPolicy(policy))
+	if collisionLog != "" {
+		f, err := os.OpenFile(collisionLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("❌ Failed to open collision log: %v", err)
+		}
+		defer f.Close()
+		encoder := json.NewEncoder(f)
+		opts = append(opts, ldapserver.WithCollisionReporter(func(c ldapserver.Collision) {
+			if err := encoder.Encode(c); err != nil {
+				log.Printf("⚠️  Failed to write collision log: %v", err)
+			}
+		}))
+	}
+
+	// Load the revocation list, and keep it up to date
+	if revokedKeys != "" {
+		list, err := revocation.Load(revokedKeys)
+		if err != nil {
+			log.Fatalf("❌ Failed to load revoked keys: %v", err)
+		}
+		stopWatching := list.Watch(5*time.Second, func(err error) {
+			log.Printf("⚠️  Keeping previous revoked keys: %v", err)
+		})
+		defer stopWatching()
+		opts = append(opts, ldapserver.WithRevocationList(list))
+	}
+
+	// Load the allowlist, and keep it up to date
+	if len(allowedKeys) > 0 {
+		list, err := allowlist.Load(allowedKeys...)
+		if err != nil {
+			log.Fatalf("❌ Failed to load allowed keys: %v", err)
+		}
+		stopWatching := list.Watch(5*time.Second, func(err error) {
+			log.Printf("⚠️  Keeping previous allowed keys: %v", err)
+		})
+		defer stopWatching()
+		opts = append(opts, ldapserver.WithAllowlist(list))
+	}
+
+	// Keep keys from anonymous readers, if asked to, and always with a salt:
+	// keys and their fingerprints are the same on every network
+	if entryNames == "" {
+		entryNames = "key"
+		if len(salt) > 0 {
+			entryNames = "uid"
+		}
+	}
+	naming, err := ldapserver.ParseEntryNaming(entryNames)
+	if err != nil {
+		log.Fatalf("❌ Invalid --entry-names: %v", err)
+	}
+	if len(salt) > 0 && naming != ldapserver.NameByUID {
+		log.Fatalf("❌ Invalid --entry-names: pseudonymous identities need --entry-names uid, since entries named by %s link them across networks", naming)
+	}
+	opts = append(opts, ldapserver.WithEntryNaming(naming))
+	if serviceAccounts != "" {
+		list, err := allowlist.Load(serviceAccounts)
+		if err != nil {
+			log.Fatalf("❌ Failed to load service accounts: %v", err)
+		}
+		stopWatching := list.Watch(5*time.Second, func(err error) {
+			log.Printf("⚠️  Keeping previous service accounts: %v", err)
+		})
+		defer stopWatching()
+		opts = append(opts, ldapserver.WithServiceAccounts(list))
+	}
+
+	// Accept invitations signed by admins, which only mean something when
+	// not everyone is let in anyway
+	if inviteAdmins != "" && len(allowedKeys) == 0 {
+		log.Fatalf("❌ --invite-admins needs --allowed-keys: without a closed community every key is admitted already")
+	}
+	if inviteAdmins != "" && network == "" {
+		log.Fatalf("❌ --invite-admins needs --network: invitations are minted for one network, so that they cannot be redeemed on others")
+	}
+	if inviteAdmins != "" {
+		admins, err := allowlist.Load(inviteAdmins)
+		if err != nil {
+			log.Fatalf("❌ Failed to load invitation admins: %v", err)
+		}
+		stopWatching := admins.Watch(5*time.Second, func(err error) {
+			log.Printf("⚠️  Keeping previous invitation admins: %v", err)
+		})
+		defer stopWatching()
+		store, err := invite.OpenFileStore(inviteStore)
+		if err != nil {
+			log.Fatalf("❌ Failed to open invitation store: %v", err)
+		}
+		opts = append(opts, ldapserver.WithInvitations(network, admins, store))
+	}
+
 	// Construct listen address
 	listenAddr := fmt.Sprintf("%s:%d", host, port)
 
@@ -22,7 +291,7 @@ func main() {
 	// The server validates SSH keys provided by clients in the BIND DN
 	// TODO: When we implement the identity manager (separate SSH server),
 	// we'll use this to pass the server's own key for validation
-	server := ldapserver.NewServer(listenAddr, nil)
+	server := ldapserver.NewServer(listenAddr, nil, opts...)
 
 	fmt.Println("╔════════════════════════════════════════════════════════════╗")
 	fmt.Println("║              LiliDAP LDAP Server Starting                  ║")
@@ -37,6 +306,56 @@ func main() {
 	fmt.Printf("🌐 Bind Address: %s\n", bindHost)
 	fmt.Printf("🔌 Port: %d\n", port)
 	fmt.Printf("📡 Listening on: %s\n", listenAddr)
+	if registryPath != "" {
+		fmt.Printf("🗂️  Registry: %s\n", registryPath)
+	}
+	if anonymousListing {
+		fmt.Printf("📖 Directory: anonymous clients may list every camper\n")
+	}
+	for _, scheme := range schemes {
+		fmt.Printf("🧬 Serving dc=%s,dc=bivvi (scheme %s: %s)\n", scheme.DC(), scheme, scheme.Summary)
+	}
+	if uidRange != "" {
+		fmt.Printf("🔢 uidNumber range: %s\n", uidRange)
+	}
+	if gidRange != "" {
+		fmt.Printf("🔢 gidNumber range: %s (one group per user)\n", gidRange)
+	}
+	if len(salt) > 0 {
+		fmt.Println("🥸 Identities: pseudonymous to this network")
+	}
+	fmt.Printf("📞 Phone numbers: %s\n", phoneFormat)
+	if sipDomain != "" {
+		fmt.Printf("📞 SIP domain: %s\n", sipDomain)
+	}
+	if extensionRange != "" {
+		fmt.Printf("☎️  Extensions: %s, given out on first bind\n", extensionRange)
+	}
+	if attributeMap != "" {
+		fmt.Printf("🧩 Attribute mapping: %s\n", attributeMap)
+	}
+	if languageDir != "" {
+		fmt.Printf("🗣️  Languages: %s from %s, besides the built-in ones\n", strings.Join(languages, ", "), languageDir)
+	}
+	fmt.Printf("👥 Identity collisions: %s\n", policy)
+	if naming != ldapserver.NameByKey {
+		fmt.Printf("🙈 Entries named by %s; full keys shown only to their owners\n", naming)
+		if serviceAccounts != "" {
+			fmt.Printf("🙈 Service accounts seeing every key: %s\n", serviceAccounts)
+		}
+	}
+	if collisionLog != "" {
+		fmt.Printf("📓 Collision log: %s\n", collisionLog)
+	}
+	if revokedKeys != "" {
+		fmt.Printf("🚫 Revoked keys: %s (reloaded on change)\n", revokedKeys)
+	}
+	if len(allowedKeys) > 0 {
+		fmt.Printf("🔒 Closed community: only keys in %s (reloaded on change)\n", allowedKeys.String())
+	}
+	if inviteAdmins != "" {
+		fmt.Printf("🎟️  Invitations: to %s, signed by keys in %s, redemptions kept in %s\n", network, inviteAdmins, inviteStore)
+	}
 
 	// Warnings for privileged ports and defaults
 	if port == 389 {
@@ -51,11 +370,11 @@ func main() {
 
 	fmt.Println()
 	fmt.Println("📋 How to authenticate:")
-	fmt.Println("   DN (Username): cn=<your-ssh-public-key>,ou=campers,dc=0_1_0,dc=bivvi")
+	fmt.Printf("   DN (Username): cn=<your-ssh-public-key>,ou=campers,dc=%s,dc=bivvi\n", schemes[0].DC())
 	fmt.Println("   Password: <your-ssh-server-host>:<port>")
 	fmt.Println()
 	fmt.Println("📝 Example:")
-	fmt.Println("   DN: cn=ssh-rsa AAAAB3NzaC1yc2E...,ou=campers,dc=0_1_0,dc=bivvi")
+	fmt.Printf("   DN: cn=ssh-rsa AAAAB3NzaC1yc2E...,ou=campers,dc=%s,dc=bivvi\n", schemes[0].DC())
 	fmt.Println("   Password: 192.168.1.100:22")
 	fmt.Println()
 	fmt.Println("🔍 Test with:")
@@ -0,0 +1,205 @@
+package allowlist
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lilidap/internal/filewatch"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ * This package restricts a deployment to a known set of SSH keys, for
+ * closed communities such as a staff-only network at an event.
+ *
+ * Allowlists are authorized_keys files. Two per-key options are understood:
+ *  - expiry-time="YYYYMMDD[HHMM[SS]][Z]" as in sshd(8), after which the key is refused
+ *  - groups="staff,medics", the groups the key holder belongs to
+ * Other options are ignored, so existing authorized_keys files can be reused.
+ */
+
+// Entry is a permitted key together with its options
+type Entry struct {
+	Key     ssh.PublicKey
+	Comment string
+	Expires time.Time // zero means the key never expires
+	Groups  []string
+}
+
+// Expired reports whether the entry is past its expiry time
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// List is a reloadable set of permitted keys backed by one or more files
+type List struct {
+	paths   []string
+	mu      sync.RWMutex
+	entries map[string]*Entry // keyed by marshaled public key
+}
+
+// Load reads the given authorized_keys files into a new List
+func Load(paths ...string) (*List, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("at least one allowlist file is required")
+	}
+	list := &List{paths: paths}
+	if err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Paths returns the files backing the list
+func (l *List) Paths() []string {
+	return l.paths
+}
+
+// Reload re-reads all backing files, keeping the old content on failure
+func (l *List) Reload() error {
+	entries := make(map[string]*Entry)
+	for _, path := range l.paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read allowlist: %w", err)
+		}
+		if err := parseAuthorizedKeys(data, entries); err != nil {
+			return fmt.Errorf("failed to parse allowlist %s: %w", path, err)
+		}
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the list whenever one of its files changes, reporting reload
+// errors through onError. It returns a function that stops watching.
+func (l *List) Watch(interval time.Duration, onError func(error)) func() {
+	return filewatch.Watch(l.paths, interval, func() {
+		if err := l.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// Lookup returns the entry for the key, if it is on the list
+func (l *List) Lookup(key ssh.PublicKey) (*Entry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[string(key.Marshal())]
+	return entry, ok
+}
+
+// Check returns the entry for the key, or an error explaining why it is not permitted
+func (l *List) Check(key ssh.PublicKey, now time.Time) (*Entry, error) {
+	entry, ok := l.Lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("key is not on the allowlist")
+	}
+	if entry.Expired(now) {
+		return nil, fmt.Errorf("key expired on %s", entry.Expires.Format(time.RFC3339))
+	}
+	return entry, nil
+}
+
+// Len returns the number of permitted keys
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// parseAuthorizedKeys adds the keys in data to entries, merging duplicates
+func parseAuthorizedKeys(data []byte, entries map[string]*Entry) error {
+	for lineNo, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pubKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo+1, err)
+		}
+		entry := &Entry{Key: pubKey, Comment: comment}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(name) {
+			case "expiry-time":
+				entry.Expires, err = parseExpiryTime(value)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", lineNo+1, err)
+				}
+			case "groups":
+				for _, group := range strings.Split(value, ",") {
+					if group = strings.TrimSpace(group); group != "" {
+						entry.Groups = append(entry.Groups, group)
+					}
+				}
+			}
+		}
+
+		keyID := string(pubKey.Marshal())
+		if existing, ok := entries[keyID]; ok {
+			entry = mergeEntries(existing, entry)
+		}
+		entries[keyID] = entry
+	}
+	return nil
+}
+
+// mergeEntries combines two entries for the same key: the union of their
+// groups, and the more generous of their expiry times
+func mergeEntries(a, b *Entry) *Entry {
+	merged := &Entry{Key: a.Key, Comment: a.Comment, Expires: a.Expires}
+	if a.Expires.IsZero() || b.Expires.IsZero() {
+		merged.Expires = time.Time{}
+	} else if b.Expires.After(a.Expires) {
+		merged.Expires = b.Expires
+	}
+
+	seen := make(map[string]bool)
+	for _, group := range append(append([]string{}, a.Groups...), b.Groups...) {
+		if !seen[group] {
+			seen[group] = true
+			merged.Groups = append(merged.Groups, group)
+		}
+	}
+	sort.Strings(merged.Groups)
+	return merged
+}
+
+// parseExpiryTime reads the sshd(8) expiry-time format YYYYMMDD[HHMM[SS]][Z],
+// in local time unless suffixed with Z
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	expires, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q: %w", value, err)
+	}
+	return expires, nil
+}
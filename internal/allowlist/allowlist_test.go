@@ -0,0 +1,100 @@
+package allowlist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lilidap/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+	otherKey, err := testutils.GetRandomPublicKey()
+	require.NoError(t, err)
+
+	staff := writeFile(t, "staff", "# event staff\n"+
+		`expiry-time="20300101",groups="staff,medics" `+testutils.TestPublicKeyString+"\n")
+	list, err := Load(staff)
+	require.NoError(t, err)
+
+	t.Run("Listed key is permitted", func(t *testing.T) {
+		entry, err := list.Check(testKey, time.Date(2029, 6, 1, 0, 0, 0, 0, time.Local))
+		assert.NoError(err)
+		assert.Equal("test@lilidap", entry.Comment)
+		assert.Equal([]string{"staff", "medics"}, entry.Groups)
+	})
+
+	t.Run("Expired key is refused", func(t *testing.T) {
+		_, err := list.Check(testKey, time.Date(2030, 1, 1, 0, 0, 0, 0, time.Local))
+		assert.ErrorContains(err, "expired")
+	})
+
+	t.Run("Unlisted key is refused", func(t *testing.T) {
+		_, err := list.Check(otherKey, time.Now())
+		assert.ErrorContains(err, "not on the allowlist")
+	})
+
+	t.Run("Multiple files are merged", func(t *testing.T) {
+		volunteers := writeFile(t, "volunteers", `groups="volunteers" `+testutils.TestPublicKeyString+"\n")
+		merged, err := Load(staff, volunteers)
+		require.NoError(t, err)
+		assert.Equal(1, merged.Len())
+
+		entry, err := merged.Check(testKey, time.Date(2031, 1, 1, 0, 0, 0, 0, time.Local))
+		assert.NoError(err, "Entry without expiry should win")
+		assert.Equal([]string{"medics", "staff", "volunteers"}, entry.Groups)
+	})
+
+	t.Run("Invalid expiry is rejected", func(t *testing.T) {
+		_, err := Load(writeFile(t, "bad", `expiry-time="tomorrow" `+testutils.TestPublicKeyString+"\n"))
+		assert.Error(err)
+	})
+}
+
+func TestParseExpiryTime(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := map[string]time.Time{
+		"20261231":        time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local),
+		"202612312359":    time.Date(2026, 12, 31, 23, 59, 0, 0, time.Local),
+		"20261231235958":  time.Date(2026, 12, 31, 23, 59, 58, 0, time.Local),
+		"20261231Z":       time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC),
+		"20261231235958Z": time.Date(2026, 12, 31, 23, 59, 58, 0, time.UTC),
+	}
+	for input, expected := range testCases {
+		actual, err := parseExpiryTime(input)
+		assert.NoError(err)
+		assert.Truef(expected.Equal(actual), "For %s, expected %s, got %s", input, expected, actual)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+
+	path := writeFile(t, "allowed", "")
+	list, err := Load(path)
+	require.NoError(t, err)
+	stop := list.Watch(10*time.Millisecond, func(err error) { t.Log(err) })
+	defer stop()
+
+	require.NoError(t, os.WriteFile(path, []byte(testutils.TestPublicKeyString+"\n"), 0644))
+	assert.Eventually(t, func() bool {
+		_, ok := list.Lookup(testKey)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
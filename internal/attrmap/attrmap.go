@@ -0,0 +1,193 @@
+package attrmap
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"lilidap/internal/derived"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * This package lets operators configure extra attributes of user entries,
+ * each a Go template over the methods of derived.UserAttributes:
+ *
+ *	objectClasses: [extensibleObject]
+ *	attributes:
+ *	  mail: "{{.Username}}@camp.lan"
+ *	  homeDirectory: "/srv/home/{{.Username}}"
+ *	  loginShell: /bin/sh
+ *	  gecos: "{{.DisplayName \"en\"}}"
+ *
+ * Configured attributes are added to the defaults, which reproduce the
+ * attributes lilidap always had, or replace a default of the same name.
+ * An empty template removes a default; a template giving an empty string
+ * leaves the attribute out of that entry.
+ */
+
+// Defaults are the templated attributes of an unconfigured server
+var Defaults = []struct{ Name, Template string }{
+	{"gidNumber", "{{.PosixGroupID}}"},
+	{"homeDirectory", "/home/{{.Username}}"},
+}
+
+// reserved attributes carry the derived identity and cannot be configured
+var reserved = []string{
+	"objectClass", "uid", "uidNumber", "telephoneNumber", "displayName", "cn",
+	"memberOf", "sshPublicKey", "sshKeyFingerprint", "sshKeyType",
+}
+
+// sample is a user for trying out templates
+var sample = func() *derived.UserAttributes {
+	key, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	if err != nil {
+		panic(err)
+	}
+	return derived.FromPublicKey(key)
+}()
+
+// Attribute is a named attribute template
+type Attribute struct {
+	Name     string
+	Template *template.Template
+}
+
+// Mapping is the set of templated attributes of user entries
+type Mapping struct {
+	ObjectClasses []string // added to those of every entry
+	Attributes    []Attribute
+}
+
+// Value is an attribute value produced by a mapping
+type Value struct {
+	Name, Value string
+}
+
+// Default returns the mapping of an unconfigured server
+func Default() *Mapping {
+	m := &Mapping{}
+	for _, attr := range Defaults {
+		if err := m.set(attr.Name, attr.Template); err != nil {
+			panic(err) // the defaults are known to parse
+		}
+	}
+	return m
+}
+
+// Load reads a mapping file
+func Load(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attribute mapping: %w", err)
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse attribute mapping %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Parse reads a mapping in YAML, applying it over the defaults
+func Parse(data []byte) (*Mapping, error) {
+	var config struct {
+		ObjectClasses []string  `yaml:"objectClasses"`
+		Attributes    yaml.Node `yaml:"attributes"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	m := Default()
+	for _, class := range config.ObjectClasses {
+		if strings.TrimSpace(class) == "" {
+			return nil, fmt.Errorf("empty object class")
+		}
+		m.ObjectClasses = append(m.ObjectClasses, strings.TrimSpace(class))
+	}
+
+	// Walk the node rather than decoding a map, to keep the attribute order
+	attrs := &config.Attributes
+	if attrs.Kind == 0 {
+		return m, nil
+	}
+	if attrs.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: attributes must map names to templates", attrs.Line)
+	}
+	for i := 0; i+1 < len(attrs.Content); i += 2 {
+		name, value := attrs.Content[i], attrs.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: the template of %s must be a string", value.Line, name.Value)
+		}
+		if err := m.set(name.Value, value.Value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", name.Line, err)
+		}
+	}
+	return m, nil
+}
+
+// set adds, replaces or (given an empty template) removes an attribute
+func (m *Mapping) set(name, text string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " ,=;") {
+		return fmt.Errorf("invalid attribute name %q", name)
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return fmt.Errorf("%s is derived by lilidap and cannot be configured", r)
+		}
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	// Catch misspelled methods now rather than when entries are built
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return err
+	}
+
+	for i, attr := range m.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			if text == "" {
+				m.Attributes = append(m.Attributes[:i], m.Attributes[i+1:]...)
+			} else {
+				m.Attributes[i] = Attribute{name, tmpl}
+			}
+			return nil
+		}
+	}
+	if text != "" {
+		m.Attributes = append(m.Attributes, Attribute{name, tmpl})
+	}
+	return nil
+}
+
+// Apply executes the templates for one user, in order. Attributes whose
+// template fails are left out and reported in the error.
+func (m *Mapping) Apply(attrs *derived.UserAttributes) ([]Value, error) {
+	var values []Value
+	var errs []string
+	for _, attr := range m.Attributes {
+		var b strings.Builder
+		if err := attr.Template.Execute(&b, attrs); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if b.Len() > 0 {
+			values = append(values, Value{attr.Name, b.String()})
+		}
+	}
+	if len(errs) > 0 {
+		return values, fmt.Errorf("attribute templates failed: %s", strings.Join(errs, "; "))
+	}
+	return values, nil
+}
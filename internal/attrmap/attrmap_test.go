@@ -0,0 +1,93 @@
+package attrmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lilidap/internal/derived"
+	"lilidap/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func apply(t *testing.T, m *Mapping, attrs *derived.UserAttributes) map[string]string {
+	values, err := m.Apply(attrs)
+	require.NoError(t, err)
+	result := map[string]string{}
+	for _, value := range values {
+		result[value.Name] = value.Value
+	}
+	return result
+}
+
+func TestMapping(t *testing.T) {
+	pubKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+	attrs := derived.FromPublicKey(pubKey)
+
+	t.Run("Defaults match the built-in attributes", func(t *testing.T) {
+		assert.Equal(t, map[string]string{
+			"gidNumber":     "1001",
+			"homeDirectory": "/home/" + attrs.Username(),
+		}, apply(t, Default(), attrs))
+
+		m, err := Parse(nil)
+		require.NoError(t, err)
+		assert.Equal(t, apply(t, Default(), attrs), apply(t, m, attrs))
+	})
+
+	t.Run("Configured attributes", func(t *testing.T) {
+		m, err := Parse([]byte(`
+objectClasses: [extensibleObject]
+attributes:
+  mail: "{{.Username}}@camp.lan"
+  homeDirectory: "/srv/home/{{.Username}}"
+  loginShell: /bin/sh
+  gecos: '{{.DisplayName "en"}}'
+  gidNumber: ""
+`))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"extensibleObject"}, m.ObjectClasses)
+		assert.Equal(t, map[string]string{
+			"homeDirectory": "/srv/home/" + attrs.Username(),
+			"mail":          attrs.Username() + "@camp.lan",
+			"loginShell":    "/bin/sh",
+			"gecos":         attrs.DisplayName("en"),
+		}, apply(t, m, attrs))
+
+		// Defaults keep their place, new attributes follow in file order
+		var names []string
+		for _, attr := range m.Attributes {
+			names = append(names, attr.Name)
+		}
+		assert.Equal(t, []string{"homeDirectory", "mail", "loginShell", "gecos"}, names)
+	})
+
+	t.Run("Invalid mappings", func(t *testing.T) {
+		for _, config := range []string{
+			"attributes:\n  uid: '{{.Username}}'\n",
+			"attributes:\n  mail: '{{.Username'\n",
+			"attributes:\n  mail: '{{.NoSuchField}}'\n",
+			"attributes:\n  mail: [a, b]\n",
+			"attributes: [mail]\n",
+			"attribute:\n  mail: x\n",
+			"objectClasses: ['']\n",
+		} {
+			_, err := Parse([]byte(config))
+			assert.Error(t, err, config)
+		}
+	})
+
+	t.Run("Load", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "attributes.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("attributes:\n  loginShell: /bin/bash\n"), 0644))
+		m, err := Load(path)
+		require.NoError(t, err)
+		assert.Equal(t, "/bin/bash", apply(t, m, attrs)["loginShell"])
+
+		_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.Error(t, err)
+	})
+}
@@ -2,18 +2,35 @@ package base32
 
 import (
 	"fmt"
-	"math"
+	"strings"
+	"unicode"
 )
 
 /*
  * This package encodes bits in a custom base32 character set for
  * safe and ergonomic use of hashed data
+ *
+ * Identifiers encoded with it get read aloud over radios and typed on phones,
+ * so decoding is lenient about confusable characters, and an optional check
+ * character catches the typos that remain.
  */
 
 // Omit confusable characters like in Base58, but also all the capitals and j and u
 // Start with o and the digits to resemble hex, which aids debugging a bit
 const base32Chars = "o123456789abcdefghikmnpqrstvwxyz"
 
+// decodeMap maps each character of the alphabet to its value, and everything else to 0xFF
+var decodeMap = func() [256]byte {
+	var m [256]byte
+	for i := range m {
+		m[i] = 0xFF
+	}
+	for i := 0; i < len(base32Chars); i++ {
+		m[base32Chars[i]] = byte(i)
+	}
+	return m
+}()
+
 // get a chunk of bits from a byte array, given a start bit and a chunk length n
 func GetBits(input []byte, start int, n int) (uint, error) {
 	if n > 8 || n < 1 {
@@ -43,17 +60,192 @@ func GetBits(input []byte, start int, n int) (uint, error) {
 	return (firstByteBits << secondByteBitsNeeded) | secondByteBits, nil
 }
 
+// EncodedLen returns the number of characters encoding numBits bits
+func EncodedLen(numBits int) int {
+	return (numBits + 4) / 5
+}
+
 // encode a given length of bits to a base32 string
 func Encode(input []byte, numBits int) (string, error) {
-	outputLength := int(math.Ceil(float64(numBits) / 5))
-	encoded := ""
-	for i := 0; i < outputLength; i++ {
-		value, err := GetBits(input, 5*i, 5)
+	encoded, err := AppendEncode(make([]byte, 0, EncodedLen(numBits)), input, numBits)
+	return string(encoded), err
+}
+
+// AppendEncode appends the encoding of the first numBits bits of input to dst.
+// A last character running past the end of input is padded with zeros.
+func AppendEncode(dst []byte, input []byte, numBits int) ([]byte, error) {
+	for i := 0; i < EncodedLen(numBits); i++ {
+		n := min(5, 8*len(input)-5*i)
+		if n < 1 {
+			return dst, fmt.Errorf("%d bits exceed input length of %d", numBits, len(input))
+		}
+		value, err := GetBits(input, 5*i, n)
 		if err != nil {
-			return "", err
+			return dst, err
+		}
+		dst = append(dst, base32Chars[value<<(5-n)])
+	}
+	return dst, nil
+}
+
+// Decode decodes a base32 string, leniently: the input is normalized first.
+// Each character holds 5 bits, packed from the most significant bit of the
+// first byte on, so the result has 5*len(s) bits followed by zero padding.
+func Decode(s string) ([]byte, error) {
+	normalized := Normalize(s)
+	output := make([]byte, (5*len(normalized)+7)/8)
+	for i := 0; i < len(normalized); i++ {
+		value := decodeMap[normalized[i]]
+		if value == 0xFF {
+			return nil, fmt.Errorf("invalid base32 character %q at position %d", normalized[i], i)
+		}
+		for bit := 0; bit < 5; bit++ {
+			if value&(0x10>>bit) != 0 {
+				pos := 5*i + bit
+				output[pos/8] |= 0x80 >> (pos % 8)
+			}
+		}
+	}
+	return output, nil
+}
+
+// Normalize maps what people type when copying an encoded string by hand onto
+// the alphabet: 0 and O become o, l, L and I become 1, and the rest is
+// lowercased. Characters that cannot be mapped are kept as they are, so the
+// result never matches a valid encoding by accident.
+func Normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '0', 'O':
+			return 'o'
+		case 'l', 'L', 'I':
+			return '1'
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// The check character is computed like Damm's algorithm, with the quasigroup
+// x∘y = 2x + y over GF(32). It catches every single substituted character and
+// every swap of two adjacent characters.
+
+// double multiplies by x in GF(32), modulo x^5 + x^2 + 1
+func double(v byte) byte {
+	v <<= 1
+	if v&0x20 != 0 {
+		v ^= 0x25
+	}
+	return v
+}
+
+// checkValue folds normalized characters into the value of their check character
+func checkValue(normalized string) (byte, error) {
+	var interim byte
+	for i := 0; i < len(normalized); i++ {
+		value := decodeMap[normalized[i]]
+		if value == 0xFF {
+			return 0, fmt.Errorf("invalid base32 character %q at position %d", normalized[i], i)
+		}
+		interim = double(interim) ^ value
+	}
+	return double(interim), nil
+}
+
+// Check returns the check character for an encoded string
+func Check(encoded string) (byte, error) {
+	value, err := checkValue(Normalize(encoded))
+	if err != nil {
+		return 0, err
+	}
+	return base32Chars[value], nil
+}
+
+// EncodeChecked encodes like Encode, followed by a check character
+func EncodeChecked(input []byte, numBits int) (string, error) {
+	encoded, err := AppendEncode(make([]byte, 0, EncodedLen(numBits)+1), input, numBits)
+	if err != nil {
+		return "", err
+	}
+	check, err := checkValue(string(encoded))
+	if err != nil {
+		return "", err
+	}
+	return string(append(encoded, base32Chars[check])), nil
+}
+
+// Verify reports whether the last character of a string is the right check
+// character for the rest, returning the normalized string without it
+func Verify(s string) (string, bool) {
+	normalized := Normalize(s)
+	if len(normalized) < 2 {
+		return "", false
+	}
+	body, check := normalized[:len(normalized)-1], normalized[len(normalized)-1]
+	value, err := checkValue(body)
+	if err != nil || base32Chars[value] != check {
+		return "", false
+	}
+	return body, true
+}
+
+// DecodeChecked verifies the check character of a string and decodes the rest
+func DecodeChecked(s string) ([]byte, error) {
+	body, ok := Verify(s)
+	if !ok {
+		return nil, fmt.Errorf("base32 check character of %q does not match: mistyped?", s)
+	}
+	return Decode(body)
+}
+
+// Value is a string of bits with a base32 text form. It implements
+// encoding.TextMarshaler and encoding.TextUnmarshaler, so identifiers can be
+// kept in JSON, YAML or command line flags.
+type Value struct {
+	Data    []byte
+	Bits    int  // number of bits of Data encoded; 0 means all of them
+	Checked bool // whether the text form ends with a check character
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (v Value) MarshalText() ([]byte, error) {
+	bits := v.Bits
+	if bits == 0 {
+		bits = 8 * len(v.Data)
+	}
+	encoded, err := AppendEncode(make([]byte, 0, EncodedLen(bits)+1), v.Data, bits)
+	if err != nil || !v.Checked {
+		return encoded, err
+	}
+	check, err := checkValue(string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, base32Chars[check]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Set Checked beforehand
+// to require and strip a check character.
+func (v *Value) UnmarshalText(text []byte) error {
+	body := string(text)
+	if v.Checked {
+		var ok bool
+		if body, ok = Verify(body); !ok {
+			return fmt.Errorf("base32 check character of %q does not match: mistyped?", text)
 		}
-		encoded += string(base32Chars[value])
 	}
-	return encoded, nil
+	data, err := Decode(body)
+	if err != nil {
+		return err
+	}
+	v.Data = data
+	v.Bits = 5 * len(body)
+	return nil
+}
 
+func (v Value) String() string {
+	text, err := v.MarshalText()
+	if err != nil {
+		return fmt.Sprintf("!base32(%v)", err)
+	}
+	return string(text)
 }
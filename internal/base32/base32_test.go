@@ -1,7 +1,9 @@
 package base32_test
 
 import (
+	"encoding/json"
 	"lilidap/internal/base32"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -43,3 +45,100 @@ func TestBase32Encode(t *testing.T) {
 	compareEncode(t, []byte{0xFF, 0xFF}, 10, "zz")
 	compareEncode(t, []byte{0xA4, 0x36, 0x8B, 0xC4, 0x73}, 40, "mgv8qh3k")
 }
+
+func TestBase32Normalize(t *testing.T) {
+	require.Equal(t, "mgv8qh3k", base32.Normalize("MGV8QH3K"))
+	require.Equal(t, "o1o1ab", base32.Normalize("0lOIab"))
+	require.Equal(t, "o1o1ab", base32.Normalize("o1o1ab"), "Valid input is unchanged")
+	require.Equal(t, "ij-u", base32.Normalize("iJ-u"), "Unmappable characters are kept")
+}
+
+func TestBase32Decode(t *testing.T) {
+	decoded, err := base32.Decode("mgv8qh3k")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xA4, 0x36, 0x8B, 0xC4, 0x73}, decoded)
+
+	decoded, err = base32.Decode("MGV8QH3K")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xA4, 0x36, 0x8B, 0xC4, 0x73}, decoded, "Decoding is case-insensitive")
+
+	decoded, err = base32.Decode("zz")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xFF, 0xC0}, decoded, "Partial bytes are padded with zeros")
+
+	_, err = base32.Decode("mgv8qhjk")
+	require.Error(t, err, "j is not in the alphabet")
+
+	// Round trip every byte value
+	input := make([]byte, 256)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	encoded, err := base32.Encode(input, 8*len(input))
+	require.NoError(t, err)
+	require.Len(t, encoded, base32.EncodedLen(8*len(input)))
+	decoded, err = base32.Decode(encoded)
+	require.NoError(t, err)
+	require.Equal(t, input, decoded[:len(input)])
+}
+
+func TestBase32Check(t *testing.T) {
+	input := []byte{0xA4, 0x36, 0x8B, 0xC4, 0x73}
+	checked, err := base32.EncodeChecked(input, 40)
+	require.NoError(t, err)
+	require.Len(t, checked, 9)
+	require.Equal(t, "mgv8qh3k", checked[:8])
+
+	decoded, err := base32.DecodeChecked(checked)
+	require.NoError(t, err)
+	require.Equal(t, input, decoded)
+
+	decoded, err = base32.DecodeChecked(strings.ToUpper(checked))
+	require.NoError(t, err, "Check characters survive normalization")
+	require.Equal(t, input, decoded)
+
+	const alphabet = "o123456789abcdefghikmnpqrstvwxyz"
+	t.Run("Every substitution is caught", func(t *testing.T) {
+		for i := range checked {
+			for _, c := range alphabet {
+				if byte(c) == checked[i] {
+					continue
+				}
+				typo := checked[:i] + string(c) + checked[i+1:]
+				_, err := base32.DecodeChecked(typo)
+				require.Errorf(t, err, "%s should not pass for %s", typo, checked)
+			}
+		}
+	})
+
+	t.Run("Every adjacent swap is caught", func(t *testing.T) {
+		for i := 0; i+1 < len(checked); i++ {
+			if checked[i] == checked[i+1] {
+				continue
+			}
+			typo := checked[:i] + string(checked[i+1]) + string(checked[i]) + checked[i+2:]
+			_, err := base32.DecodeChecked(typo)
+			require.Errorf(t, err, "%s should not pass for %s", typo, checked)
+		}
+	})
+}
+
+func TestBase32Value(t *testing.T) {
+	value := base32.Value{Data: []byte{0xA4, 0x36, 0x8B, 0xC4, 0x73}, Checked: true}
+	text, err := value.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, value.String(), string(text))
+
+	// Values embed in JSON as strings
+	data, err := json.Marshal(map[string]base32.Value{"id": value})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"`+string(text)+`"}`, string(data))
+
+	parsed := base32.Value{Checked: true}
+	require.NoError(t, parsed.UnmarshalText(text))
+	require.Equal(t, value.Data, parsed.Data)
+	require.Equal(t, 40, parsed.Bits)
+
+	text[0] = 'z'
+	require.Error(t, parsed.UnmarshalText(text))
+}
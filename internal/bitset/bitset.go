@@ -1,13 +1,19 @@
 package bitset
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math"
+	"math/big"
 	"math/bits"
+	"strconv"
 	"strings"
 )
 
-// BitSet represents an arbitrary-length array of bits
+// BitSet represents an arbitrary-length array of bits. Bit i has the value
+// 2^i when the set is read as a number; bits past the size are always zero,
+// so that whole words can be compared.
 type BitSet struct {
 	bits []uint64
 	size int
@@ -30,7 +36,8 @@ func FromBools(bools []bool) *BitSet {
 	return bs
 }
 
-// FromBytes creates a BitSet from a byte array with optional length
+// FromBytes creates a BitSet from a big-endian byte array with optional
+// length, keeping the low bits of the last bytes
 func FromBytes(bytes []byte, length ...int) *BitSet {
 	size := len(bytes) * 8
 	if len(length) > 0 && length[0] > 0 && length[0] <= size {
@@ -38,21 +45,53 @@ func FromBytes(bytes []byte, length ...int) *BitSet {
 	}
 
 	bs := New(size)
-	for i := 0; i < size; i++ {
-		bytePos, bitPos := len(bytes)-1-i/8, i%8
-		bs.Set(i, bytes[bytePos]&(1<<bitPos) != 0)
+	for i := range bs.bits {
+		// Word i holds the eight bytes before the last 8*i
+		end := len(bytes) - 8*i
+		if end >= 8 {
+			bs.bits[i] = binary.BigEndian.Uint64(bytes[end-8 : end])
+			continue
+		}
+		var word [8]byte
+		copy(word[8-end:], bytes[:end])
+		bs.bits[i] = binary.BigEndian.Uint64(word[:])
 	}
+	bs.trim()
 	return bs
 }
 
+// FromInt creates a BitSet of the given size from the low bits of an integer
 func FromInt(num int, size int) *BitSet {
 	bs := New(size)
-	for i := 0; i < size; i++ {
-		bs.Set(i, num&(1<<i) != 0)
+	if len(bs.bits) > 0 {
+		bs.bits[0] = uint64(num)
 	}
+	bs.trim()
 	return bs
 }
 
+// FromBigInt creates a BitSet of the given size from the low bits of a
+// non-negative big integer
+func FromBigInt(num *big.Int, size int) *BitSet {
+	if num.Sign() < 0 {
+		panic(fmt.Sprintf("BitSet cannot hold negative number %s", num))
+	}
+	bytes := num.Bytes()
+	if size > len(bytes)*8 {
+		padded := make([]byte, (size+7)/8)
+		copy(padded[len(padded)-len(bytes):], bytes)
+		bytes = padded
+	}
+	return FromBytes(bytes, size)
+}
+
+// trim clears the bits of the last word past the size
+func (bs *BitSet) trim() {
+	if extra := bs.size % 64; extra != 0 {
+		bs.bits[len(bs.bits)-1] &= 1<<extra - 1
+	}
+}
+
 // Size returns the number of bits in the BitSet
 func (bs *BitSet) Size() int {
 	return bs.size
@@ -114,12 +153,108 @@ func (bs *BitSet) Slice(start, end int) *BitSet {
 	}
 
 	result := New(end - start)
-	for i := start; i < end; i++ {
-		result.Set(i-start, bs.Get(i))
+	first, shift := start/64, start%64
+	for i := range result.bits {
+		word := bs.bits[first+i] >> shift
+		if shift > 0 && first+i+1 < len(bs.bits) {
+			word |= bs.bits[first+i+1] << (64 - shift)
+		}
+		result.bits[i] = word
 	}
+	result.trim()
 	return result
 }
 
+// orAt ORs the bits of other into the set, starting at bit offset
+func (bs *BitSet) orAt(other *BitSet, offset int) {
+	first, shift := offset/64, offset%64
+	for i, word := range other.bits {
+		bs.bits[first+i] |= word << shift
+		if shift > 0 && first+i+1 < len(bs.bits) {
+			bs.bits[first+i+1] |= word >> (64 - shift)
+		}
+	}
+}
+
+// ShiftLeft returns the bits moved n places up, towards higher values, as
+// multiplying by 2^n does; bits moved past the size are lost. A negative n
+// shifts right.
+func (bs *BitSet) ShiftLeft(n int) *BitSet {
+	if n < 0 {
+		return bs.ShiftRight(-n)
+	}
+	result := New(bs.size)
+	if n < bs.size {
+		result.orAt(bs.Slice(0, bs.size-n), n)
+	}
+	return result
+}
+
+// ShiftRight returns the bits moved n places down, as dividing by 2^n does.
+// A negative n shifts left.
+func (bs *BitSet) ShiftRight(n int) *BitSet {
+	if n < 0 {
+		return bs.ShiftLeft(-n)
+	}
+	result := New(bs.size)
+	if n < bs.size {
+		result.orAt(bs.Slice(n, bs.size), 0)
+	}
+	return result
+}
+
+// RotateLeft returns the bits moved n places up, the bits moved past the
+// size coming back in at the bottom. A negative n rotates right.
+func (bs *BitSet) RotateLeft(n int) *BitSet {
+	if bs.size == 0 {
+		return New(0)
+	}
+	n %= bs.size
+	if n < 0 {
+		n += bs.size
+	}
+	return Concat(bs.Slice(bs.size-n, bs.size), bs.Slice(0, bs.size-n))
+}
+
+// RotateRight returns the bits moved n places down, the bits moved past the
+// bottom coming back in at the top
+func (bs *BitSet) RotateRight(n int) *BitSet {
+	return bs.RotateLeft(-(n % max(bs.size, 1)))
+}
+
+// NextSet returns the index of the first set bit at or after i, and false
+// if there is none. Iterate over the set bits with
+//
+//	for i, ok := bs.NextSet(0); ok; i, ok = bs.NextSet(i + 1) {
+func (bs *BitSet) NextSet(i int) (int, bool) {
+	if i < 0 {
+		i = 0
+	}
+	if i >= bs.size {
+		return 0, false
+	}
+	idx := i / 64
+	word := bs.bits[idx] >> (i % 64)
+	if word != 0 {
+		return i + bits.TrailingZeros64(word), true
+	}
+	for idx++; idx < len(bs.bits); idx++ {
+		if bs.bits[idx] != 0 {
+			return idx*64 + bits.TrailingZeros64(bs.bits[idx]), true
+		}
+	}
+	return 0, false
+}
+
+// SetBits returns the indices of the set bits, in increasing order
+func (bs *BitSet) SetBits() []int {
+	indices := make([]int, 0, bs.Count())
+	for i, ok := bs.NextSet(0); ok; i, ok = bs.NextSet(i + 1) {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
 // And performs a bitwise AND with another BitSet
 func (bs *BitSet) And(other *BitSet) *BitSet {
 	size := bs.size
@@ -133,6 +268,7 @@ func (bs *BitSet) And(other *BitSet) *BitSet {
 			result.bits[i] = bs.bits[i] & other.bits[i]
 		}
 	}
+	result.trim()
 	return result
 }
 
@@ -187,32 +323,52 @@ func (bs *BitSet) ToBools() []bool {
 	return bools
 }
 
-// ToBytes converts the BitSet to a byte array and its bit length
+// ToBytes converts the BitSet to a big-endian byte array, as FromBytes reads
 func (bs *BitSet) ToBytes() []byte {
 	byteLen := (bs.size + 7) / 8
 	bytes := make([]byte, byteLen)
 
-	for i := 0; i < bs.size; i++ {
-		bytePos, bitPos := len(bytes)-1-i/8, i%8
-		bytes[bytePos] |= byte(bs.GetInt(i) << bitPos)
+	var word [8]byte
+	for i, w := range bs.bits {
+		binary.BigEndian.PutUint64(word[:], w)
+		end := byteLen - 8*i
+		if end >= 8 {
+			copy(bytes[end-8:end], word[:])
+		} else {
+			copy(bytes[:end], word[8-end:])
+		}
 	}
 
 	return bytes
 }
 
-// ToInt converts the BitSet to an integer value and its bit length
-// Note: This will only work correctly for BitSets that fit in an int
+// ToInt converts the BitSet to an integer. It panics if the value does not
+// fit in an int; use ToUint64 or ToBigInt for larger values.
 func (bs *BitSet) ToInt() int {
-	if bs.size > 64 {
-		panic("BitSet too large to convert to int")
+	val := bs.ToUint64()
+	if val > math.MaxInt {
+		panic(fmt.Sprintf("%s does not fit in an int", bs))
 	}
+	return int(val)
+}
 
-	var val int
-	for i := 0; i < bs.size; i++ {
-		val |= bs.GetInt(i) << i
+// ToUint64 converts the BitSet to an unsigned integer. It panics if a bit
+// past the 64th is set.
+func (bs *BitSet) ToUint64() uint64 {
+	for _, word := range bs.bits[min(1, len(bs.bits)):] {
+		if word != 0 {
+			panic(fmt.Sprintf("%s does not fit in 64 bits", bs))
+		}
 	}
+	if len(bs.bits) == 0 {
+		return 0
+	}
+	return bs.bits[0]
+}
 
-	return val
+// ToBigInt converts the BitSet to a big integer of any size
+func (bs *BitSet) ToBigInt() *big.Int {
+	return new(big.Int).SetBytes(bs.ToBytes())
 }
 
 // ToString returns a string representation of the BitSet as binary digits
@@ -261,7 +417,8 @@ func (bs *BitSet) ToStringDecimal() string {
 	// log10(2^n) = n * log10(2)
 	// We add 1 because log gives us one less than the number of digits
 	digits := int(math.Floor(float64(bs.size)*math.Log10(2))) + 1
-	return fmt.Sprintf("%0*d", digits, bs.ToInt())
+	decimal := bs.ToBigInt().String()
+	return strings.Repeat("0", max(digits-len(decimal), 0)) + decimal
 }
 
 // Count returns the number of bits set to 1
@@ -307,9 +464,7 @@ func Concat(sets ...*BitSet) *BitSet {
 	// Copy bits from other BitSets
 	offset := 0
 	for _, other := range sets {
-		for i := 0; i < other.size; i++ {
-			result.Set(offset+i, other.Get(i))
-		}
+		result.orAt(other, offset)
 		offset += other.size
 	}
 
@@ -320,3 +475,56 @@ func Concat(sets ...*BitSet) *BitSet {
 func (bs *BitSet) Append(other *BitSet) *BitSet {
 	return Concat(bs, other)
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler: the size as a uvarint,
+// then the bits as ToBytes writes them
+func (bs *BitSet) MarshalBinary() ([]byte, error) {
+	data := binary.AppendUvarint(nil, uint64(bs.size))
+	return append(data, bs.ToBytes()...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (bs *BitSet) UnmarshalBinary(data []byte) error {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > math.MaxInt32 {
+		return fmt.Errorf("invalid BitSet size")
+	}
+	return bs.setBytes(int(size), data[n:])
+}
+
+// MarshalText implements encoding.TextMarshaler as the size and the bits in
+// hex, e.g. 40:d8aab9cf4c. JSON uses it too, so BitSets are stored as
+// strings.
+func (bs *BitSet) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(bs.size) + ":" + hex.EncodeToString(bs.ToBytes())), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (bs *BitSet) UnmarshalText(text []byte) error {
+	sizeText, hexText, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return fmt.Errorf("invalid BitSet %q: want size:hex", text)
+	}
+	size, err := strconv.Atoi(sizeText)
+	if err != nil || size < 0 || size > math.MaxInt32 {
+		return fmt.Errorf("invalid BitSet size %q", sizeText)
+	}
+	bytes, err := hex.DecodeString(hexText)
+	if err != nil {
+		return fmt.Errorf("invalid BitSet %q: %w", text, err)
+	}
+	return bs.setBytes(size, bytes)
+}
+
+// setBytes replaces the set with size bits read from exactly as many bytes
+// as ToBytes writes, none of them past the size
+func (bs *BitSet) setBytes(size int, bytes []byte) error {
+	if len(bytes) != (size+7)/8 {
+		return fmt.Errorf("%d bytes cannot hold a BitSet of %d bits", len(bytes), size)
+	}
+	if size%8 != 0 && bytes[0]>>(size%8) != 0 {
+		return fmt.Errorf("bits set past the size of a BitSet of %d bits", size)
+	}
+	*bs = *FromBytes(bytes, size)
+	return nil
+}
@@ -1,6 +1,8 @@
 package bitset
 
 import (
+	"encoding/json"
+	"math/big"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -166,3 +168,200 @@ func TestStringConversions(t *testing.T) {
 	assert.Equal("7777", bs3.ToStringOctal())
 	assert.Equal("4095", bs3.ToStringDecimal())
 }
+
+// bitwise builds a BitSet one bit at a time, as a reference for the
+// word-level implementations
+func bitwise(bytes []byte, size int) *BitSet {
+	bs := New(size)
+	for i := 0; i < size; i++ {
+		bytePos, bitPos := len(bytes)-1-i/8, i%8
+		bs.Set(i, bytes[bytePos]&(1<<bitPos) != 0)
+	}
+	return bs
+}
+
+func testBytes(n int) []byte {
+	bytes := make([]byte, n)
+	for i := range bytes {
+		bytes[i] = byte(i*151 + 17)
+	}
+	return bytes
+}
+
+func TestWordBoundaries(t *testing.T) {
+	assert := assert.New(t)
+	bytes := testBytes(32)
+
+	for _, size := range []int{1, 7, 8, 63, 64, 65, 127, 128, 129, 200, 256} {
+		bs := FromBytes(bytes, size)
+		want := bitwise(bytes, size)
+		assert.Equalf(want.ToBools(), bs.ToBools(), "FromBytes of %d bits", size)
+		assert.Equalf(FromBytes(bytes[len(bytes)-(size+7)/8:], size).ToBools(), bs.ToBools(), "Only the last bytes count")
+		assert.Equalf(want.ToBytes(), bs.ToBytes(), "ToBytes of %d bits", size)
+
+		for _, cut := range [][2]int{{0, size}, {1, size}, {0, size - 1}, {size / 3, size / 2}, {63, 130}} {
+			start, end := cut[0], min(cut[1], size)
+			if start >= end {
+				continue
+			}
+			slice := bs.Slice(start, end)
+			assert.Equalf(want.ToBools()[start:end], slice.ToBools(), "Slice(%d, %d) of %d bits", start, end, size)
+			assert.Truef(Concat(bs.Slice(0, start), slice, bs.Slice(end, size)).Equals(bs), "Slices of %d bits concatenate back", size)
+		}
+	}
+
+	a, b := FromBytes(bytes, 70), FromBytes(bytes, 100)
+	assert.Equal(append(a.ToBools(), b.ToBools()...), Concat(a, b).ToBools())
+	assert.True(a.And(b).Equals(a.And(b).Slice(0, 70)), "Bits past the size stay clear")
+}
+
+func TestIntConversions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0x2A5, FromInt(0x2A5, 10).ToInt())
+	assert.Equal(0x25, FromInt(0x2A5, 6).ToInt(), "FromInt keeps the low bits")
+	assert.Equal(-1&(1<<63-1), FromInt(-1, 63).ToInt())
+	assert.Equal(64, FromInt(-1, 100).Count(), "An int has 64 bits")
+	assert.Equal(uint64(1<<64-1), FromInt(-1, 64).ToUint64())
+	assert.Equal(12345, FromInt(12345, 200).ToInt(), "Large sets with small values convert")
+
+	assert.Panics(func() { FromInt(-1, 64).ToInt() }, "The 64th bit does not fit in an int")
+	assert.Panics(func() { FromInt(1, 65).ShiftLeft(64).ToUint64() })
+	assert.Equal(0, New(0).ToInt())
+
+	num, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	bs := FromBigInt(num, 100)
+	assert.Equal(0, num.Cmp(bs.ToBigInt()))
+	assert.Equal(FromInt(12345, 20).ToBytes(), FromBigInt(big.NewInt(12345), 20).ToBytes())
+	assert.Equal(int64(12345&0xFF), FromBigInt(big.NewInt(12345), 8).ToBigInt().Int64(), "FromBigInt keeps the low bits")
+	assert.Panics(func() { FromBigInt(big.NewInt(-1), 8) })
+	assert.Equal("0000000000000000000000123456789012345678901234567890", FromBigInt(num, 170).ToStringDecimal())
+}
+
+func TestShiftAndRotate(t *testing.T) {
+	assert := assert.New(t)
+	bs := FromInt(0b1011, 8)
+
+	assert.Equal(0b10110000, bs.ShiftLeft(4).ToInt())
+	assert.Equal(0b01100000, bs.ShiftLeft(5).ToInt(), "Bits shifted past the size are lost")
+	assert.Equal(0b10, bs.ShiftRight(2).ToInt())
+	assert.Equal(bs.ShiftRight(2).ToInt(), bs.ShiftLeft(-2).ToInt())
+	assert.Equal(0, bs.ShiftLeft(8).ToInt())
+	assert.Equal(0b01100001, bs.RotateLeft(5).ToInt())
+	assert.Equal(0b11000010, bs.RotateRight(2).ToInt())
+	assert.True(bs.RotateLeft(13).Equals(bs.RotateRight(3)))
+	assert.True(bs.RotateLeft(0).Equals(bs))
+
+	// Across words
+	wide := FromBytes(testBytes(25), 200)
+	shifted := FromBigInt(new(big.Int).Lsh(wide.ToBigInt(), 70), 270).Slice(0, 200)
+	assert.True(shifted.Equals(wide.ShiftLeft(70)))
+	assert.True(wide.ShiftLeft(70).ShiftRight(70).Equals(Concat(wide.Slice(0, 130), New(70))))
+	assert.True(wide.ShiftRight(70).Equals(Concat(wide.Slice(70, 200), New(70))))
+	assert.True(wide.RotateLeft(77).RotateRight(77).Equals(wide))
+	assert.True(wide.RotateLeft(77).Equals(Concat(wide.Slice(123, 200), wide.Slice(0, 123))))
+	assert.Equal(0, New(0).RotateLeft(3).Size())
+}
+
+func TestNextSet(t *testing.T) {
+	assert := assert.New(t)
+	bs := New(200)
+	for _, i := range []int{0, 5, 63, 64, 130, 199} {
+		bs.SetBit(i)
+	}
+	assert.Equal([]int{0, 5, 63, 64, 130, 199}, bs.SetBits())
+
+	i, ok := bs.NextSet(65)
+	assert.True(ok)
+	assert.Equal(130, i)
+	_, ok = bs.NextSet(200)
+	assert.False(ok)
+	assert.Empty(New(100).SetBits())
+}
+
+func TestMarshaling(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, size := range []int{0, 1, 12, 40, 64, 65, 200} {
+		bs := FromBytes(testBytes(32), size)
+		if size == 0 {
+			bs = New(0)
+		}
+
+		data, err := bs.MarshalBinary()
+		assert.NoError(err)
+		var fromBinary BitSet
+		if assert.NoError(fromBinary.UnmarshalBinary(data)) {
+			assert.Truef(bs.Equals(&fromBinary), "%d bits survive binary marshaling", size)
+		}
+
+		text, err := bs.MarshalText()
+		assert.NoError(err)
+		var fromText BitSet
+		if assert.NoError(fromText.UnmarshalText(text)) {
+			assert.Truef(bs.Equals(&fromText), "%d bits survive text marshaling", size)
+		}
+	}
+
+	text, _ := FromInt(0xD8AAB9CF4C, 40).MarshalText()
+	assert.Equal("40:d8aab9cf4c", string(text))
+
+	type record struct {
+		Bits *BitSet `json:"bits"`
+	}
+	data, err := json.Marshal(record{FromInt(0x2A5, 12)})
+	assert.NoError(err)
+	assert.JSONEq(`{"bits": "12:02a5"}`, string(data))
+	var decoded record
+	if assert.NoError(json.Unmarshal(data, &decoded)) {
+		assert.True(FromInt(0x2A5, 12).Equals(decoded.Bits))
+	}
+
+	var bs BitSet
+	for _, bad := range []string{"", "12", "x:02a5", "12:2a5", "12:0002a5", "12:f2a5", "-1:"} {
+		assert.Errorf(bs.UnmarshalText([]byte(bad)), "%q is not a BitSet", bad)
+	}
+	assert.Error(bs.UnmarshalBinary(nil))
+	assert.Error(bs.UnmarshalBinary([]byte{12, 0x02}))
+}
+
+func BenchmarkFromBytes(b *testing.B) {
+	bytes := testBytes(32)
+	for i := 0; i < b.N; i++ {
+		FromBytes(bytes, 256)
+	}
+}
+
+func BenchmarkFromInt(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		FromInt(i, 40)
+	}
+}
+
+func BenchmarkSlice(b *testing.B) {
+	bs := FromBytes(testBytes(32), 256)
+	for i := 0; i < b.N; i++ {
+		bs.Slice(13, 213)
+	}
+}
+
+func BenchmarkConcat(b *testing.B) {
+	x, y := FromBytes(testBytes(32), 100), FromBytes(testBytes(32), 150)
+	for i := 0; i < b.N; i++ {
+		Concat(x, y, x)
+	}
+}
+
+func BenchmarkToBytes(b *testing.B) {
+	bs := FromBytes(testBytes(32), 256)
+	for i := 0; i < b.N; i++ {
+		bs.ToBytes()
+	}
+}
+
+func BenchmarkMarshalText(b *testing.B) {
+	bs := FromBytes(testBytes(32), 256)
+	for i := 0; i < b.N; i++ {
+		bs.MarshalText()
+	}
+}
@@ -1,10 +1,13 @@
 package derived
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base32"
 	"fmt"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"lilidap/internal/bitset"
 	"lilidap/internal/derived/syllables"
@@ -19,69 +22,343 @@ import (
 // For 40 bits, this is calculated as the square root of 2^40 = 1,048,576
 const KEY_HASH_BIT_LENGTH = 40
 
+// builtinLanguages holds the generator of each language built into the
+// syllables package, by BCP 47 tag. Names are generated in these unless
+// attributes are given other languages; nothing is ever added to it.
+var builtinLanguages = syllables.Builtin()
+
+// LoadLanguages returns the built-in languages together with those defined
+// in the files of a directory, and the tags of the latter in order.
+// Built-in languages cannot be redefined, since that would rename everyone
+// who has been given a name in them.
+func LoadLanguages(dir string) (*syllables.Registry, []string, error) {
+	langs, err := syllables.LoadLanguageDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	languages := syllables.Builtin()
+	tags := make([]string, 0, len(langs))
+	for tag := range langs {
+		if languages.Has(tag) {
+			return nil, nil, fmt.Errorf("language %s is built in and cannot be redefined", tag)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		if err := languages.RegisterLanguage(tag, langs[tag]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return languages, tags, nil
+}
+
 // UserAttributes generates consistent LDAP attributes from an SSH public key
 type UserAttributes struct {
-	pubKey       ssh.PublicKey
-	hash         [32]byte       // cached sha256 of pubKey
-	keyBits      *bitset.BitSet // KEY_HASH_BIT_LENGTH bits from the hash
-	displayNames map[string]string
+	pubKey      ssh.PublicKey
+	hash        [32]byte       // cached sha256 of pubKey, or its HMAC with the salt
+	keyBits     *bitset.BitSet // KEY_HASH_BIT_LENGTH bits from the hash
+	suffixes    Suffixes       // disambiguate colliding keys, attribute by attribute
+	uidRange    *IDRange       // range uidNumber is mapped into; nil means LegacyUIDBase onwards
+	gidRange    *IDRange       // range gidNumber is mapped into; nil means DefaultGID for all
+	scheme      *Scheme        // derivation algorithm
+	phoneFormat PhoneFormat
+	languages   *syllables.Registry // generators of the languages names are made in
 }
 
-// FromPublicKey creates an attribute generator from an SSH public key
+// FromPublicKey creates an attribute generator from an SSH public key,
+// using DefaultScheme
 func FromPublicKey(pubKey ssh.PublicKey) *UserAttributes {
+	return derive(pubKey, DefaultScheme)
+}
+
+func derive(pubKey ssh.PublicKey, scheme *Scheme) *UserAttributes {
 	// Get deterministic seed from key fingerprint
 	theHash := sha256.Sum256(pubKey.Marshal())
 	attrs := &UserAttributes{
-		pubKey:       pubKey,
-		hash:         theHash,
-		keyBits:      bitset.FromBytes(theHash[:], KEY_HASH_BIT_LENGTH),
-		displayNames: make(map[string]string),
+		pubKey:      pubKey,
+		hash:        theHash,
+		keyBits:     bitset.FromBytes(theHash[:], KEY_HASH_BIT_LENGTH),
+		scheme:      scheme,
+		phoneFormat: DefaultPhoneFormat,
+		languages:   builtinLanguages,
 	}
 
-	// Generate English name using syllables
+	return attrs
+}
+
+// KeyBits returns the KEY_HASH_BIT_LENGTH bits of a key's hash that its
+// derived attributes come from
+func KeyBits(pubKey ssh.PublicKey) *bitset.BitSet {
+	theHash := sha256.Sum256(pubKey.Marshal())
+	return bitset.FromBytes(theHash[:], KEY_HASH_BIT_LENGTH)
+}
 
-	attrs.displayNames["en"] = syllables.NewEnglishGenerator().Generate(attrs.keyBits)
+// NameBits returns the key bits a display name in any of the languages could
+// have been generated from, ignoring a disambiguating suffix, for looking
+// people up by name without deriving everyone's. A nil languages means the
+// built-in ones. ok is false when the name might come from bits it does not
+// decode to, because a language that forbids sequences reads it, so that no
+// key can be ruled out.
+func NameBits(name string, languages *syllables.Registry) (candidates []*bitset.BitSet, ok bool) {
+	if languages == nil {
+		languages = builtinLanguages
+	}
+	name = strings.TrimRightFunc(name, func(r rune) bool { return r >= '0' && r <= '9' })
+	for _, tag := range languages.Tags() {
+		generator, _, _ := languages.Lookup(tag)
+		// Schemes before 0.3.0 spell names without re-rolls, and names may
+		// be common names or, from 0.4.0, full names
+		var parses []*bitset.BitSet
+		for _, g := range []syllables.SyllableGenerator{generator, generator.Unfiltered()} {
+			parses = append(parses, g.ParseAll(name, KEY_HASH_BIT_LENGTH)...)
+			parses = append(parses, g.ParseFullName(name, KEY_HASH_BIT_LENGTH)...)
+		}
+		if len(parses) > 0 && !generator.Invertible() {
+			return nil, false
+		}
+		for _, bits := range parses {
+			if !containsBits(candidates, bits) {
+				candidates = append(candidates, bits)
+			}
+		}
+	}
+	return candidates, true
+}
 
-	return attrs
+func containsBits(sets []*bitset.BitSet, bits *bitset.BitSet) bool {
+	for _, set := range sets {
+		if set.Equals(bits) {
+			return true
+		}
+	}
+	return false
+}
+
+// Suffixes tell the attributes of a key apart from those of keys seen
+// before it that derive the same values. Each attribute has its own, so a
+// key whose uidNumber collides keeps its name and telephone number.
+// Suffixes start at 2 ("the second vantumkeirrof"); 0 means none.
+type Suffixes struct {
+	UIDNumber       int `json:"uid_number,omitempty"`
+	GIDNumber       int `json:"gid_number,omitempty"`
+	TelephoneNumber int `json:"telephone_number,omitempty"`
+	DisplayName     int `json:"display_name,omitempty"` // and every other name
+}
+
+// Disambiguate returns a copy of the attributes carrying suffix n on one
+// attribute, named as in DerivedAttributes, for a key whose value of it
+// collides with that of a key seen before it. Names get n appended,
+// numeric IDs and fixed-length phone numbers are probed n-1 steps further,
+// and other phone numbers get n appended. 0 removes the suffix.
+func (ua *UserAttributes) Disambiguate(attribute string, n int) *UserAttributes {
+	c := *ua
+	switch attribute {
+	case "uidNumber":
+		c.suffixes.UIDNumber = n
+	case "gidNumber":
+		c.suffixes.GIDNumber = n
+	case "telephoneNumber":
+		c.suffixes.TelephoneNumber = n
+	case "displayName":
+		c.suffixes.DisplayName = n
+	default:
+		panic(fmt.Sprintf("%s cannot be disambiguated", attribute))
+	}
+	return &c
+}
+
+// WithSuffixes returns a copy of the attributes carrying the suffixes
+func (ua *UserAttributes) WithSuffixes(suffixes Suffixes) *UserAttributes {
+	c := *ua
+	c.suffixes = suffixes
+	return &c
+}
+
+// WithSalt returns a copy of the attributes derived from the HMAC-SHA256 of
+// the key with a per-deployment salt instead of its plain hash. Networks
+// with different salts give the same key unrelated uids, names and numbers,
+// so sightings cannot be linked across them. An empty salt keeps the global
+// identity.
+func (ua *UserAttributes) WithSalt(salt []byte) *UserAttributes {
+	c := *ua
+	c.hash = sha256.Sum256(ua.pubKey.Marshal())
+	if len(salt) > 0 {
+		mac := hmac.New(sha256.New, salt)
+		mac.Write(ua.pubKey.Marshal())
+		copy(c.hash[:], mac.Sum(nil))
+	}
+	c.keyBits = bitset.FromBytes(c.hash[:], KEY_HASH_BIT_LENGTH)
+	return &c
+}
+
+// KeyBits returns the KEY_HASH_BIT_LENGTH bits the attributes come from,
+// which names decode back to
+func (ua *UserAttributes) KeyBits() *bitset.BitSet {
+	return ua.keyBits
+}
+
+// WithIDRanges returns a copy of the attributes mapping uidNumber into uids
+// and gidNumber into gids. A nil uids keeps the legacy uidNumber, and a nil
+// gids gives every user DefaultGID.
+func (ua *UserAttributes) WithIDRanges(uids *IDRange, gids *IDRange) *UserAttributes {
+	c := *ua
+	c.uidRange = uids
+	c.gidRange = gids
+	return &c
+}
+
+// WithLanguages returns a copy of the attributes generating names in the
+// given languages rather than the built-in ones
+func (ua *UserAttributes) WithLanguages(languages *syllables.Registry) *UserAttributes {
+	c := *ua
+	c.languages = languages
+	return &c
+}
+
+// WithPhoneFormat returns a copy of the attributes deriving phone numbers
+// in the given format
+func (ua *UserAttributes) WithPhoneFormat(format PhoneFormat) *UserAttributes {
+	c := *ua
+	c.phoneFormat = format
+	return &c
+}
+
+// Suffixes returns the disambiguating suffixes
+func (ua *UserAttributes) Suffixes() Suffixes {
+	return ua.suffixes
+}
+
+// Scheme returns the derivation scheme the attributes come from
+func (ua *UserAttributes) Scheme() *Scheme {
+	return ua.scheme
 }
 
 // Username returns a consistent unique identifier
 func (ua *UserAttributes) Username() string {
-	b32str := strings.ToLower(base32.StdEncoding.EncodeToString(ua.hash[:])[:8])
-	return fmt.Sprintf("u%s", b32str)
+	return ua.scheme.username(ua)
 }
 
-// UserID starting at 1000
+// PosixUserID returns the numeric user ID: the key bits past LegacyUIDBase,
+// or mapped into the UID range if one is set
 func (ua *UserAttributes) PosixUserID() int {
-	return ua.keyBits.ToInt() + 1000
+	if ua.uidRange == nil {
+		return ua.keyBits.ToInt() + LegacyUIDBase + probe(ua.suffixes.UIDNumber)
+	}
+	return int(ua.uidRange.Map(uint64(ua.keyBits.ToInt()), probe(ua.suffixes.UIDNumber)))
+}
+
+// PosixGroupID returns the numeric group ID: DefaultGID, or a per-user group
+// mapped into the GID range if one is set
+func (ua *UserAttributes) PosixGroupID() int {
+	if ua.gidRange == nil {
+		return DefaultGID
+	}
+	return int(ua.gidRange.Map(uint64(ua.keyBits.ToInt()), probe(ua.suffixes.GIDNumber)))
+}
+
+// probe is how many steps a suffix moves a numeric ID away from a colliding key
+func probe(suffix int) int {
+	if suffix > 0 {
+		return suffix - 1
+	}
+	return 0
 }
 
-// PhoneNumber returns a consistent unique phone number
+// PhoneNumber returns a consistent unique phone number, as dialled locally
 func (ua *UserAttributes) PhoneNumber() string {
-	return fmt.Sprintf("8%0*d", 4, ua.keyBits.ToInt())
+	return ua.phoneFormat.local(uint64(ua.keyBits.ToInt()), ua.suffixes.TelephoneNumber)
+}
+
+// E164 returns the phone number in international format (+<country><number>),
+// or the local number if the phone format has no country code
+func (ua *UserAttributes) E164() string {
+	if ua.phoneFormat.CountryCode == "" {
+		return ua.PhoneNumber()
+	}
+	return "+" + ua.phoneFormat.CountryCode + ua.PhoneNumber()
 }
 
-// DisplayName returns a locale-specific display name
+// SIPURI returns the SIP address of the phone number at a SIP domain
+func (ua *UserAttributes) SIPURI(domain string) string {
+	return fmt.Sprintf("sip:%s@%s", ua.PhoneNumber(), domain)
+}
+
+// DisplayName returns the display name in a language, given as a BCP 47
+// tag. Tags without a generator fall back to a more general one (en-GB to
+// en), and then to English. From scheme 0.4.0 on it is the full name, e.g.
+// "Vantum Keirrof"; before, the common name, e.g. "vantumkeirrof".
 func (ua *UserAttributes) DisplayName(lang string) string {
-	if name, ok := ua.displayNames[lang]; ok {
+	if ua.scheme.splitNames {
+		return ua.FullName(lang)
+	}
+	return ua.CommonName(lang)
+}
+
+// CommonName returns the name as a single lowercase word, as display names
+// were before scheme 0.4.0 and cn still is
+func (ua *UserAttributes) CommonName(lang string) string {
+	return ua.generator(lang).Generate(ua.keyBits) + ua.suffixString()
+}
+
+// GivenName returns the capitalized given name, made from the first half of
+// the bits the common name is
+func (ua *UserAttributes) GivenName(lang string) string {
+	given, _ := ua.generator(lang).GenerateNames(ua.keyBits)
+	return capitalize(given)
+}
+
+// Surname returns the capitalized family name, made from the second half
+// of the bits the common name is
+func (ua *UserAttributes) Surname(lang string) string {
+	_, family := ua.generator(lang).GenerateNames(ua.keyBits)
+	return capitalize(family)
+}
+
+// FullName returns the given name and the family name, in the order and
+// with the separator of the language, and any number telling namesakes apart
+func (ua *UserAttributes) FullName(lang string) string {
+	generator := ua.generator(lang)
+	return generator.FullName(ua.GivenName(lang), ua.Surname(lang)) + generator.Number(ua.keyBits) + ua.suffixString()
+}
+
+// generator returns the name generator of a language, as the scheme uses it
+func (ua *UserAttributes) generator(lang string) syllables.SyllableGenerator {
+	generator, _, ok := ua.languages.Lookup(lang)
+	if !ok {
+		generator, _, _ = ua.languages.Lookup("en")
+	}
+	if !ua.scheme.filterNames {
+		generator = generator.Unfiltered()
+	}
+	return generator
+}
+
+// capitalize upper-cases the first letter of a name, in scripts with case
+func capitalize(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	if r == utf8.RuneError {
 		return name
 	}
-	// Fall back to English if language not supported
-	return ua.displayNames["en"]
+	return string(unicode.ToTitle(r)) + name[size:]
 }
 
-// SupportedLanguages returns a list of supported languages
+func (ua *UserAttributes) suffixString() string {
+	if ua.suffixes.DisplayName == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", ua.suffixes.DisplayName)
+}
+
+// SupportedLanguages returns a sorted list of supported languages
 //
 // This drives LDAP support like the following:
 //
-//	displayName: User-123        # Default/fallback
-//	displayName;lang-en: User-123
-//	displayName;lang-ja: ユーザー123
-//	displayName;lang-zh: 用户123
+//	displayName: lutbousnifkeit   # Default/fallback
+//	displayName;lang-en: lutbousnifkeit
+//	displayName;lang-ja: スンマリンニンサフ
+//	displayName;lang-ko: 픙렘톱뎡
+//	displayName;lang-zh: 农山中（55466）
 func (ua *UserAttributes) SupportedLanguages() []string {
-	langs := make([]string, 0, len(ua.displayNames))
-	for lang := range ua.displayNames {
-		langs = append(langs, lang)
-	}
-	return langs
+	return ua.languages.Tags()
 }
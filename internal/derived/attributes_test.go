@@ -1,10 +1,25 @@
 package derived
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"lilidap/internal/derived/syllables"
 	"lilidap/internal/testutils"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func TestUserAttributes(t *testing.T) {
@@ -30,7 +45,67 @@ func TestUserAttributes(t *testing.T) {
 	t.Run("PosixUserID is properly generated", func(t *testing.T) {
 		uid := ua.PosixUserID()
 		kb := ua.keyBits
-		assert.Equal(kb.ToInt()+1000, uid, "PosixUserID should be the int val of the hash plus 1000")
+		assert.Equal(kb.ToInt()+1000, uid, "PosixUserID should be the int val of the hash + 1000")
+		assert.Equal(kb.ToInt()+1001, ua.Disambiguate("uidNumber", 2).PosixUserID())
+		assert.Equal(DefaultGID, ua.PosixGroupID())
+	})
+
+	t.Run("ID ranges", func(t *testing.T) {
+		uids := IDRange{Min: 5000, Max: 5009}
+		gids := IDRange{Min: 7000, Max: 7009}
+		ranged := ua.WithIDRanges(&uids, &gids)
+		assert.Equal(5000+ua.keyBits.ToInt()%10, ranged.PosixUserID())
+		assert.Equal(7000+ua.keyBits.ToInt()%10, ranged.PosixGroupID())
+
+		// Probing wraps around at the end of the range
+		ids := map[int]bool{}
+		for n := 2; n <= 11; n++ {
+			uid := ranged.Disambiguate("uidNumber", n).PosixUserID()
+			assert.True(uids.Contains(uint32(uid)))
+			ids[uid] = true
+		}
+		assert.Len(ids, 10, "Ten probes should visit every ID in a range of ten")
+	})
+
+	t.Run("Phone formats", func(t *testing.T) {
+		assert.Equal(ua.PhoneNumber(), ua.WithPhoneFormat(DefaultPhoneFormat).PhoneNumber())
+
+		short := ua.WithPhoneFormat(PhoneFormat{Prefix: "7", Digits: 4})
+		assert.Equal("79884", short.PhoneNumber(), "Last four digits of 930577239884")
+		assert.Equal("79885", short.Disambiguate("telephoneNumber", 2).PhoneNumber(), "Fixed-length numbers are probed")
+		assert.Equal("79884", short.E164(), "No country code, no E.164 form")
+
+		checked := ua.WithPhoneFormat(PhoneFormat{Prefix: "7", Digits: 4, CheckDigit: true, CountryCode: "44"})
+		number := checked.PhoneNumber()
+		assert.Len(number, 6)
+		assert.True(LuhnValid(number), "%s should end with its Luhn digit", number)
+		assert.Equal("+44"+number, checked.E164())
+		assert.Equal("sip:"+number+"@pbx.example.org", checked.SIPURI("pbx.example.org"))
+
+		assert.True(LuhnValid("79927398713"), "Luhn example from ISO/IEC 7812")
+		assert.False(LuhnValid("79927398710"))
+
+		assert.NoError(PhoneFormat{Prefix: "8", Digits: 6, CheckDigit: true, CountryCode: "1"}.Validate())
+		for _, bad := range []PhoneFormat{
+			{Prefix: "8a"},
+			{Prefix: "8", Digits: 19},
+			{Prefix: "8", CountryCode: "1"},
+			{Prefix: "8", Digits: 4, CountryCode: "012"},
+			{Prefix: "8", Digits: 14, CountryCode: "44"},
+		} {
+			assert.Errorf(bad.Validate(), "%+v should be rejected", bad)
+		}
+	})
+
+	t.Run("Parse ID range", func(t *testing.T) {
+		r, err := ParseIDRange("200000-2147483647")
+		assert.NoError(err)
+		assert.Equal(RecommendedUIDRange, r)
+
+		for _, bad := range []string{"2000", "3000-2000", "0-65535", "100000-4294967295", "1000-4294967296", "a-b"} {
+			_, err := ParseIDRange(bad)
+			assert.Errorf(err, "%q should be rejected", bad)
+		}
 	})
 
 	t.Run("Phone number is valid", func(t *testing.T) {
@@ -46,10 +121,409 @@ func TestUserAttributes(t *testing.T) {
 	t.Run("Generated name is valid", func(t *testing.T) {
 		name := ua.DisplayName("en")
 		assert.Equal("lutbousnifkeit", name)
+
+		v4 := V0_4_0.Derive(testKey)
+		assert.Equal("Lutbous Nifkeit", v4.DisplayName("en"))
+		assert.Equal("スンマリン・ニンサフ", v4.DisplayName("ja"))
+		assert.Equal("톱뎡픙렘", v4.DisplayName("ko"))
+		assert.Equal("农山中（55466）", v4.DisplayName("zh"))
+	})
+
+	t.Run("Disambiguation suffix", func(t *testing.T) {
+		second := ua.WithSuffixes(Suffixes{UIDNumber: 2, TelephoneNumber: 2, DisplayName: 2})
+		assert.Equal(Suffixes{}, ua.Suffixes(), "Original attributes should be unchanged")
+		assert.Equal(2, second.Suffixes().DisplayName)
+		assert.Equal("lutbousnifkeit2", second.DisplayName("en"))
+		assert.Equal("89305772398842", second.PhoneNumber())
+		assert.Equal(ua.PosixUserID()+1, second.PosixUserID())
+		assert.Equal(ua.Username(), second.Username(), "Username does not come from the colliding bits")
+		assert.Equal(ua.DisplayName("en"), second.Disambiguate("displayName", 0).DisplayName("en"))
+
+		// Each attribute has its own suffix
+		uidOnly := ua.Disambiguate("uidNumber", 2)
+		assert.Equal(ua.PosixUserID()+1, uidOnly.PosixUserID())
+		assert.Equal(ua.DisplayName("en"), uidOnly.DisplayName("en"), "A uidNumber collision leaves the name alone")
+		assert.Equal(ua.PhoneNumber(), uidOnly.PhoneNumber())
+		nameOnly := ua.Disambiguate("displayName", 3)
+		assert.Equal("lutbousnifkeit3", nameOnly.DisplayName("en"))
+		assert.Equal(ua.PosixUserID(), nameOnly.PosixUserID())
+		assert.Panics(func() { ua.Disambiguate("uid", 2) })
+	})
+
+	t.Run("Derivation schemes", func(t *testing.T) {
+		scheme, ok := LookupScheme("0_1_0")
+		assert.True(ok)
+		assert.Same(V0_1_0, scheme)
+		scheme, ok = LookupScheme("0.1.0")
+		assert.True(ok)
+		assert.Same(V0_1_0, scheme)
+		_, ok = LookupScheme("9_9_9")
+		assert.False(ok)
+
+		assert.Equal("0_1_0", V0_1_0.DC())
+		assert.Same(DefaultScheme, ua.Scheme())
+		assert.Equal(ua.Username(), V0_1_0.Derive(testKey).Username(), "0.1.0 must keep the original identity")
+		assert.Equal(DerivedAttributes, V0_1_0.Compatible(V0_1_0))
+		assert.Equal([]string{"uidNumber", "gidNumber", "telephoneNumber", "displayName"}, V0_1_0.Compatible(V0_2_0))
+		assert.Equal([]string{"uid", "uidNumber", "gidNumber", "telephoneNumber"}, V0_2_0.Compatible(V0_3_0))
+		assert.Equal([]string{"uid", "uidNumber", "gidNumber", "telephoneNumber"}, V0_3_0.Compatible(V0_4_0))
+		assert.Same(V0_4_0, LatestScheme())
+
+		_, err := ParseSchemes("0_1_0,9_9_9")
+		assert.Error(err)
+		_, err = ParseSchemes("")
+		assert.Error(err)
+	})
+
+	t.Run("Confusable-free uid", func(t *testing.T) {
+		v2 := V0_2_0.Derive(testKey)
+		uid := v2.Username()
+		assert.Regexp("^u[o1-9a-hikmnp-tv-z]{8}$", uid)
+		assert.NotEqual(ua.Username(), uid, "0.2.0 changes the uid")
+		assert.Equal(ua.DisplayName("en"), v2.DisplayName("en"), "0.2.0 keeps the display name")
+		assert.Equal(ua.PosixUserID(), v2.PosixUserID(), "0.2.0 keeps the uidNumber")
+
+		// Mangle every o and 1 the way people misread them
+		typed := strings.ToUpper(uid[:1]) + strings.NewReplacer("o", "0", "1", "l").Replace(uid[1:])
+		assert.True(V0_2_0.UsernameMatches(typed, uid), "%s should match %s", typed, uid)
+		assert.True(V0_2_0.UsernameMatches(strings.ToUpper(uid), uid))
+		assert.False(V0_2_0.UsernameMatches("u"+uid[2:]+"x", uid))
+		assert.False(V0_1_0.UsernameMatches("uakmyrve1", "uakmyrvel"), "0.1.0 uids are matched exactly")
+		assert.True(V0_1_0.UsernameMatches("UAKMYRVEL", "uakmyrvel"))
+	})
+
+	t.Run("Avatars", func(t *testing.T) {
+		avatar := ua.Avatar()
+		assert.Equal(avatar, FromPublicKey(testKey).Avatar(), "Avatars should be deterministic")
+		assert.Equal(avatar, ua.Disambiguate("displayName", 2).Avatar(), "Suffixes should not change the avatar")
+		for _, row := range avatar.Cells {
+			for col := range row {
+				assert.Equal(row[col], row[AvatarGrid-1-col], "Avatars should be mirrored")
+			}
+		}
+		assert.Regexp("^#[0-9a-f]{6}$", ua.AccentColor())
+
+		otherKey, err := testutils.GetRandomPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := FromPublicKey(otherKey)
+		assert.False(other.Avatar().Color == avatar.Color && other.Avatar().Cells == avatar.Cells)
+
+		// The middle of the image is the middle cell, the corner is margin
+		img := avatar.Image(120)
+		assert.Equal(avatarBackground, img.RGBAAt(0, 0))
+		middle := avatarBackground
+		if avatar.Cells[AvatarGrid/2][AvatarGrid/2] {
+			middle = avatar.Color
+		}
+		assert.Equal(middle, img.RGBAAt(60, 60))
+
+		jpegData, err := avatar.JPEG(96)
+		if assert.NoError(err) {
+			decoded, format, err := image.Decode(bytes.NewReader(jpegData))
+			if assert.NoError(err) {
+				assert.Equal("jpeg", format)
+				assert.Equal(96, decoded.Bounds().Dx())
+			}
+		}
+		pngData, err := avatar.PNG(64)
+		if assert.NoError(err) {
+			_, format, err := image.Decode(bytes.NewReader(pngData))
+			assert.NoError(err)
+			assert.Equal("png", format)
+		}
+
+		assert.Equal(AvatarGrid, strings.Count(avatar.BlockArt(), "\n"))
+	})
+
+	t.Run("Word fingerprint", func(t *testing.T) {
+		seen := map[string]bool{}
+		for _, word := range append(evenWords[:], oddWords[:]...) {
+			assert.False(seen[word], "%s is listed twice", word)
+			seen[word] = true
+		}
+		// The PGP word list example, E582 94F2 E9A2 2748 6E8B 061B 31CC 528F D7FA 3F19
+		example := []byte{0xE5, 0x82, 0x94, 0xF2, 0xE9, 0xA2, 0x27, 0x48, 0x6E, 0x8B, 0x06, 0x1B, 0x31, 0xCC, 0x52, 0x8F, 0xD7, 0xFA, 0x3F, 0x19}
+		spoken := make([]string, 0, len(example))
+		for i, b := range example {
+			spoken = append(spoken, fingerprintWord(i, b))
+		}
+		assert.Equal("topmost istanbul pluto vagabond treadmill pacific brackish dictator goldfish medusa "+
+			"afflict bravado chatter revolver dupont midsummer stopwatch whimsical cowbell bottomless", strings.Join(spoken, " "))
+
+		words := ua.FingerprintWords()
+		assert.Len(words, FingerprintWordCount)
+		fingerprint, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(ssh.FingerprintSHA256(testKey), "SHA256:"))
+		if assert.NoError(err) {
+			for i, b := range fingerprint {
+				assert.Equal(fingerprintWord(i, b), words[i], "Words should spell the SSH fingerprint")
+			}
+		}
+		assert.Equal(strings.Join(words[:4], " ")+" - ", ua.WordFingerprint()[:len(strings.Join(words[:4], " "))+3])
+		assert.Equal(FingerprintWordCount/4-1, strings.Count(ua.WordFingerprint(), " - "))
+	})
+
+	t.Run("Safety numbers", func(t *testing.T) {
+		otherKey, err := testutils.GetRandomPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		thirdKey, err := testutils.GetRandomPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		number := SafetyNumber(testKey, otherKey)
+		assert.Regexp(`^(\d{5} ){11}\d{5}$`, number)
+		assert.Equal(number, SafetyNumber(otherKey, testKey), "Both people should see the same number")
+		assert.NotEqual(number, SafetyNumber(testKey, thirdKey))
+
+		// Each key contributes the same half to all of its safety numbers
+		digits := strings.ReplaceAll(number, " ", "")
+		half := safetyHalf(testKey)
+		assert.True(strings.HasPrefix(digits, half) || strings.HasSuffix(digits, half))
+		assert.Contains(strings.ReplaceAll(SafetyNumber(testKey, thirdKey), " ", ""), half)
+
+		assert.True(SameKey(testKey, testKey))
+		assert.False(SameKey(testKey, otherKey))
+	})
+
+	t.Run("Blocked names are re-rolled", func(t *testing.T) {
+		// Look for a key whose name spells a blocked word
+		var blockedKey ssh.PublicKey
+		for i := 0; i < 10000 && blockedKey == nil; i++ {
+			var seed [ed25519.SeedSize]byte
+			binary.BigEndian.PutUint32(seed[:], uint32(i))
+			key, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed[:]).Public())
+			require.NoError(t, err)
+			if regexp.MustCompile("fuk|dik|kunt|slut|wank|twat|tits|piss|porn|rape|nig|kum").MatchString(V0_2_0.Derive(key).DisplayName("en")) {
+				blockedKey = key
+			}
+		}
+		require.NotNil(t, blockedKey)
+
+		old, filtered := V0_2_0.Derive(blockedKey), V0_3_0.Derive(blockedKey)
+		assert.NotEqual(old.DisplayName("en"), filtered.DisplayName("en"), "0.3.0 re-rolls the name")
+		assert.Equal(filtered.DisplayName("en"), V0_3_0.Derive(blockedKey).DisplayName("en"), "Re-rolls are deterministic")
+		assert.Equal(old.Username(), filtered.Username(), "Only the name changes")
+		assert.Equal(old.PhoneNumber(), filtered.PhoneNumber())
+
+		// Both names lead back to the key
+		for _, name := range []string{old.DisplayName("en"), filtered.DisplayName("en")} {
+			candidates, ok := NameBits(name, nil)
+			assert.True(ok)
+			assert.True(containsBits(candidates, KeyBits(blockedKey)), name)
+		}
+
+		// Names without blocked words are the same in every scheme
+		assert.Equal(ua.DisplayName("en"), V0_3_0.Derive(testKey).DisplayName("en"))
+	})
+
+	t.Run("Names decode to key bits", func(t *testing.T) {
+		bits := KeyBits(testKey)
+		assert.True(bits.Equals(ua.keyBits))
+		for _, name := range []string{ua.CommonName("en"), ua.CommonName("ja"), strings.ToUpper(ua.CommonName("en")), ua.Disambiguate("displayName", 2).CommonName("en"),
+			ua.FullName("en"), ua.FullName("ja"), strings.ToLower(ua.FullName("en"))} {
+			candidates, ok := NameBits(name, nil)
+			assert.True(ok)
+			require.Len(t, candidates, 1, name)
+			assert.True(bits.Equals(candidates[0]), name)
+		}
+		// Without a separator a common name also reads as a full name, the
+		// halves swapped, and the other way round
+		for _, name := range []string{ua.CommonName("ko"), ua.CommonName("zh"), ua.FullName("ko"), ua.FullName("zh")} {
+			candidates, ok := NameBits(name, nil)
+			assert.True(ok)
+			assert.True(containsBits(candidates, bits), name)
+		}
+
+		candidates, ok := NameBits("not a name", nil)
+		assert.True(ok)
+		assert.Empty(candidates)
+
+		// A language that swaps syllables cannot rule anyone out
+		swapping := syllables.Builtin()
+		require.NoError(t, swapping.Register("xx",
+			(&syllables.Language{Tag: "xx", Nuclei: []string{"a", "b"}, Forbidden: []string{"bb"}}).Generator()))
+		_, ok = NameBits(strings.Repeat("ab", 20), swapping)
+		assert.False(ok)
+		_, ok = NameBits(ua.DisplayName("en"), nil)
+		assert.True(ok)
+	})
+
+	t.Run("Given name and surname", func(t *testing.T) {
+		v4 := V0_4_0.Derive(testKey)
+		given, family := v4.GivenName("en"), v4.Surname("en")
+		assert.Equal(given+" "+family, v4.DisplayName("en"))
+		assert.Equal(strings.ToLower(given+family), v4.CommonName("en"), "The halves make the common name")
+		assert.Equal(strings.ToUpper(given[:1]), given[:1])
+		assert.Equal(strings.ToUpper(family[:1]), family[:1])
+		assert.Equal("农", v4.Surname("zh"))
+		assert.Equal(v4.Surname("zh")+v4.GivenName("zh")+"（55466）", v4.DisplayName("zh"))
+		assert.Equal(v4.CommonName("zh"), v4.DisplayName("zh"), "Chinese common names are full names")
+		assert.Equal(v4.GivenName("ja")+"・"+v4.Surname("ja"), v4.DisplayName("ja"))
+		assert.Equal(given+" "+family+"2", v4.Disambiguate("displayName", 2).DisplayName("en"))
+
+		old := V0_3_0.Derive(testKey)
+		assert.Equal(old.CommonName("en"), old.DisplayName("en"), "Older schemes keep one-word display names")
+		assert.Equal(old.CommonName("en"), v4.CommonName("en"))
+
+		// Names re-rolled to avoid a blocked word are cut in two as well
+		rerolled := 0
+		for i := 0; i < 2000; i++ {
+			seed := make([]byte, ed25519.SeedSize)
+			_, err := rand.Read(seed)
+			require.NoError(t, err)
+			pubKey, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+			require.NoError(t, err)
+			v4 := V0_4_0.Derive(pubKey)
+			for _, lang := range v4.SupportedLanguages() {
+				whole := v4.GivenName(lang) + v4.Surname(lang)
+				if v4.generator(lang).Number(v4.keyBits) != "" {
+					whole = v4.FullName(lang) // the common name is the full name
+				}
+				if !assert.Equal(strings.ToLower(v4.CommonName(lang)), strings.ToLower(whole), "The halves make the common name of %x in %s", seed, lang) {
+					return
+				}
+				if v4.CommonName(lang) != V0_2_0.Derive(pubKey).CommonName(lang) {
+					rerolled++
+				}
+			}
+		}
+		assert.NotZero(rerolled, "Some names should have been re-rolled")
+
+		assert.Len([]rune(v4.GivenName("zh")), 2, "Chinese given names are short")
+	})
+
+	t.Run("Salted identities", func(t *testing.T) {
+		camp, other := ua.WithSalt([]byte("camp-2026")), ua.WithSalt([]byte("other-camp"))
+		assert.NotEqual(ua.Username(), camp.Username())
+		assert.NotEqual(camp.Username(), other.Username())
+		assert.NotEqual(ua.DisplayName("en"), camp.DisplayName("en"))
+		assert.NotEqual(ua.PhoneNumber(), camp.PhoneNumber())
+		assert.NotEqual(ua.AccentColor(), camp.AccentColor())
+		assert.Equal(camp.Username(), FromPublicKey(testKey).WithSalt([]byte("camp-2026")).Username(), "Pseudonyms are deterministic")
+		assert.NotEqual(ua.WordFingerprint(), camp.WordFingerprint(), "Word fingerprints would link pseudonyms")
+		assert.NotEqual(camp.WordFingerprint(), other.WordFingerprint())
+
+		assert.Equal(ua.Username(), ua.WithSalt(nil).Username(), "No salt is the global identity")
+		assert.Equal(ua.Username(), camp.WithSalt(nil).Username())
+		assert.True(KeyBits(testKey).Equals(ua.KeyBits()))
+
+		candidates, ok := NameBits(camp.DisplayName("en"), nil)
+		assert.True(ok)
+		assert.True(containsBits(candidates, camp.KeyBits()), "Pseudonyms decode to their own bits")
+		assert.NotEqual(SaltDigest([]byte("camp-2026")), SaltDigest([]byte("other-camp")))
+		assert.Len(SaltDigest([]byte("camp-2026")), 16)
+
+		// Salts that can be guessed are refused
+		for _, weak := range []string{"camp-2026", "camp-2026camp-2026", strings.Repeat("ab", 20)} {
+			assert.Error(CheckSalt([]byte(weak)), weak)
+		}
+		strong := make([]byte, 32)
+		_, err := rand.Read(strong)
+		require.NoError(t, err)
+		encoded := base64.StdEncoding.EncodeToString(strong)
+		assert.NoError(CheckSalt([]byte(encoded)))
+
+		path := filepath.Join(t.TempDir(), "salt")
+		require.NoError(t, os.WriteFile(path, []byte(encoded+"\n"), 0600))
+		salt, err := ReadSaltFile(path)
+		if assert.NoError(err) {
+			assert.Equal(encoded, string(salt), "The final newline is not part of the salt")
+		}
+		require.NoError(t, os.WriteFile(path, []byte("camp-2026\n"), 0600))
+		_, err = ReadSaltFile(path)
+		assert.Error(err)
 	})
 
 	t.Run("Supported languages", func(t *testing.T) {
 		langs := ua.SupportedLanguages()
-		assert.Equal([]string{"en"}, langs)
+		assert.Equal([]string{"en", "ja", "ko", "zh"}, langs)
+		for _, lang := range langs {
+			assert.NotEmpty(ua.DisplayName(lang))
+			assert.Equal(ua.DisplayName(lang), FromPublicKey(testKey).DisplayName(lang), "Names should be deterministic")
+		}
+		assert.Equal(ua.DisplayName("en"), ua.DisplayName("fr"), "Unsupported languages fall back to English")
+		assert.Equal(ua.DisplayName("en"), ua.DisplayName("en-GB"), "Regional variants fall back to their language")
+		assert.Equal(ua.DisplayName("zh"), ua.DisplayName("zh-Hans-CN"))
+		assert.Equal(ua.DisplayName("ja"), ua.DisplayName("JA"), "Tags are case-insensitive")
 	})
+
+	t.Run("Loaded languages", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "es.yaml"), []byte(`
+tag: es
+name: Spanish
+script: Latn
+onsets: [b, c, d, f, g, l, m, n, p, r, s, t, v, ch, ll, j]
+nuclei: [a, e, i, o, u, ia, ie, ue]
+codas: ["", l, n, r]
+`), 0644))
+		languages, tags, err := LoadLanguages(dir)
+		require.NoError(t, err)
+		assert.Equal([]string{"es"}, tags)
+
+		es := FromPublicKey(testKey).WithLanguages(languages)
+		assert.Equal([]string{"en", "es", "ja", "ko", "zh"}, es.SupportedLanguages())
+		assert.NotEmpty(es.DisplayName("es"))
+		assert.Equal(ua.DisplayName("en"), es.DisplayName("en"), "Other languages should be unchanged")
+		assert.Equal([]string{"en", "ja", "ko", "zh"}, FromPublicKey(testKey).SupportedLanguages(), "Loading languages changes nothing else")
+		candidates, ok := NameBits(es.DisplayName("es"), languages)
+		assert.True(ok)
+		assert.True(containsBits(candidates, es.KeyBits()), "Names in loaded languages decode")
+
+		// Redefining a built-in language would rename everyone
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "es.yaml"), []byte("tag: en\nnuclei: [a, e]\n"), 0644))
+		_, _, err = LoadLanguages(dir)
+		assert.Error(err)
+	})
+}
+
+// TestBaseline pins V0_1_0 to what lilidap derived before schemes existed
+// (commit 8d46c76), so that nobody's identity changes under them
+func TestBaseline(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []ssh.PublicKey{testKey}
+	for i := 1; i <= 6; i++ {
+		priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{byte(i * 37)}, ed25519.SeedSize))
+		pubKey, err := ssh.NewPublicKey(priv.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, pubKey)
+	}
+
+	golden := []struct {
+		fingerprint string
+		uid         string
+		uidNumber   int
+		phoneNumber string
+		displayName string
+	}{
+		{"SHA256:ApmI1IvUj2TRLRXDUc86bfl6fUTLNkbRmElZ2Kq5z0w", "uakmyrvel", 930577240884, "8930577239884", "lutbousnifkeit"},
+		{"SHA256:QCW+2YcH7dhiasd+KlS1usXjo20lV+rItEjUp7oTBmw", "uias35wmh", 720381348436, "8720381347436", "leistuntikwef"},
+		{"SHA256:DMZQfnfNuViD11vgBcTHLwlWsbRECKvQuy0FBUsrllk", "ubtdfa7tx", 22735985217, "822735984217", "zaisgeifkongem"},
+		{"SHA256:TG6frS9Ve5HYpknUxOXorQ2Ebcc2E+f9JtIcF4N/Ogc", "ujrxj7ljp", 100990402031, "8100990401031", "vaswukvomwaim"},
+		{"SHA256:RVeuzgKk3MVxJP04uUfHDhPqdC3LpEip/BE0tTERIE8", "uivl25tqc", 778212287543, "8778212286543", "yumsumtetdaif"},
+		{"SHA256:p1an63XYoj5Pad//eqPhEY9Z7T8wrwjHGc2rSkxEhjw", "uu5lkp23v", 319107140132, "8319107139132", "lostildunzil"},
+		{"SHA256:dgHxOkz5ukwiCd94kI1cfwFCyG2R0tWxILTZxIJgbgA", "uoya7cosm", 844000948712, "8844000947712", "pasnemfimket"},
+	}
+	for i, want := range golden {
+		assert.Equal(want.fingerprint, ssh.FingerprintSHA256(keys[i]))
+		for _, ua := range []*UserAttributes{FromPublicKey(keys[i]), V0_1_0.Derive(keys[i])} {
+			assert.Equal(want.uid, ua.Username())
+			assert.Equal(want.uidNumber, ua.PosixUserID())
+			assert.Equal(DefaultGID, ua.PosixGroupID())
+			assert.Equal(want.phoneNumber, ua.PhoneNumber())
+			assert.Equal(want.displayName, ua.DisplayName("en"))
+			assert.Equal(want.displayName, ua.CommonName("en"))
+		}
+	}
 }
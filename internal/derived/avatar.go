@@ -0,0 +1,147 @@
+package derived
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+// Avatars are identicons: a 5x5 grid, mirrored left to right, in an accent
+// color on a light background. They are drawn from hash bits past the first
+// KEY_HASH_BIT_LENGTH, so two keys whose other attributes collide still look
+// different.
+
+// AvatarGrid is the number of cells across an avatar
+const AvatarGrid = 5
+
+// avatarBackground is the color of empty cells
+var avatarBackground = color.RGBA{0xF0, 0xF0, 0xF0, 0xFF}
+
+// Avatar is the identicon of a key
+type Avatar struct {
+	Cells [AvatarGrid][AvatarGrid]bool // [row][column], true where filled
+	Color color.RGBA                   // the accent color
+}
+
+// Avatar returns the identicon of the key
+func (ua *UserAttributes) Avatar() *Avatar {
+	a := &Avatar{Color: ua.accentColor()}
+	// 15 bits fill the left three columns, which are mirrored onto the right
+	bits := uint(ua.hash[10])<<8 | uint(ua.hash[11])
+	half := (AvatarGrid + 1) / 2
+	for row := 0; row < AvatarGrid; row++ {
+		for col := 0; col < half; col++ {
+			filled := bits&(1<<(row*half+col)) != 0
+			a.Cells[row][col] = filled
+			a.Cells[row][AvatarGrid-1-col] = filled
+		}
+	}
+	return a
+}
+
+// AccentColor returns the key's color as #rrggbb, for highlighting its owner
+// in clients; avatars are drawn in it
+func (ua *UserAttributes) AccentColor() string {
+	c := ua.accentColor()
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// accentColor picks a hue from the hash, at a saturation and lightness that
+// read well on both light and dark backgrounds
+func (ua *UserAttributes) accentColor() color.RGBA {
+	hue := float64(uint(ua.hash[8])<<8|uint(ua.hash[9])) / 65536 * 360
+	return hslToRGB(hue, 0.65, 0.5)
+}
+
+// hslToRGB converts a color given as hue (degrees), saturation and lightness
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	scale := func(v float64) uint8 { return uint8(math.Round((v + m) * 255)) }
+	return color.RGBA{scale(r), scale(g), scale(b), 0xFF}
+}
+
+// Image renders the avatar as a size x size image, with a margin of half a
+// cell around the grid
+func (a *Avatar) Image(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	// Work in half cells: the grid spans 2*AvatarGrid of them plus one each side
+	halves := 2*AvatarGrid + 2
+	cell := func(p int) (int, bool) {
+		half := p * halves / size
+		if half < 1 || half > 2*AvatarGrid {
+			return 0, false
+		}
+		return (half - 1) / 2, true
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := avatarBackground
+			row, inRow := cell(y)
+			col, inCol := cell(x)
+			if inRow && inCol && a.Cells[row][col] {
+				c = a.Color
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// PNG encodes the avatar as a size x size PNG
+func (a *Avatar) PNG(size int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, a.Image(size)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// JPEG encodes the avatar as a size x size JPEG, as LDAP's jpegPhoto expects
+func (a *Avatar) JPEG(size int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, a.Image(size), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// BlockArt draws the avatar for a 24-bit color terminal, two characters per
+// cell so that it comes out square
+func (a *Avatar) BlockArt() string {
+	var b strings.Builder
+	filled := fmt.Sprintf("\x1b[38;2;%d;%d;%dm██\x1b[0m", a.Color.R, a.Color.G, a.Color.B)
+	empty := fmt.Sprintf("\x1b[38;2;%d;%d;%dm██\x1b[0m", avatarBackground.R, avatarBackground.G, avatarBackground.B)
+	for _, row := range a.Cells {
+		for _, cell := range row {
+			if cell {
+				b.WriteString(filled)
+			} else {
+				b.WriteString(empty)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
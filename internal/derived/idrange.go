@@ -0,0 +1,80 @@
+package derived
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IDRange is an inclusive range of POSIX user or group IDs that derived IDs
+// are mapped into. The KEY_HASH_BIT_LENGTH bits of a key go well past 2^32,
+// which Linux, NFS and Samba reject or truncate, so they are reduced modulo
+// the size of the range.
+type IDRange struct {
+	Min uint32
+	Max uint32
+}
+
+// LegacyUIDBase is added to the key bits to give the uidNumber when no UID
+// range is set, as every identity was derived before ranges existed. The
+// result can go well past 2^32, so new deployments should set a range.
+const LegacyUIDBase = 1000
+
+// RecommendedUIDRange keeps derived uids clear of system and local accounts
+// and of the tools that still treat IDs as signed 32-bit integers
+var RecommendedUIDRange = IDRange{Min: 200000, Max: 1<<31 - 1}
+
+// DefaultGID is the group shared by every user unless a GID range is configured
+const DefaultGID = 1001
+
+// ParseIDRange reads a range written as "min-max"
+func ParseIDRange(value string) (IDRange, error) {
+	lo, hi, ok := strings.Cut(value, "-")
+	if !ok {
+		return IDRange{}, fmt.Errorf("invalid ID range %q: want min-max", value)
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 32)
+	if err != nil {
+		return IDRange{}, fmt.Errorf("invalid ID range %q: %w", value, err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 32)
+	if err != nil {
+		return IDRange{}, fmt.Errorf("invalid ID range %q: %w", value, err)
+	}
+	r := IDRange{Min: uint32(min), Max: uint32(max)}
+	return r, r.Validate()
+}
+
+// Validate checks that the range is usable for regular accounts
+func (r IDRange) Validate() error {
+	switch {
+	case r.Min > r.Max:
+		return fmt.Errorf("ID range %s is empty", r)
+	case r.Min < 1000:
+		return fmt.Errorf("ID range %s overlaps system accounts below 1000", r)
+	case r.Max == 1<<32-1:
+		return fmt.Errorf("ID range %s includes 4294967295, which means \"no ID\" to the kernel", r)
+	}
+	return nil
+}
+
+// Size returns the number of IDs in the range
+func (r IDRange) Size() uint64 {
+	return uint64(r.Max) - uint64(r.Min) + 1
+}
+
+// Map deterministically maps a value into the range. Each step of offset
+// moves to the next ID, wrapping around at Max, so colliding keys can be
+// probed linearly.
+func (r IDRange) Map(value uint64, offset int) uint32 {
+	return r.Min + uint32((value+uint64(offset))%r.Size())
+}
+
+// Contains reports whether the ID is in the range
+func (r IDRange) Contains(id uint32) bool {
+	return id >= r.Min && id <= r.Max
+}
+
+func (r IDRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
@@ -0,0 +1,132 @@
+package derived
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PhoneFormat describes how telephone numbers are derived for a deployment.
+// Local numbers are Prefix followed by digits mapped from the key hash, and
+// optionally a Luhn check digit; with a CountryCode they are also published
+// in E.164 form.
+type PhoneFormat struct {
+	Prefix      string // dialled before the derived digits, e.g. "8"
+	Digits      int    // derived digits after the prefix; 0 uses all of KEY_HASH_BIT_LENGTH
+	CheckDigit  bool   // append a Luhn check digit to catch misdialled numbers
+	CountryCode string // E.164 country calling code, e.g. "1" or "44"; empty for local numbers only
+}
+
+// DefaultPhoneFormat is the original format: 8 and every digit of the hash bits
+var DefaultPhoneFormat = PhoneFormat{Prefix: "8"}
+
+// maxE164Digits is the longest number E.164 allows, country code included
+const maxE164Digits = 15
+
+// Validate checks that the format yields dialable numbers
+func (f PhoneFormat) Validate() error {
+	if !isDigits(f.Prefix) {
+		return fmt.Errorf("phone prefix %q must be digits", f.Prefix)
+	}
+	if f.Digits < 0 || f.Digits > 18 {
+		return fmt.Errorf("phone number digits must be between 1 and 18 (or 0 for all), got %d", f.Digits)
+	}
+	if f.CountryCode != "" {
+		if !isDigits(f.CountryCode) || len(f.CountryCode) > 3 || f.CountryCode[0] == '0' {
+			return fmt.Errorf("country code %q must be 1 to 3 digits, not starting with 0", f.CountryCode)
+		}
+		if f.Digits == 0 {
+			return fmt.Errorf("a country code needs a fixed number of digits")
+		}
+		if length := len(f.CountryCode) + f.localLength(); length > maxE164Digits {
+			return fmt.Errorf("E.164 numbers have at most %d digits, this format gives %d", maxE164Digits, length)
+		}
+	}
+	return nil
+}
+
+// localLength returns the length of fixed-length local numbers
+func (f PhoneFormat) localLength() int {
+	length := len(f.Prefix) + f.Digits
+	if f.CheckDigit {
+		length++
+	}
+	return length
+}
+
+// local formats the number for a hash value. Fixed-length numbers move one
+// step further per suffix, wrapping around, like numeric IDs; numbers using
+// all the hash digits get the suffix appended as before.
+func (f PhoneFormat) local(value uint64, suffix int) string {
+	var b strings.Builder
+	b.WriteString(f.Prefix)
+	if f.Digits == 0 {
+		fmt.Fprintf(&b, "%04d", value)
+		if suffix > 0 {
+			b.WriteString(strconv.Itoa(suffix))
+		}
+	} else {
+		modulus := uint64(1)
+		for i := 0; i < f.Digits; i++ {
+			modulus *= 10
+		}
+		if suffix > 0 {
+			value += uint64(suffix - 1)
+		}
+		fmt.Fprintf(&b, "%0*d", f.Digits, value%modulus)
+	}
+	if f.CheckDigit {
+		b.WriteByte(LuhnDigit(b.String()))
+	}
+	return b.String()
+}
+
+func (f PhoneFormat) String() string {
+	digits := "all"
+	if f.Digits > 0 {
+		digits = strconv.Itoa(f.Digits)
+	}
+	s := fmt.Sprintf("prefix %q, %s digits", f.Prefix, digits)
+	if f.CheckDigit {
+		s += ", check digit"
+	}
+	if f.CountryCode != "" {
+		s += ", +" + f.CountryCode
+	}
+	return s
+}
+
+// LuhnDigit returns the Luhn check digit for a string of digits
+func LuhnDigit(digits string) byte {
+	sum := 0
+	double := true // the check digit itself will be in the undoubled position
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// LuhnValid reports whether a string of digits ends with its Luhn check digit
+func LuhnValid(digits string) bool {
+	if len(digits) < 2 || !isDigits(digits) {
+		return false
+	}
+	return LuhnDigit(digits[:len(digits)-1]) == digits[len(digits)-1]
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package derived
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A safety number is shared by two keys, like Signal's: both people see the
+// same 60 digits, so reading them to each other confirms that each holds the
+// key the other expects. Each key contributes 30 digits of an iterated
+// SHA-512 of it, and the halves are put in sorted order so that it does not
+// matter who computes the number.
+
+// safetyNumberVersion is hashed in first, so the derivation can evolve
+const safetyNumberVersion = 0
+
+// safetyNumberIterations slows down searching for a key sharing a half
+const safetyNumberIterations = 5200
+
+// SafetyNumberGroups is the number of five-digit groups in a safety number
+const SafetyNumberGroups = 12
+
+// SafetyNumber returns the safety number of two keys, as twelve groups of
+// five digits separated by spaces
+func SafetyNumber(a, b ssh.PublicKey) string {
+	halves := []string{safetyHalf(a), safetyHalf(b)}
+	if halves[0] > halves[1] {
+		halves[0], halves[1] = halves[1], halves[0]
+	}
+	digits := halves[0] + halves[1]
+
+	groups := make([]string, 0, SafetyNumberGroups)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+// safetyHalf returns the 30 digits a key contributes to its safety numbers
+func safetyHalf(key ssh.PublicKey) string {
+	marshaled := key.Marshal()
+	var version [2]byte
+	binary.BigEndian.PutUint16(version[:], safetyNumberVersion)
+
+	hash := sha512.Sum512(append(version[:], marshaled...))
+	for i := 1; i < safetyNumberIterations; i++ {
+		hash = sha512.Sum512(append(hash[:], marshaled...))
+	}
+
+	// Six chunks of five bytes, each reduced to five digits
+	var b strings.Builder
+	for chunk := 0; chunk < SafetyNumberGroups/2; chunk++ {
+		var padded [8]byte
+		copy(padded[3:], hash[5*chunk:5*chunk+5])
+		fmt.Fprintf(&b, "%05d", binary.BigEndian.Uint64(padded[:])%100000)
+	}
+	return b.String()
+}
+
+// SameKey reports whether two keys are the same, in which case their
+// safety number proves nothing
+func SameKey(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
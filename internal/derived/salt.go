@@ -0,0 +1,78 @@
+package derived
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// A salt is a secret: anyone holding it can work out which pseudonym is
+// whose key. It is read from a file or the environment rather than the
+// command line, where other users of the host can see it, and it must be
+// too long and varied to guess, since every pseudonym published checks a
+// guess.
+
+// SaltEnv is the environment variable a salt can be passed in
+const SaltEnv = "LILIDAP_SALT"
+
+// MinSaltLength and MinSaltBits bound how short and how predictable a salt
+// may be, the bits estimated from how often each byte occurs in it
+const (
+	MinSaltLength = 16
+	MinSaltBits   = 64
+)
+
+// CheckSalt rejects salts short or repetitive enough to be guessed, such as
+// the name and year of an event
+func CheckSalt(salt []byte) error {
+	if len(salt) < MinSaltLength {
+		return fmt.Errorf("salt has %d bytes, want at least %d", len(salt), MinSaltLength)
+	}
+	if bits := saltBits(salt); bits < MinSaltBits {
+		return fmt.Errorf("salt has about %.0f bits of entropy, want at least %d: use random bytes, e.g. from openssl rand -base64 32", bits, MinSaltBits)
+	}
+	return nil
+}
+
+// saltBits estimates the entropy of a salt as its length times the Shannon
+// entropy of its byte frequencies, which is generous to words but catches
+// short alphabets and repetition
+func saltBits(salt []byte) float64 {
+	counts := map[byte]int{}
+	for _, b := range salt {
+		counts[b]++
+	}
+	perByte := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(len(salt))
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * float64(len(salt))
+}
+
+// ReadSaltFile reads and checks the salt in a file, ignoring a final newline
+func ReadSaltFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read salt: %w", err)
+	}
+	salt := []byte(strings.TrimRight(string(data), "\r\n"))
+	if err := CheckSalt(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// SaltDigest tells a salt apart from others in the registry, so that
+// identities derived with another salt are derived again. It is an HMAC
+// keyed with the salt, like the pseudonyms, and checks guesses at the salt
+// just as well, so it is kept in the registry only, never printed or logged.
+func SaltDigest(salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte("lilidap registry"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,216 @@
+package derived
+
+import (
+	stdbase32 "encoding/base32"
+	"fmt"
+	"strings"
+
+	"lilidap/internal/base32"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Scheme is a named, versioned derivation algorithm. Users keep the
+// identity a scheme gave them for as long as the server serves that scheme,
+// so a published scheme must never change its output: any change to how an
+// attribute is derived goes into a new version, served side by side with
+// the old ones under its own dc=X_Y_Z naming context.
+
+// Attributes a scheme derives, as used in Scheme.Changed and Compatible
+var DerivedAttributes = []string{"uid", "uidNumber", "gidNumber", "telephoneNumber", "displayName"}
+
+// Scheme is a versioned derivation algorithm
+type Scheme struct {
+	Version string   // SemVer, written X_Y_Z in DNs
+	Summary string   // what this version is, for humans
+	Changed []string // attributes derived differently than in the previous version
+
+	username      func(ua *UserAttributes) string
+	matchUsername func(typed, uid string) bool
+	filterNames   bool // re-roll names spelling a word of their language's blocklist
+	splitNames    bool // derive givenName and sn, and make displayName the full name
+}
+
+// V0_1_0 is the original derivation, reproducing every attribute lilidap
+// derived before schemes existed. Its uid is lowercased RFC 4648 base32, not
+// the confusable-free alphabet of internal/base32.
+var V0_1_0 = &Scheme{
+	Version: "0.1.0",
+	Summary: "original derivation",
+	username: func(ua *UserAttributes) string {
+		return "u" + strings.ToLower(stdbase32.StdEncoding.EncodeToString(ua.hash[:])[:8])
+	},
+	matchUsername: strings.EqualFold,
+}
+
+// V0_2_0 encodes uid with the confusable-free alphabet of internal/base32,
+// so that uids typed with 0/O or 1/l/I mix-ups still match
+var V0_2_0 = &Scheme{
+	Version:       "0.2.0",
+	Summary:       "uid in the confusable-free base32 alphabet",
+	Changed:       []string{"uid"},
+	username:      confusableFreeUsername,
+	matchUsername: matchConfusableFree,
+}
+
+// V0_3_0 re-rolls display names that spell a word of their language's
+// blocklist, in every language. The built-in blocklists are frozen with it;
+// loaded languages are told apart by their Registry digest.
+var V0_3_0 = &Scheme{
+	Version:       "0.3.0",
+	Summary:       "display names re-rolled to avoid blocked words",
+	Changed:       []string{"displayName"},
+	username:      confusableFreeUsername,
+	matchUsername: matchConfusableFree,
+	filterNames:   true,
+}
+
+// V0_4_0 splits names into a capitalized given name and family name, for
+// the givenName and sn of address books, and makes displayName the full
+// name. cn stays the single word it always was.
+var V0_4_0 = &Scheme{
+	Version:       "0.4.0",
+	Summary:       "givenName and sn, and displayName as the full name",
+	Changed:       []string{"displayName"},
+	username:      confusableFreeUsername,
+	matchUsername: matchConfusableFree,
+	filterNames:   true,
+	splitNames:    true,
+}
+
+func confusableFreeUsername(ua *UserAttributes) string {
+	encoded, err := base32.Encode(ua.hash[:], 40)
+	if err != nil {
+		panic(err) // the hash always has 40 bits
+	}
+	return "u" + encoded
+}
+
+func matchConfusableFree(typed, uid string) bool {
+	if strings.EqualFold(typed, uid) {
+		return true
+	}
+	// Leave the u prefix alone, since it is not in the alphabet
+	if len(typed) == 0 || (typed[0] != 'u' && typed[0] != 'U') {
+		return false
+	}
+	return "u"+base32.Normalize(typed[1:]) == uid
+}
+
+// schemes lists every published scheme, oldest first
+var schemes = []*Scheme{V0_1_0, V0_2_0, V0_3_0, V0_4_0}
+
+// DefaultScheme is what FromPublicKey derives with. It stays at the oldest
+// scheme so that nobody's identity changes unless a server opts in.
+var DefaultScheme = V0_1_0
+
+// Schemes returns every published scheme, oldest first
+func Schemes() []*Scheme {
+	return append([]*Scheme{}, schemes...)
+}
+
+// LatestScheme returns the newest published scheme
+func LatestScheme() *Scheme {
+	return schemes[len(schemes)-1]
+}
+
+// LookupScheme finds a scheme by version, written either X.Y.Z or X_Y_Z
+func LookupScheme(version string) (*Scheme, bool) {
+	version = strings.ReplaceAll(version, "_", ".")
+	for _, scheme := range schemes {
+		if scheme.Version == version {
+			return scheme, true
+		}
+	}
+	return nil, false
+}
+
+// ParseSchemes reads a comma-separated list of versions
+func ParseSchemes(versions string) ([]*Scheme, error) {
+	var result []*Scheme
+	for _, version := range strings.Split(versions, ",") {
+		version = strings.TrimSpace(version)
+		if version == "" {
+			continue
+		}
+		scheme, ok := LookupScheme(version)
+		if !ok {
+			return nil, fmt.Errorf("unknown derivation scheme %q", version)
+		}
+		result = append(result, scheme)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no derivation schemes given")
+	}
+	return result, nil
+}
+
+// UsernameMatches reports whether a uid typed by a person denotes uid, as
+// derived by this scheme. Schemes from 0.2.0 tolerate confusable characters.
+func (s *Scheme) UsernameMatches(typed, uid string) bool {
+	return s.matchUsername(strings.TrimSpace(typed), uid)
+}
+
+// UsernameSpellings returns the uids a typed uid may denote in any scheme,
+// for looking them up in an index; UsernameMatches has the last word
+func UsernameSpellings(typed string) []string {
+	typed = strings.TrimSpace(typed)
+	spellings := []string{strings.ToLower(typed)}
+	if len(typed) > 0 && (typed[0] == 'u' || typed[0] == 'U') {
+		if normalized := "u" + base32.Normalize(typed[1:]); normalized != spellings[0] {
+			spellings = append(spellings, normalized)
+		}
+	}
+	return spellings
+}
+
+// SplitsNames reports whether the scheme derives givenName and sn
+func (s *Scheme) SplitsNames() bool {
+	return s.splitNames
+}
+
+// DC returns the version as the DN's domain component, e.g. 0_1_0
+func (s *Scheme) DC() string {
+	return strings.ReplaceAll(s.Version, ".", "_")
+}
+
+// Derive generates the attributes of a key with this scheme
+func (s *Scheme) Derive(pubKey ssh.PublicKey) *UserAttributes {
+	return derive(pubKey, s)
+}
+
+// Compatible returns the attributes that this scheme and other derive
+// identically, in the order of DerivedAttributes
+func (s *Scheme) Compatible(other *Scheme) []string {
+	lo, hi := s.index(), other.index()
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	changed := map[string]bool{}
+	for _, scheme := range schemes[lo+1 : hi+1] {
+		for _, attr := range scheme.Changed {
+			changed[attr] = true
+		}
+	}
+	var same []string
+	for _, attr := range DerivedAttributes {
+		if !changed[attr] {
+			same = append(same, attr)
+		}
+	}
+	return same
+}
+
+// index returns the position of the scheme in the published list
+func (s *Scheme) index() int {
+	for i, scheme := range schemes {
+		if scheme == s {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("derivation scheme %s is not published", s.Version))
+}
+
+func (s *Scheme) String() string {
+	return s.Version
+}
@@ -0,0 +1,35 @@
+package syllables
+
+// Generators for Japanese, Korean and Chinese names. Like English names, they
+// are made of syllables drawn from the key bits, but written in the script
+// native speakers read, following what names in each language sound like.
+// Their syllables are listed in languages/.
+
+// JapaneseGenerator writes names in katakana, as made-up and foreign names
+// are in Japan: a mora per syllable, each optionally closed by ン
+type JapaneseGenerator struct {
+	BaseGenerator
+}
+
+func NewJapaneseGenerator() *JapaneseGenerator {
+	return &JapaneseGenerator{mustEmbedded("ja")}
+}
+
+// KoreanGenerator writes names in hangul, one syllable block per syllable
+type KoreanGenerator struct {
+	BaseGenerator
+}
+
+func NewKoreanGenerator() *KoreanGenerator {
+	return &KoreanGenerator{mustEmbedded("ko")}
+}
+
+// ChineseGenerator writes names in simplified hanzi: a common surname, and
+// a given name of characters common in given names, one per syllable
+type ChineseGenerator struct {
+	BaseGenerator
+}
+
+func NewChineseGenerator() *ChineseGenerator {
+	return &ChineseGenerator{mustEmbedded("zh")}
+}
@@ -0,0 +1,263 @@
+package syllables
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Languages are defined in YAML or JSON files, so that adding one needs no
+// Go code:
+//
+//	tag: es              # BCP 47 language tag, as in displayName;lang-es
+//	name: Spanish
+//	script: Latn         # ISO 15924 script code
+//	onsets: [b, ch, d, ...]
+//	nuclei: [a, e, i, o, u, ia, ie, ue]
+//	codas: ["", l, n, r]
+//	forbidden: [rr]      # sequences names must not contain
+//	blocklist: [puta]    # words names are re-rolled to avoid
+//	familyFirst: false   # full names: given name first
+//	separator: " "       # between given name and family name
+//	givenSyllables: 2    # at most this many syllables in given names
+//	surnames: [García, ...] # family names, instead of spelling them
+//
+// Each list holds a power of two entries, so that every pattern of key bits
+// picks one.
+// The built-in languages live in languages/ and are embedded in the binary.
+
+//go:embed languages/*.yaml
+var embedded embed.FS
+
+// Language is a language definition as read from a file
+type Language struct {
+	Tag       string   `yaml:"tag" json:"tag"`
+	Name      string   `yaml:"name" json:"name"`
+	Script    string   `yaml:"script" json:"script"`
+	Onsets    []string `yaml:"onsets" json:"onsets"`
+	Nuclei    []string `yaml:"nuclei" json:"nuclei"`
+	Codas     []string `yaml:"codas" json:"codas"`
+	Forbidden []string `yaml:"forbidden" json:"forbidden"`
+	Blocklist []string `yaml:"blocklist" json:"blocklist"`
+	// FamilyFirst and Separator say how full names are written: given name,
+	// a space and family name unless the file says otherwise
+	FamilyFirst bool    `yaml:"familyFirst" json:"familyFirst"`
+	Separator   *string `yaml:"separator" json:"separator"`
+	// GivenSyllables caps the length of given names, where they are short
+	GivenSyllables int `yaml:"givenSyllables" json:"givenSyllables,omitempty"`
+	// Surnames lists family names to pick from, where a language has few
+	// and spelling new ones would not read as a name
+	Surnames []string `yaml:"surnames" json:"surnames,omitempty"`
+	// Compose names a way of writing syllables other than concatenating
+	// their parts; "hangul" composes jamo into syllable blocks
+	Compose string `yaml:"compose" json:"compose"`
+}
+
+// ParseLanguage reads a language definition in YAML or JSON (which is YAML).
+// Unknown fields are errors, so that a misspelled blocklist is not silently
+// ignored.
+func ParseLanguage(data []byte) (*Language, error) {
+	var lang Language
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&lang); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := lang.Validate(); err != nil {
+		return nil, err
+	}
+	return &lang, nil
+}
+
+// Validate checks that the definition makes a working generator
+func (l *Language) Validate() error {
+	if l.Tag == "" || strings.ContainsAny(l.Tag, " ,;=_") {
+		return fmt.Errorf("language tag %q must be a BCP 47 tag like es or pt-BR", l.Tag)
+	}
+	if len(l.Nuclei) < 2 {
+		return fmt.Errorf("language %s needs at least two nuclei", l.Tag)
+	}
+	for _, part := range []struct {
+		name string
+		list []string
+	}{{"onsets", l.Onsets}, {"nuclei", l.Nuclei}, {"codas", l.Codas}, {"surnames", l.Surnames}} {
+		// Only whole powers of two use every bit pattern exactly once
+		if n := len(part.list); n > 1 && n&(n-1) != 0 {
+			return fmt.Errorf("language %s has %d %s, which must be a power of two", l.Tag, n, part.name)
+		}
+		seen := map[string]bool{}
+		for _, s := range part.list {
+			if seen[s] {
+				return fmt.Errorf("language %s lists %q twice in its %s", l.Tag, s, part.name)
+			}
+			seen[s] = true
+		}
+	}
+	for _, f := range l.Forbidden {
+		if f == "" {
+			return fmt.Errorf("language %s forbids an empty sequence", l.Tag)
+		}
+	}
+	if l.GivenSyllables < 0 {
+		return fmt.Errorf("language %s cannot have given names of %d syllables", l.Tag, l.GivenSyllables)
+	}
+	if len(l.Surnames) > 0 && l.GivenSyllables == 0 {
+		return fmt.Errorf("language %s lists surnames, so it needs givenSyllables", l.Tag)
+	}
+	for _, surname := range l.Surnames {
+		if surname == "" || strings.ContainsAny(surname, "0123456789"+numberOpen+numberClose) {
+			return fmt.Errorf("language %s has surname %q, which must be letters", l.Tag, surname)
+		}
+	}
+	for _, word := range l.Blocklist {
+		if word == "" {
+			return fmt.Errorf("language %s blocks an empty word", l.Tag)
+		}
+	}
+	switch l.Compose {
+	case "":
+	case "hangul":
+		if err := checkHangul(l); err != nil {
+			return fmt.Errorf("language %s: %w", l.Tag, err)
+		}
+	default:
+		return fmt.Errorf("language %s: unknown composition %q", l.Tag, l.Compose)
+	}
+	return nil
+}
+
+// Generator builds the generator the definition describes
+func (l *Language) Generator() *BaseGenerator {
+	g := NewBaseGenerator(l.Onsets, l.Nuclei, l.Codas)
+	g.Forbidden = l.Forbidden
+	g.Blocklist = l.Blocklist
+	g.FamilyFirst = l.FamilyFirst
+	g.GivenSyllables = l.GivenSyllables
+	g.Surnames = l.Surnames
+	g.surnameBits = BitsFor(l.Surnames)
+	g.NameSeparator = " "
+	if l.Separator != nil {
+		g.NameSeparator = *l.Separator
+	}
+	if l.Compose == "hangul" {
+		g.Compose = composeHangul(l)
+	}
+	return &g
+}
+
+// EmbeddedLanguages returns the built-in language definitions, by tag
+func EmbeddedLanguages() map[string]*Language {
+	langs, err := loadLanguages(embedded, "languages")
+	if err != nil {
+		panic(err) // the embedded files are tested
+	}
+	return langs
+}
+
+// LoadLanguageDir reads every .yaml, .yml and .json file in a directory
+func LoadLanguageDir(dir string) (map[string]*Language, error) {
+	return loadLanguages(os.DirFS(dir), ".")
+}
+
+func loadLanguages(fsys fs.FS, dir string) (map[string]*Language, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read language files: %w", err)
+	}
+
+	langs := map[string]*Language{}
+	for _, entry := range entries {
+		switch path.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read language file %s: %w", entry.Name(), err)
+		}
+		lang, err := ParseLanguage(data)
+		if err != nil {
+			return nil, fmt.Errorf("language file %s: %w", entry.Name(), err)
+		}
+		if _, dup := langs[lang.Tag]; dup {
+			return nil, fmt.Errorf("language file %s: language %s is defined twice", entry.Name(), lang.Tag)
+		}
+		langs[lang.Tag] = lang
+	}
+	return langs, nil
+}
+
+// mustEmbedded returns the generator of a built-in language
+func mustEmbedded(tag string) BaseGenerator {
+	lang, ok := EmbeddedLanguages()[tag]
+	if !ok {
+		panic(fmt.Sprintf("no embedded language %s", tag))
+	}
+	return *lang.Generator()
+}
+
+// Compatibility jamo in the order of the Unicode hangul syllable composition
+var (
+	hangulInitials = []rune("ㄱㄲㄴㄷㄸㄹㅁㅂㅃㅅㅆㅇㅈㅉㅊㅋㅌㅍㅎ")
+	hangulMedials  = []rune("ㅏㅐㅑㅒㅓㅔㅕㅖㅗㅘㅙㅚㅛㅜㅝㅞㅟㅠㅡㅢㅣ")
+	hangulFinals   = []rune("ㄱㄲㄳㄴㄵㄶㄷㄹㄺㄻㄼㄽㄾㄿㅀㅁㅂㅄㅅㅆㅇㅈㅊㅋㅌㅍㅎ") // after the empty final
+)
+
+// jamoIndex returns the position of a single jamo in a table
+func jamoIndex(table []rune, jamo string) int {
+	r := []rune(jamo)
+	if len(r) != 1 {
+		return -1
+	}
+	for i, t := range table {
+		if t == r[0] {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkHangul checks that onsets, nuclei and codas are jamo of their kind
+func checkHangul(l *Language) error {
+	if len(l.Onsets) == 0 {
+		return fmt.Errorf("hangul syllables need onsets (ㅇ for none)")
+	}
+	for _, onset := range l.Onsets {
+		if jamoIndex(hangulInitials, onset) < 0 {
+			return fmt.Errorf("onset %q is not an initial jamo", onset)
+		}
+	}
+	for _, nucleus := range l.Nuclei {
+		if jamoIndex(hangulMedials, nucleus) < 0 {
+			return fmt.Errorf("nucleus %q is not a vowel jamo", nucleus)
+		}
+	}
+	for _, coda := range l.Codas {
+		if coda != "" && jamoIndex(hangulFinals, coda) < 0 {
+			return fmt.Errorf("coda %q is not a final jamo", coda)
+		}
+	}
+	return nil
+}
+
+// composeHangul composes syllable blocks, since jamo written one after the
+// other do not make one
+func composeHangul(l *Language) func(onset, nucleus, coda int) string {
+	return func(onset, nucleus, coda int) string {
+		final := 0
+		if coda >= 0 && l.Codas[coda] != "" {
+			final = jamoIndex(hangulFinals, l.Codas[coda]) + 1
+		}
+		initial := jamoIndex(hangulInitials, l.Onsets[onset])
+		medial := jamoIndex(hangulMedials, l.Nuclei[nucleus])
+		return string(rune(0xAC00 + (initial*21+medial)*28 + final))
+	}
+}
@@ -0,0 +1,129 @@
+package syllables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry holds syllable generators by BCP 47 language tag. Lookups ignore
+// case and fall back from a specific tag to a more general one, so that a
+// client asking for en-GB or zh-Hans-CN gets the en or zh names.
+type Registry struct {
+	mu         sync.RWMutex
+	generators map[string]registered // by lowercase tag
+}
+
+type registered struct {
+	tag        string // as registered
+	generator  SyllableGenerator
+	definition []byte // the language file as JSON, if registered from one
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{generators: make(map[string]registered)}
+}
+
+// Builtin creates a registry of the languages embedded in this package
+func Builtin() *Registry {
+	r := NewRegistry()
+	for tag, lang := range EmbeddedLanguages() {
+		if err := r.RegisterLanguage(tag, lang); err != nil {
+			panic(err) // the embedded files are tested
+		}
+	}
+	return r
+}
+
+// Register adds the generator of a language, which must not have one yet
+func (r *Registry) Register(tag string, generator SyllableGenerator) error {
+	return r.register(registered{tag, generator, nil})
+}
+
+// RegisterLanguage adds the generator a language definition describes,
+// keeping the definition for Digest
+func (r *Registry) RegisterLanguage(tag string, lang *Language) error {
+	definition, err := json.Marshal(lang)
+	if err != nil {
+		return err
+	}
+	return r.register(registered{tag, lang.Generator(), definition})
+}
+
+func (r *Registry) register(found registered) error {
+	if found.tag == "" {
+		return fmt.Errorf("a language tag is required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := strings.ToLower(found.tag)
+	if existing, ok := r.generators[key]; ok {
+		return fmt.Errorf("language %s is already registered", existing.tag)
+	}
+	r.generators[key] = found
+	return nil
+}
+
+// Digest names the registered languages and their definitions, blocklists
+// included, so that names derived with other definitions can be told apart.
+// Generators registered without a definition count by their tag alone.
+func (r *Registry) Digest() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]string, 0, len(r.generators))
+	for key := range r.generators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key + "\x00"))
+		h.Write(r.generators[key].definition)
+		h.Write([]byte("\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Has reports whether a generator is registered for exactly this tag
+func (r *Registry) Has(tag string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.generators[strings.ToLower(tag)]
+	return ok
+}
+
+// Lookup returns the generator for a tag, or for the longest prefix of it
+// that has one (en-GB falls back to en), and the tag it is registered as
+func (r *Registry) Lookup(tag string) (SyllableGenerator, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key := strings.ToLower(tag)
+	for key != "" {
+		if found, ok := r.generators[key]; ok {
+			return found.generator, found.tag, true
+		}
+		cut := strings.LastIndex(key, "-")
+		if cut < 0 {
+			break
+		}
+		key = key[:cut]
+	}
+	return nil, "", false
+}
+
+// Tags returns the registered tags, sorted
+func (r *Registry) Tags() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tags := make([]string, 0, len(r.generators))
+	for _, found := range r.generators {
+		tags = append(tags, found.tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -1,8 +1,12 @@
 package syllables
 
 import (
+	"fmt"
 	"lilidap/internal/bitset"
 	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // SyllableGenerator defines rules for generating pronounceable syllables
@@ -13,16 +17,74 @@ type SyllableGenerator interface {
 	Generate(bits *bitset.BitSet) string
 	// GenerateFromInt generates a syllable from an integer
 	GenerateFromInt(i int) string
+	// Parse decodes a name back into the bits it was generated from
+	Parse(name string, size int) (*bitset.BitSet, error)
+	// ParseAll decodes a name into every bit pattern spelling it
+	ParseAll(name string, size int) []*bitset.BitSet
+	// Invertible reports whether Parse recovers the bits of every name
+	Invertible() bool
+	// Unfiltered returns the generator without its blocklist, as derivation
+	// schemes from before blocklists generate names
+	Unfiltered() SyllableGenerator
+	// GenerateNames creates a given name and a family name from the two
+	// halves of the bits
+	GenerateNames(bits *bitset.BitSet) (given, family string)
+	// FullName writes a given name and a family name the way the language does
+	FullName(given, family string) string
+	// Number writes the bits the names leave out, to follow the full name;
+	// empty where the names carry all the bits
+	Number(bits *bitset.BitSet) string
+	// ParseFullName decodes a full name back into the bits of its parts
+	ParseFullName(name string, size int) []*bitset.BitSet
 }
 
+// MaxRerolls bounds how many times a blocked name is generated again
+const MaxRerolls = 16
+
+// Numbers go between full-width brackets, as in 王明华（04821）
+const (
+	numberOpen  = "（"
+	numberClose = "）"
+)
+
+var (
+	_ SyllableGenerator = (*BaseGenerator)(nil)
+	_ SyllableGenerator = (*EnglishGenerator)(nil)
+)
+
 // BaseGenerator provides common functionality for syllable generation
 type BaseGenerator struct {
-	Onsets     []string // Initial consonant sounds
-	Nuclei     []string // Vowel sounds (required)
-	Codas      []string // Final consonant sounds (optional)
-	onsetBits  int      // cached bit counts
-	nucleiBits int      // cached bit counts
-	codaBits   int      // cached bit counts
+	Onsets []string // Initial consonant sounds
+	Nuclei []string // Vowel sounds (required)
+	Codas  []string // Final consonant sounds (optional)
+	// Compose writes out a syllable from the indices of its parts, -1
+	// marking a part left out, for scripts where the parts are not simply
+	// written one after the other. Nil concatenates them.
+	Compose func(onset, nucleus, coda int) string
+	// Forbidden lists sequences names must not contain, such as awkward
+	// clusters across syllables; a syllable that would make one is swapped
+	// for the next one that does not
+	Forbidden []string
+	// Blocklist lists words names must not contain, such as slurs in the
+	// language. A name spelling one is generated again from its bits mixed
+	// with a fixed pattern, so it stays the same for the same key.
+	Blocklist []string
+	// FamilyFirst puts the family name before the given name in full
+	// names, and NameSeparator goes between them
+	FamilyFirst   bool
+	NameSeparator string
+	// GivenSyllables caps how many syllables a given name has, where given
+	// names are short; the family name gets the rest. Zero splits the bits
+	// in the middle.
+	GivenSyllables int
+	// Surnames lists family names to pick from instead of spelling them.
+	// Given names then take GivenSyllables syllables, the surname the bits
+	// after them, and Number any bits left.
+	Surnames    []string
+	surnameBits int // cached bit counts
+	onsetBits   int // cached bit counts
+	nucleiBits  int // cached bit counts
+	codaBits    int // cached bit counts
 }
 
 // BitsFor calculates bits needed to represent n choices
@@ -58,40 +120,458 @@ func (g *BaseGenerator) BitsPerSyllable(fullSyllable bool) int {
 	return total
 }
 
-// Generate creates syllables from bits following phonetic rules
+// Generate creates syllables from bits following phonetic rules, re-rolling
+// names that spell a blocked word
 func (g *BaseGenerator) Generate(bits *bitset.BitSet) string {
-	var result string
+	return g.generate(g.rolled(bits))
+}
+
+// rolled returns the bits Generate spells: the bits themselves, or their
+// first re-roll spelling no blocked word
+func (g *BaseGenerator) rolled(bits *bitset.BitSet) *bitset.BitSet {
+	rolled := bits
+	for attempt := 1; attempt <= MaxRerolls && g.blocked(g.generate(rolled)); attempt++ {
+		rolled = reroll(bits, attempt)
+	}
+	return rolled
+}
+
+// splitPoint returns where the bits of a given name end and those of a
+// family name start: at the syllable boundary nearest the middle, so that
+// the two names together spell what Generate spells from all the bits
+func (g *BaseGenerator) splitPoint(size int) int {
+	syllable := g.BitsPerSyllable(true)
+	if syllable == 0 {
+		return size / 2
+	}
+	split := min(size, (size+syllable)/(2*syllable)*syllable)
+	if g.GivenSyllables > 0 {
+		split = min(split, g.GivenSyllables*syllable)
+	}
+	return split
+}
+
+// GenerateNames cuts the name Generate spells from the bits in two, at the
+// syllable boundary nearest their middle: a given name and a family name
+// that together always spell the common name, re-rolls and all. A language
+// with surnames writes its common name as the full name and its number.
+func (g *BaseGenerator) GenerateNames(bits *bitset.BitSet) (given, family string) {
+	if len(g.Surnames) > 0 {
+		given, family, _ = g.parts(g.rolled(bits))
+		return given, family
+	}
+	name, cut := g.spell(g.rolled(bits), g.splitPoint(bits.Size()))
+	return name[:cut], name[cut:]
+}
+
+// Number writes the bits past the surname, in a language with surnames, as
+// a number of fixed width in brackets; other languages spell every bit
+func (g *BaseGenerator) Number(bits *bitset.BitSet) string {
+	if len(g.Surnames) == 0 {
+		return ""
+	}
+	_, _, number := g.parts(g.rolled(bits))
+	return number
+}
+
+// parts splits bits into a given name, a surname and a number, in a
+// language with surnames. Bits too few to reach a part leave it empty.
+func (g *BaseGenerator) parts(bits *bitset.BitSet) (given, family, number string) {
+	size := bits.Size()
+	split := min(size, g.GivenSyllables*g.BitsPerSyllable(true))
+	given, _ = g.spell(bits.Slice(0, split), split)
+	if split == size {
+		return given, "", ""
+	}
+	end := min(size, split+g.surnameBits)
+	family = g.Surnames[bits.Slice(split, end).ToInt()]
+	if end < size {
+		number = fmt.Sprintf("%s%0*d%s", numberOpen, numberDigits(size-end), bits.Slice(end, size).ToInt(), numberClose)
+	}
+	return given, family, number
+}
+
+// numberDigits returns how many digits a number of so many bits takes
+func numberDigits(bits int) int {
+	return len(strconv.Itoa(1<<bits - 1))
+}
+
+// FullName writes a given name and a family name in the language's order
+func (g *BaseGenerator) FullName(given, family string) string {
+	if g.FamilyFirst {
+		return family + g.NameSeparator + given
+	}
+	return given + g.NameSeparator + family
+}
+
+// ParseFullName returns the bits of every way of reading a full name as
+// the names GenerateNames makes from size bits
+func (g *BaseGenerator) ParseFullName(name string, size int) []*bitset.BitSet {
+	if len(g.Surnames) > 0 {
+		return g.ParseAll(name, size) // the common name is the full name
+	}
+	parsed := map[string][]*bitset.BitSet{} // without a separator every cut spells the same name
+	var found []*bitset.BitSet
+	// The names meet at a separator or, without one, at any character
+	for cut := 1; cut < len(name); cut++ {
+		if !utf8.RuneStart(name[cut]) || !strings.HasPrefix(name[cut:], g.NameSeparator) {
+			continue
+		}
+		given, family := name[:cut], name[cut+len(g.NameSeparator):]
+		if g.FamilyFirst {
+			given, family = family, name[:cut]
+		}
+		whole := strings.ToLower(given + family)
+		if _, ok := parsed[whole]; !ok {
+			parsed[whole] = g.ParseAll(whole, size)
+		}
+		for _, bits := range parsed[whole] {
+			if parsedGiven, parsedFamily := g.GenerateNames(bits); strings.EqualFold(parsedGiven, given) && strings.EqualFold(parsedFamily, family) {
+				found = append(found, bits)
+			}
+		}
+	}
+	return found
+}
+
+// reroll mixes the bits of a name with the pattern of its nth re-roll. The
+// pattern does not depend on the key, so that Parse can undo it.
+func reroll(bits *bitset.BitSet, attempt int) *bitset.BitSet {
+	// splitmix64, seeded with the attempt
+	state := uint64(attempt) * 0x9E3779B97F4A7C15
+	pattern := make([]byte, 0, (bits.Size()+63)/64*8)
+	for len(pattern)*8 < bits.Size() {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		z ^= z >> 31
+		for i := 0; i < 8; i++ {
+			pattern = append(pattern, byte(z>>(8*i)))
+		}
+	}
+	return bits.Xor(bitset.FromBytes(pattern, bits.Size()))
+}
+
+// blocked reports whether a name contains a word of the blocklist
+func (g *BaseGenerator) blocked(name string) bool {
+	lower := strings.ToLower(name)
+	for _, word := range g.Blocklist {
+		if strings.Contains(lower, strings.ToLower(word)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unfiltered returns a copy of the generator without its blocklist
+func (g *BaseGenerator) Unfiltered() SyllableGenerator {
+	c := *g
+	c.Blocklist = nil
+	return &c
+}
+
+// generate spells out bits without regard to the blocklist. In a language
+// with surnames that is the full name, number and all.
+func (g *BaseGenerator) generate(bits *bitset.BitSet) string {
+	if len(g.Surnames) > 0 {
+		given, family, number := g.parts(bits)
+		if family == "" {
+			return given
+		}
+		return g.FullName(given, family) + number
+	}
+	name, _ := g.spell(bits, bits.Size())
+	return name
+}
+
+// spell spells out bits without regard to the blocklist, and returns where
+// in the name the syllables of the bits from split on start
+func (g *BaseGenerator) spell(bits *bitset.BitSet, split int) (result string, cut int) {
 	bitPos := 0
 	maxBits := bits.Size()
+	cut = -1
 
 	for bitPos < maxBits {
-		syllable := ""
+		if cut < 0 && bitPos >= split {
+			cut = len(result)
+		}
+		onsetIdx, codaIdx := -1, -1
 
 		if g.onsetBits > 0 {
-			onsetIdx := bits.Slice(bitPos, bitPos+g.onsetBits).ToInt()
-			syllable += g.Onsets[onsetIdx]
+			onsetIdx = bits.Slice(bitPos, bitPos+g.onsetBits).ToInt()
 			bitPos += g.onsetBits
-
 		}
 
 		// Always use nucleus
 		nucleusIdx := bits.Slice(bitPos, bitPos+g.nucleiBits).ToInt()
-		syllable += g.Nuclei[nucleusIdx]
 		bitPos += g.nucleiBits
 
 		// Optionally add coda if we have enough bits
 		if g.codaBits > 0 {
 			if bitPos < maxBits {
-				codaIdx := bits.Slice(bitPos, bitPos+g.codaBits).ToInt()
-				syllable += g.Codas[codaIdx]
+				codaIdx = bits.Slice(bitPos, bitPos+g.codaBits).ToInt()
 				bitPos += g.codaBits
 			}
 		}
 
-		result += syllable
+		result += g.allowed(result, onsetIdx, nucleusIdx, codaIdx)
 	}
+	if cut < 0 {
+		cut = len(result)
+	}
+
+	return result, cut
+}
 
-	return result
+// GenerateFromInt generates the full syllable the lowest
+// BitsPerSyllable(true) bits of i stand for; higher bits are ignored
+func (g *BaseGenerator) GenerateFromInt(i int) string {
+	return g.Generate(bitset.FromInt(i, g.BitsPerSyllable(true)))
+}
+
+// allowed writes out the syllable to follow prefix, or if that makes a
+// forbidden sequence the first that does not, trying other nuclei, then
+// codas, then onsets. Two keys may then share a name, like any collision.
+func (g *BaseGenerator) allowed(prefix string, onset, nucleus, coda int) string {
+	syllable := g.syllable(onset, nucleus, coda)
+	if g.permitted(prefix + syllable) {
+		return syllable
+	}
+	alternatives := func(idx int, choices []string) []int {
+		if idx < 0 {
+			return []int{idx}
+		}
+		order := make([]int, len(choices))
+		for i := range order {
+			order[i] = (idx + i) % len(choices)
+		}
+		return order
+	}
+	for _, o := range alternatives(onset, g.Onsets) {
+		for _, c := range alternatives(coda, g.Codas) {
+			for _, n := range alternatives(nucleus, g.Nuclei) {
+				if candidate := g.syllable(o, n, c); g.permitted(prefix + candidate) {
+					return candidate
+				}
+			}
+		}
+	}
+	return syllable
+}
+
+// permitted reports whether a name contains none of the forbidden sequences
+func (g *BaseGenerator) permitted(name string) bool {
+	for _, f := range g.Forbidden {
+		if strings.Contains(name, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse decodes a name back into the size bits Generate made it from,
+// ignoring letter case. Where a language spells two bit patterns alike it
+// returns the first; ParseAll returns them all. A name changed to avoid a
+// forbidden sequence decodes to the bits of the name as written, not those
+// it was generated from.
+func (g *BaseGenerator) Parse(name string, size int) (*bitset.BitSet, error) {
+	limit := 1
+	if len(g.Blocklist) > 0 {
+		limit = -1 // the first spelling might not be the one generated
+	}
+	parses := g.parses(name, size, limit)
+	if len(parses) == 0 {
+		return nil, fmt.Errorf("%q is not a name of %d bits", name, size)
+	}
+	return parses[0], nil
+}
+
+// ParseAll returns every bit pattern of size bits Generate spells as name
+func (g *BaseGenerator) ParseAll(name string, size int) []*bitset.BitSet {
+	return g.parses(name, size, -1)
+}
+
+// parses finds the bit patterns spelling name, then those re-rolled into
+// it: a pattern counts if Generate, blocklist and all, spells it as name
+func (g *BaseGenerator) parses(name string, size, limit int) []*bitset.BitSet {
+	spellings := g.parse(name, size, limit)
+	if len(g.Blocklist) == 0 {
+		return spellings
+	}
+	var found []*bitset.BitSet
+	for _, spelling := range spellings {
+		for attempt := 0; attempt <= MaxRerolls; attempt++ {
+			bits := spelling
+			if attempt > 0 {
+				bits = reroll(spelling, attempt)
+			}
+			if strings.EqualFold(g.Generate(bits), name) {
+				found = append(found, bits)
+			}
+		}
+	}
+	return found
+}
+
+// Invertible reports whether Parse recovers the bits of every generated
+// name, which it does unless the language forbids sequences
+func (g *BaseGenerator) Invertible() bool {
+	return len(g.Forbidden) == 0
+}
+
+// parse finds up to limit (-1 for all) bit patterns spelling name: the
+// syllables of a given name, surname and number that parts makes in a
+// language with surnames, and otherwise only syllables
+func (g *BaseGenerator) parse(name string, size, limit int) []*bitset.BitSet {
+	split := min(size, g.GivenSyllables*g.BitsPerSyllable(true))
+	if len(g.Surnames) == 0 || split == size {
+		return g.parseSyllables(name, size, limit)
+	}
+	end := min(size, split+g.surnameBits)
+	number := bitset.New(0)
+	if end < size {
+		open := strings.LastIndex(name, numberOpen)
+		if open < 0 || !strings.HasSuffix(name, numberClose) {
+			return nil
+		}
+		digits := name[open+len(numberOpen) : len(name)-len(numberClose)]
+		value, err := strconv.Atoi(digits)
+		if err != nil || len(digits) != numberDigits(size-end) || strings.Trim(digits, "0123456789") != "" || value >= 1<<(size-end) {
+			return nil
+		}
+		number = bitset.FromInt(value, size-end)
+		name = name[:open]
+	}
+
+	var parses []*bitset.BitSet
+	for i, surname := range g.Surnames[:1<<(end-split)] {
+		given := name
+		if g.FamilyFirst {
+			if !hasPrefixFold(given, surname+g.NameSeparator) {
+				continue
+			}
+			given = given[len(surname+g.NameSeparator):]
+		} else {
+			if !hasSuffixFold(given, g.NameSeparator+surname) {
+				continue
+			}
+			given = given[:len(given)-len(g.NameSeparator+surname)]
+		}
+		for _, bits := range g.parseSyllables(given, split, -1) {
+			parses = append(parses, bitset.Concat(bits, bitset.FromInt(i, end-split), number))
+			if limit >= 0 && len(parses) >= limit {
+				return parses
+			}
+		}
+	}
+	return parses
+}
+
+// parseSyllables finds up to limit (-1 for all) bit patterns spelling name, by
+// trying every syllable that fits where Generate would put one and
+// backtracking when the rest of the name cannot follow it. Multi-letter
+// parts make this necessary: "ai" might be a nucleus, or "a" then a coda.
+func (g *BaseGenerator) parseSyllables(name string, size, limit int) []*bitset.BitSet {
+	var parses []*bitset.BitSet
+	bits := bitset.New(size)
+
+	// choices returns how many values a part can take at bitPos, and the
+	// number of bits it covers, as Generate truncates the last parts
+	choices := func(bitPos, partBits, count int) (int, int) {
+		width := min(partBits, size-bitPos)
+		if width <= 0 {
+			return 1, 0
+		}
+		return min(count, 1<<width), width
+	}
+	put := func(bitPos, width, value int) {
+		for i := 0; i < width; i++ {
+			bits.Set(bitPos+i, value&(1<<i) != 0)
+		}
+	}
+
+	var walk func(rest string, bitPos int) bool
+	walk = func(rest string, bitPos int) bool {
+		if bitPos >= size {
+			if rest == "" {
+				parses = append(parses, bits.Slice(0, size))
+			}
+			return limit >= 0 && len(parses) >= limit
+		}
+
+		onsets, onsetWidth := 1, 0
+		if g.onsetBits > 0 {
+			onsets, onsetWidth = choices(bitPos, g.onsetBits, len(g.Onsets))
+		}
+		nucleusPos := bitPos + onsetWidth
+		nuclei, nucleusWidth := choices(nucleusPos, g.nucleiBits, len(g.Nuclei))
+		codaPos := nucleusPos + nucleusWidth
+		codas, codaWidth := 1, 0
+		hasCoda := g.codaBits > 0 && codaPos < size
+		if hasCoda {
+			codas, codaWidth = choices(codaPos, g.codaBits, len(g.Codas))
+		}
+
+		for o := 0; o < onsets; o++ {
+			onset := -1
+			if g.onsetBits > 0 {
+				onset = o
+				// Concatenated syllables can be ruled out by their onset alone
+				if g.Compose == nil && !hasPrefixFold(rest, g.Onsets[o]) {
+					continue
+				}
+			}
+			for n := 0; n < nuclei; n++ {
+				for c := 0; c < codas; c++ {
+					coda := -1
+					if hasCoda {
+						coda = c
+					}
+					syllable := g.syllable(onset, n, coda)
+					if !hasPrefixFold(rest, syllable) {
+						continue
+					}
+					put(bitPos, onsetWidth, o)
+					put(nucleusPos, nucleusWidth, n)
+					put(codaPos, codaWidth, c)
+					if walk(rest[len(syllable):], codaPos+codaWidth) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	walk(name, 0)
+	return parses
+}
+
+// hasPrefixFold reports whether s starts with prefix, ignoring case
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// hasSuffixFold reports whether s ends with suffix, ignoring case
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// syllable writes out a syllable from the indices of its parts, -1 marking
+// a part left out
+func (g *BaseGenerator) syllable(onset, nucleus, coda int) string {
+	if g.Compose != nil {
+		return g.Compose(onset, nucleus, coda)
+	}
+	syllable := ""
+	if onset >= 0 {
+		syllable += g.Onsets[onset]
+	}
+	syllable += g.Nuclei[nucleus]
+	if coda >= 0 {
+		syllable += g.Codas[coda]
+	}
+	return syllable
 }
 
 // EnglishGenerator implements English syllable rules
@@ -100,12 +580,5 @@ type EnglishGenerator struct {
 }
 
 func NewEnglishGenerator() *EnglishGenerator {
-	return &EnglishGenerator{
-		NewBaseGenerator(
-			[]string{"p", "t", "k", "b", "d", "g", "f", "v",
-				"s", "z", "m", "n", "l", "r", "w", "y"},
-			[]string{"a", "e", "i", "o", "u", "ai", "ei", "ou"},
-			[]string{"m", "n", "l", "r", "s", "f", "t", "k"},
-		),
-	}
+	return &EnglishGenerator{mustEmbedded("en")}
 }
@@ -2,10 +2,14 @@ package syllables
 
 import (
 	"lilidap/internal/bitset"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBaseGenerator(t *testing.T) {
@@ -112,3 +116,364 @@ func TestSampleGenerations(t *testing.T) {
 		assert.Equalf(expected, result, "For input 0x%X, expected %s, got %s", input, expected, result)
 	}
 }
+
+func TestCJKGenerators(t *testing.T) {
+	assert := assert.New(t)
+	bits := bitset.FromInt(0xDEADBEEF12, 40)
+
+	t.Run("Japanese is katakana", func(t *testing.T) {
+		name := NewJapaneseGenerator().Generate(bits)
+		for _, r := range name {
+			assert.True(r >= 0x30A0 && r <= 0x30FF, "%c in %s is not katakana", r, name)
+		}
+		assert.Equal(6, utf8.RuneCountInString(strings.ReplaceAll(name, "ン", "")), "40 bits make six morae")
+	})
+
+	t.Run("Korean is composed hangul", func(t *testing.T) {
+		gen := NewKoreanGenerator()
+		assert.Equal(10, gen.BitsPerSyllable(true))
+		name := gen.Generate(bits)
+		assert.Equal(4, utf8.RuneCountInString(name))
+		for _, r := range name {
+			assert.True(r >= 0xAC00 && r <= 0xD7A3, "%c in %s is not a hangul syllable", r, name)
+		}
+		assert.Equal("가가가가", gen.Generate(bitset.FromInt(0, 40)))
+		assert.Equal("쎗쎗쎗쎗", gen.Generate(bitset.FromInt(0xFFFFFFFFFF, 40)))
+	})
+
+	t.Run("Chinese is one hanzi per byte", func(t *testing.T) {
+		gen := NewChineseGenerator()
+		seen := map[string]bool{}
+		for _, hanzi := range gen.Nuclei {
+			assert.False(seen[hanzi], "%s is listed twice", hanzi)
+			seen[hanzi] = true
+		}
+		assert.Len(gen.Nuclei, 256)
+		assert.Len(gen.Surnames, 256)
+		// A surname and a given name of two characters carry 24 bits; the
+		// other 16 make a number of five digits
+		assert.Regexp(`^\p{Han}{3}（\d{5}）$`, gen.Generate(bits))
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		for _, gen := range []interface {
+			Generate(*bitset.BitSet) string
+		}{NewJapaneseGenerator(), NewKoreanGenerator(), NewChineseGenerator()} {
+			assert.Equal(gen.Generate(bits), gen.Generate(bitset.FromInt(0xDEADBEEF12, 40)))
+			assert.NotEqual(gen.Generate(bits), gen.Generate(bitset.FromInt(0xDEADBEEF13, 40)))
+		}
+	})
+}
+
+func TestLanguages(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Embedded languages", func(t *testing.T) {
+		langs := EmbeddedLanguages()
+		scripts := map[string]string{}
+		for tag, lang := range langs {
+			assert.Equal(tag, lang.Tag)
+			assert.NotEmpty(lang.Name)
+			scripts[tag] = lang.Script
+		}
+		assert.Equal(map[string]string{"en": "Latn", "ja": "Kana", "ko": "Hang", "zh": "Hans"}, scripts)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		lang, err := ParseLanguage([]byte(`{"tag": "sw", "name": "Swahili", "script": "Latn",
+			"onsets": ["b", "d", "k", "m"], "nuclei": ["a", "e", "i", "o"], "codas": []}`))
+		require.NoError(t, err)
+		gen := lang.Generator()
+		assert.Equal(4, gen.BitsPerSyllable(true))
+		assert.Equal("bababa", gen.Generate(bitset.FromInt(0, 12)))
+		assert.Equal("momomo", gen.Generate(bitset.FromInt(0xFFF, 12)))
+	})
+
+	t.Run("Invalid languages", func(t *testing.T) {
+		for _, def := range []string{
+			"nuclei: [a, e]\n",
+			"tag: x y\nnuclei: [a, e]\n",
+			"tag: xx\nnuclei: [a]\n",
+			"tag: xx\nnuclei: [a, e, i]\n",
+			"tag: xx\nnuclei: [a, a]\n",
+			"tag: xx\nnuclei: [a, e]\nforbidden: ['']\n",
+			"tag: xx\nnuclei: [a, e]\ncompose: runic\n",
+			"tag: xx\nonsets: [a, e]\nnuclei: [ㅏ, ㅓ]\ncompose: hangul\n",
+			"tag: xx\nnuclei: [a, e\n",
+			"tag: xx\nnuclei: [a, e]\nblocklsit: [puta]\n",
+			"tag: xx\nnuclei: [a, e]\nsurnames: [x, y]\n",
+			"tag: xx\nnuclei: [a, e]\ngivenSyllables: 1\nsurnames: [x, y, z]\n",
+			"tag: xx\nnuclei: [a, e]\ngivenSyllables: 1\nsurnames: [x, '7']\n",
+		} {
+			_, err := ParseLanguage([]byte(def))
+			assert.Error(err, def)
+		}
+	})
+
+	t.Run("Forbidden sequences", func(t *testing.T) {
+		lang := &Language{Tag: "xx", Nuclei: []string{"a", "b"}}
+		bits := bitset.FromInt(0xF, 4)
+		assert.Equal("bbbb", lang.Generator().Generate(bits))
+
+		lang.Forbidden = []string{"bb"}
+		assert.Equal("baba", lang.Generator().Generate(bits), "The next nucleus should stand in")
+		assert.Equal("aaaa", lang.Generator().Generate(bitset.FromInt(0, 4)), "Allowed names are unchanged")
+	})
+
+	t.Run("Load a directory", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sw.json"), []byte(`{"tag": "sw", "nuclei": ["a", "e"]}`), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "es.yml"), []byte("tag: es\nnuclei: [a, e]\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("# Languages\n"), 0644))
+		langs, err := LoadLanguageDir(dir)
+		require.NoError(t, err)
+		assert.Len(langs, 2)
+		assert.Contains(langs, "sw")
+		assert.Contains(langs, "es")
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sw2.yaml"), []byte("tag: sw\nnuclei: [a, e]\n"), 0644))
+		_, err = LoadLanguageDir(dir)
+		assert.Error(err, "A language should only be defined once")
+
+		_, err = LoadLanguageDir(filepath.Join(dir, "missing"))
+		assert.Error(err)
+	})
+}
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Round trip", func(t *testing.T) {
+		for tag, lang := range EmbeddedLanguages() {
+			gen := lang.Generator()
+			for _, size := range []int{40, 37, 12} {
+				for _, value := range []int{0, 1, 0x2A, 0xDEADBEEF12, 0xFFFFFFFFFF, 0x5555555555} {
+					bits := bitset.FromInt(value, 40).Slice(0, size)
+					name := gen.Generate(bits)
+					parsed, err := gen.Parse(name, size)
+					require.NoError(t, err, "%s name %s", tag, name)
+					assert.Equal(bits.ToStringBinary(), parsed.ToStringBinary(), "%s name %s", tag, name)
+				}
+			}
+		}
+	})
+
+	t.Run("Multi-letter nuclei", func(t *testing.T) {
+		gen := NewEnglishGenerator().Unfiltered() // re-rolls make some names share a spelling
+		// ai, ei and ou are nuclei of their own, but so are a, e and o:
+		// every syllable, and every pair of them, must decode
+		for value := 0; value < 1<<20; value += 61 {
+			bits := bitset.FromInt(value, 20)
+			parsed, err := gen.Parse(gen.Generate(bits), 20)
+			require.NoError(t, err)
+			require.True(t, bits.Equals(parsed), gen.Generate(bits))
+		}
+		bits, err := gen.Parse("lutbousnifkeit", 40)
+		require.NoError(t, err)
+		assert.Equal("lutbousnifkeit", gen.Generate(bits))
+		assert.Len(gen.ParseAll("lutbousnifkeit", 40), 1)
+	})
+
+	t.Run("Backtracking", func(t *testing.T) {
+		// "ab" then "c", or "a" then "bc": only one leaves a name of 2 syllables
+		lang := &Language{Tag: "xx", Nuclei: []string{"a", "ab", "bc", "c"}}
+		gen := lang.Generator()
+		assert.Equal("abc", gen.Generate(bitset.FromInt(0b1101, 4)))
+		all := gen.ParseAll("abc", 4)
+		assert.Len(all, 2, "a+bc and ab+c spell the same name")
+		for _, bits := range all {
+			assert.Equal("abc", gen.Generate(bits))
+		}
+		_, err := gen.Parse("abca", 4)
+		assert.Error(err)
+	})
+
+	t.Run("Surnames", func(t *testing.T) {
+		lang := &Language{Tag: "xx", Nuclei: []string{"a", "e"}, GivenSyllables: 2, Surnames: []string{"Ko", "Lu"}}
+		gen := lang.Generator()
+		bits := bitset.FromInt(0b1101, 4)
+		assert.Equal("ea Lu（1）", gen.Generate(bits))
+		given, family := gen.GenerateNames(bits)
+		assert.Equal([]string{"ea", "Lu"}, []string{given, family})
+		assert.Equal("（1）", gen.Number(bits))
+		parsed, err := gen.Parse("EA lu（1）", 4)
+		require.NoError(t, err)
+		assert.True(bits.Equals(parsed))
+		for _, name := range []string{"ea Lu", "ea Lu（2）", "ea Lu（01）", "ea Mo（1）", "eaLu（1）"} {
+			_, err := gen.Parse(name, 4)
+			assert.Error(err, name)
+		}
+	})
+
+	t.Run("Case and scripts", func(t *testing.T) {
+		bits := bitset.FromInt(0xDEADBEEF12, 40)
+		en := NewEnglishGenerator()
+		parsed, err := en.Parse(strings.ToUpper(en.Generate(bits)), 40)
+		require.NoError(t, err)
+		assert.True(bits.Equals(parsed))
+
+		ko := NewKoreanGenerator()
+		parsed, err = ko.Parse(ko.Generate(bits), 40)
+		require.NoError(t, err)
+		assert.True(bits.Equals(parsed), "Composed hangul should decode")
+
+		for _, bad := range []string{"", "lutbousnifkeitx", "lutbousnif", "l u t"} {
+			_, err := en.Parse(bad, 40)
+			assert.Error(err, bad)
+		}
+	})
+
+	t.Run("Invertible", func(t *testing.T) {
+		assert.True(NewEnglishGenerator().Invertible())
+		lang := &Language{Tag: "xx", Nuclei: []string{"a", "b"}, Forbidden: []string{"bb"}}
+		assert.False(lang.Generator().Invertible())
+	})
+}
+
+func TestGenerateFromInt(t *testing.T) {
+	assert := assert.New(t)
+	gen := NewEnglishGenerator().Unfiltered()
+	assert.Equal("pam", gen.GenerateFromInt(0))
+	assert.Equal(gen.Generate(bitset.FromInt(0x2A5, 10)), gen.GenerateFromInt(0x2A5))
+	assert.Equal(gen.GenerateFromInt(0x2A5), gen.GenerateFromInt(0x2A5|1<<10), "Bits past one syllable are ignored")
+
+	seen := map[string]bool{}
+	for i := 0; i < 1<<gen.BitsPerSyllable(true); i++ {
+		seen[gen.GenerateFromInt(i)] = true
+	}
+	assert.Len(seen, 1<<gen.BitsPerSyllable(true), "Every integer should make a different syllable")
+
+	assert.Equal("가", NewKoreanGenerator().GenerateFromInt(0))
+}
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+	r := Builtin()
+	assert.Equal([]string{"en", "ja", "ko", "zh"}, r.Tags())
+
+	for tag, want := range map[string]string{
+		"en": "en", "en-GB": "en", "EN-gb": "en", "zh-Hans-CN": "zh", "ko-KR": "ko",
+	} {
+		gen, found, ok := r.Lookup(tag)
+		if assert.True(ok, tag) {
+			assert.Equal(want, found, tag)
+			assert.NotNil(gen)
+		}
+	}
+	for _, tag := range []string{"fr", "", "-", "english"} {
+		_, _, ok := r.Lookup(tag)
+		assert.False(ok, tag)
+	}
+
+	// A regional variant can have its own generator
+	lang := &Language{Tag: "en-AU", Nuclei: []string{"a", "e"}}
+	require.NoError(t, r.Register("en-AU", lang.Generator()))
+	_, found, _ := r.Lookup("en-au")
+	assert.Equal("en-AU", found)
+	_, found, _ = r.Lookup("en-NZ")
+	assert.Equal("en", found)
+
+	assert.Error(r.Register("EN", NewEnglishGenerator()), "A language is registered once")
+	assert.Error(r.Register("", NewEnglishGenerator()))
+	assert.True(r.Has("en-au"))
+	assert.False(r.Has("en-NZ"))
+
+	// Editing a built-in language, its blocklist included, renames people:
+	// it takes a new scheme, not a change to this digest
+	assert.Equal("a65df5f4b53dd834", Builtin().Digest())
+	assert.NotEqual(Builtin().Digest(), r.Digest())
+	blocking := Builtin()
+	es := &Language{Tag: "es", Nuclei: []string{"a", "e"}}
+	require.NoError(t, blocking.RegisterLanguage("es", es))
+	digest := blocking.Digest()
+	blocking = Builtin()
+	es.Blocklist = []string{"ee"}
+	require.NoError(t, blocking.RegisterLanguage("es", es))
+	assert.NotEqual(digest, blocking.Digest(), "Blocklists count")
+}
+
+func TestBlocklist(t *testing.T) {
+	assert := assert.New(t)
+	filtered := NewEnglishGenerator()
+	unfiltered := filtered.Unfiltered()
+
+	// Find key bits spelling a blocked word
+	var blocked *bitset.BitSet
+	for value := 0; value < 1<<20 && blocked == nil; value++ {
+		bits := bitset.FromInt(value, 40)
+		if strings.Contains(unfiltered.Generate(bits), "fuk") {
+			blocked = bits
+		}
+	}
+	require.NotNil(t, blocked)
+
+	name := filtered.Generate(blocked)
+	assert.NotContains(name, "fuk")
+	assert.Equal(name, filtered.Generate(blocked), "Re-rolls should be deterministic")
+	assert.Equal(unfiltered.Generate(reroll(blocked, 1)), name, "The first re-roll should do")
+
+	// Re-rolled names decode to the bits that were re-rolled, among others
+	all := filtered.ParseAll(name, 40)
+	found := false
+	for _, bits := range all {
+		assert.Equal(name, filtered.Generate(bits))
+		found = found || bits.Equals(blocked)
+	}
+	assert.True(found, "%s should decode to the blocked bits", name)
+	_, err := filtered.Parse(unfiltered.Generate(blocked), 40)
+	assert.Error(err, "Nobody is called a blocked name")
+
+	// Names without blocked words are left alone
+	bits := bitset.FromInt(0xDEADBEEF12, 40)
+	assert.Equal(unfiltered.Generate(bits), filtered.Generate(bits))
+
+	// Blocked words are found across syllables and whatever the case
+	lang := &Language{Tag: "xx", Nuclei: []string{"a", "b"}, Blocklist: []string{"BBB"}}
+	gen := lang.Generator()
+	for value := 0; value < 1<<8; value++ {
+		assert.NotContains(gen.Generate(bitset.FromInt(value, 8)), "bbb")
+	}
+	_, err = ParseLanguage([]byte("tag: xx\nnuclei: [a, b]\nblocklist: ['']\n"))
+	assert.Error(err)
+}
+
+func TestFullNames(t *testing.T) {
+	assert := assert.New(t)
+	bits := bitset.FromInt(0xDEADBEEF12, 40)
+
+	for _, tc := range []struct {
+		gen       SyllableGenerator
+		separator string
+		split     int
+	}{
+		{NewEnglishGenerator(), " ", 20},
+		{NewJapaneseGenerator(), "・", 21},
+		{NewKoreanGenerator(), "", 20},
+		{NewChineseGenerator(), "", 16}, // given names of two characters
+	} {
+		given, family := tc.gen.GenerateNames(bits)
+		assert.Equal(tc.gen.Generate(bits.Slice(0, tc.split)), given)
+		full := tc.gen.FullName(given, family)
+		if number := tc.gen.Number(bits); number != "" {
+			full += number
+			assert.Equal(tc.gen.Generate(bits), full, "With a number the common name is the full name")
+		} else {
+			assert.Equal(tc.gen.Generate(bits), given+family, "The halves make the common name")
+		}
+		assert.Contains(full, tc.separator)
+		found := false
+		for _, parsed := range tc.gen.ParseFullName(full, 40) {
+			found = found || parsed.Equals(bits)
+		}
+		assert.True(found, "%s should decode to its bits", full)
+	}
+
+	en := NewEnglishGenerator()
+	given, family := en.GenerateNames(bits)
+	assert.Equal(given+" "+family, en.FullName(given, family), "Given name first")
+	ko := NewKoreanGenerator()
+	given, family = ko.GenerateNames(bits)
+	assert.Equal(family+given, ko.FullName(given, family), "Family name first")
+
+	assert.Empty(en.ParseFullName(en.Generate(bits), 40), "English full names need a space")
+}
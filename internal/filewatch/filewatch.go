@@ -0,0 +1,68 @@
+package filewatch
+
+import (
+	"os"
+	"time"
+)
+
+/*
+ * This package polls files for changes so that lists loaded from disk
+ * (revocations, allowlists, ...) can be reloaded without a restart.
+ *
+ * Polling is used instead of inotify & friends so that it behaves the
+ * same on every platform, including the odd little boxes that end up
+ * running on a field network.
+ */
+
+// fileState is what we compare between polls to detect a change
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// Watch polls the given paths every interval and calls onChange whenever
+// any of them is created, removed, resized or touched.
+// It returns a function that stops the watcher.
+func Watch(paths []string, interval time.Duration, onChange func()) func() {
+	states := make([]fileState, len(paths))
+	for i, path := range paths {
+		states[i] = statFile(path)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				changed := false
+				for i, path := range paths {
+					state := statFile(path)
+					if state != states[i] {
+						states[i] = state
+						changed = true
+					}
+				}
+				if changed {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,53 @@
+package filewatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "watched")
+	changes := make(chan struct{}, 10)
+	stop := Watch([]string{path}, 10*time.Millisecond, func() {
+		changes <- struct{}{}
+	})
+	defer stop()
+
+	waitForChange := func() bool {
+		select {
+		case <-changes:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	t.Run("Creation is a change", func(t *testing.T) {
+		assert.NoError(os.WriteFile(path, []byte("one"), 0644))
+		assert.True(waitForChange(), "Expected a change when the file is created")
+	})
+
+	t.Run("Resize is a change", func(t *testing.T) {
+		assert.NoError(os.WriteFile(path, []byte("one two"), 0644))
+		assert.True(waitForChange(), "Expected a change when the file is rewritten")
+	})
+
+	t.Run("Removal is a change", func(t *testing.T) {
+		assert.NoError(os.Remove(path))
+		assert.True(waitForChange(), "Expected a change when the file is removed")
+	})
+
+	t.Run("No change, no callback", func(t *testing.T) {
+		select {
+		case <-changes:
+			assert.Fail("Unexpected change notification")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
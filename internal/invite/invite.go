@@ -0,0 +1,127 @@
+package invite
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ * This package implements signed invitation tokens, which let admins admit
+ * new keys to a closed community without editing files on the server.
+ *
+ * Admins mint tokens offline with their own SSH key, for one network: an
+ * admin listed on several servers must not have an invitation to one
+ * redeemed on all of them. A token is
+ *
+ *	base64url(json payload) "." base64url(ssh wire signature)
+ *
+ * where the signature covers signaturePrefix + payload, so that an invitation
+ * signature can never be mistaken for any other kind of SSH signature.
+ */
+
+const signaturePrefix = "lilidap-invite-v2\n"
+
+// Token is the signed content of an invitation
+type Token struct {
+	ID      string    `json:"id"`             // random identifier, used to count redemptions
+	Issuer  string    `json:"issuer"`         // admin public key in authorized_keys format
+	Network string    `json:"network"`        // name of the only network the token admits to
+	MaxUses int       `json:"max_uses"`       // 0 means unlimited
+	Expires time.Time `json:"expires"`        // the token cannot be redeemed from this time on
+	Note    string    `json:"note,omitempty"` // free text for the admin's records
+}
+
+// IssuerKey parses the key of the admin that issued the token
+func (t *Token) IssuerKey() (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(t.Issuer))
+	return key, err
+}
+
+// Mint creates a signed invitation token to the named network
+func Mint(signer ssh.Signer, network string, maxUses int, expires time.Time, note string) (string, *Token, error) {
+	if network == "" {
+		return "", nil, fmt.Errorf("the network the invitation is for must be named")
+	}
+	if maxUses < 0 {
+		return "", nil, fmt.Errorf("max uses must not be negative")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+
+	token := &Token{
+		ID:      hex.EncodeToString(id),
+		Issuer:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Network: network,
+		MaxUses: maxUses,
+		Expires: expires.UTC().Truncate(time.Second),
+		Note:    note,
+	}
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode token: %w", err)
+	}
+
+	signature, err := signer.Sign(rand.Reader, append([]byte(signaturePrefix), payload...))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(ssh.Marshal(signature))
+	return encoded, token, nil
+}
+
+// Verify decodes a token and checks that it was signed by an admin for the named
+// network and has not expired. It does not check the number of remaining uses,
+// which is up to the Store.
+func Verify(encoded, network string, isAdmin func(ssh.PublicKey) bool, now time.Time) (*Token, error) {
+	payloadPart, signaturePart, ok := strings.Cut(strings.TrimSpace(encoded), ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed invitation token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return nil, fmt.Errorf("malformed invitation payload: %w", err)
+	}
+	signatureBytes, err := base64.RawURLEncoding.DecodeString(signaturePart)
+	if err != nil {
+		return nil, fmt.Errorf("malformed invitation signature: %w", err)
+	}
+
+	var token Token
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, fmt.Errorf("malformed invitation payload: %w", err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(signatureBytes, &signature); err != nil {
+		return nil, fmt.Errorf("malformed invitation signature: %w", err)
+	}
+
+	issuer, err := token.IssuerKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid invitation issuer: %w", err)
+	}
+	if !isAdmin(issuer) {
+		return nil, fmt.Errorf("invitation issued by %s, who is not an admin", ssh.FingerprintSHA256(issuer))
+	}
+	if err := issuer.Verify(append([]byte(signaturePrefix), payload...), &signature); err != nil {
+		return nil, fmt.Errorf("invalid invitation signature: %w", err)
+	}
+	if token.Network != network {
+		return nil, fmt.Errorf("invitation is for network %q, not %q", token.Network, network)
+	}
+	if !now.Before(token.Expires) {
+		return nil, fmt.Errorf("invitation expired on %s", token.Expires.Format(time.RFC3339))
+	}
+	return &token, nil
+}
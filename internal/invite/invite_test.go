@@ -0,0 +1,143 @@
+package invite
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+// adminCheck accepts exactly the given admin keys
+func adminCheck(admins ...ssh.Signer) func(ssh.PublicKey) bool {
+	return func(key ssh.PublicKey) bool {
+		for _, admin := range admins {
+			if string(admin.PublicKey().Marshal()) == string(key.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestToken(t *testing.T) {
+	assert := assert.New(t)
+
+	admin := newSigner(t)
+	now := time.Now()
+	encoded, minted, err := Mint(admin, "camp", 1, now.Add(time.Hour), "for the medics tent")
+	require.NoError(t, err)
+
+	t.Run("Valid token verifies", func(t *testing.T) {
+		token, err := Verify(encoded, "camp", adminCheck(admin), now)
+		assert.NoError(err)
+		assert.Equal(minted, token)
+		assert.Equal("for the medics tent", token.Note)
+	})
+
+	t.Run("Expired token is refused", func(t *testing.T) {
+		_, err := Verify(encoded, "camp", adminCheck(admin), now.Add(2*time.Hour))
+		assert.ErrorContains(err, "expired")
+	})
+
+	t.Run("Token for another network is refused", func(t *testing.T) {
+		_, err := Verify(encoded, "festival", adminCheck(admin), now)
+		assert.ErrorContains(err, "network")
+	})
+
+	t.Run("Network must be named", func(t *testing.T) {
+		_, _, err := Mint(admin, "", 1, now.Add(time.Hour), "")
+		assert.Error(err)
+	})
+
+	t.Run("Token from a non-admin is refused", func(t *testing.T) {
+		_, err := Verify(encoded, "camp", adminCheck(newSigner(t)), now)
+		assert.ErrorContains(err, "not an admin")
+	})
+
+	t.Run("Tampered token is refused", func(t *testing.T) {
+		payload, signature, _ := strings.Cut(encoded, ".")
+		forged, _, err := Mint(admin, "camp", 0, now.Add(24*time.Hour), "")
+		require.NoError(t, err)
+		forgedPayload, _, _ := strings.Cut(forged, ".")
+		assert.NotEqual(payload, forgedPayload)
+
+		_, err = Verify(forgedPayload+"."+signature, "camp", adminCheck(admin), now)
+		assert.ErrorContains(err, "invalid invitation signature")
+	})
+
+	t.Run("Garbage is refused", func(t *testing.T) {
+		for _, garbage := range []string{"", "nodot", "!!.!!", "e30.e30"} {
+			_, err := Verify(garbage, "camp", adminCheck(admin), now)
+			assert.Errorf(err, "Expected error for %q", garbage)
+		}
+	})
+}
+
+func testStore(t *testing.T, store Store) {
+	assert := assert.New(t)
+
+	admin := newSigner(t)
+	alice := newSigner(t).PublicKey()
+	bob := newSigner(t).PublicKey()
+	carol := newSigner(t).PublicKey()
+	now := time.Now()
+
+	_, single, err := Mint(admin, "camp", 1, now.Add(time.Hour), "")
+	require.NoError(t, err)
+	_, multi, err := Mint(admin, "camp", 0, now.Add(time.Hour), "")
+	require.NoError(t, err)
+
+	assert.False(store.IsAdmitted(alice))
+	assert.NoError(store.Redeem(single, alice, now))
+	assert.True(store.IsAdmitted(alice))
+
+	assert.NoError(store.Redeem(single, alice, now), "Redeeming again with the same key is fine")
+	assert.Error(store.Redeem(single, bob, now), "Single-use token is used up")
+	assert.False(store.IsAdmitted(bob))
+
+	assert.NoError(store.Redeem(multi, bob, now))
+	assert.NoError(store.Redeem(multi, carol, now))
+	assert.True(store.IsAdmitted(bob))
+	assert.True(store.IsAdmitted(carol))
+
+	redemptions := store.Redemptions()
+	if assert.Len(redemptions, 3) {
+		assert.Equal(single.ID, redemptions[0].TokenID)
+		assert.Equal(ssh.FingerprintSHA256(admin.PublicKey()), redemptions[0].Issuer)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redemptions.json")
+	store, err := OpenFileStore(path)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	t.Run("Redemptions survive a restart", func(t *testing.T) {
+		reopened, err := OpenFileStore(path)
+		require.NoError(t, err)
+		assert.Equal(t, store.Redemptions(), reopened.Redemptions())
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(store.Redemptions()[0].Key))
+		require.NoError(t, err)
+		assert.True(t, reopened.IsAdmitted(key))
+	})
+}
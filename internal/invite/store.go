@@ -0,0 +1,194 @@
+package invite
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Redemption records a key admitted by an invitation
+type Redemption struct {
+	TokenID    string    `json:"token_id"`
+	Issuer     string    `json:"issuer"` // SHA256 fingerprint of the admin key
+	Key        string    `json:"key"`    // admitted key in authorized_keys format
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// Store keeps track of redeemed invitations
+type Store interface {
+	// Redeem admits the key with the token, failing if the token has no uses left.
+	// Redeeming the same token again with the same key is a no-op.
+	Redeem(token *Token, key ssh.PublicKey, at time.Time) error
+	// IsAdmitted reports whether the key was admitted by an invitation
+	IsAdmitted(key ssh.PublicKey) bool
+	// Redemptions lists all redemptions in the order they happened
+	Redemptions() []Redemption
+}
+
+func normalizeKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// MemoryStore is a Store that forgets everything on restart
+type MemoryStore struct {
+	mu          sync.RWMutex
+	redemptions []Redemption
+	admitted    map[string]bool            // normalized key → admitted
+	uses        map[string]int             // token ID → number of keys admitted
+	redeemed    map[string]map[string]bool // token ID → normalized key → redeemed
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		admitted: make(map[string]bool),
+		uses:     make(map[string]int),
+		redeemed: make(map[string]map[string]bool),
+	}
+}
+
+// check returns the redemption to record, nil if the key already redeemed
+// this token, or an error if the token is used up. The caller holds the lock.
+func (s *MemoryStore) check(token *Token, key ssh.PublicKey, at time.Time) (*Redemption, error) {
+	normalized := normalizeKey(key)
+	if s.redeemed[token.ID][normalized] {
+		return nil, nil
+	}
+	if token.MaxUses > 0 && s.uses[token.ID] >= token.MaxUses {
+		return nil, fmt.Errorf("invitation has already been used %d times", s.uses[token.ID])
+	}
+
+	issuer := token.Issuer
+	if issuerKey, err := token.IssuerKey(); err == nil {
+		issuer = ssh.FingerprintSHA256(issuerKey)
+	}
+	return &Redemption{
+		TokenID:    token.ID,
+		Issuer:     issuer,
+		Key:        normalized,
+		RedeemedAt: at.UTC(),
+	}, nil
+}
+
+// add records a redemption. The caller holds the lock.
+func (s *MemoryStore) add(r Redemption) {
+	s.redemptions = append(s.redemptions, r)
+	s.admitted[r.Key] = true
+	s.uses[r.TokenID]++
+	if s.redeemed[r.TokenID] == nil {
+		s.redeemed[r.TokenID] = make(map[string]bool)
+	}
+	s.redeemed[r.TokenID][r.Key] = true
+}
+
+// Redeem implements Store
+func (s *MemoryStore) Redeem(token *Token, key ssh.PublicKey, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.check(token, key, at)
+	if err != nil || r == nil {
+		return err
+	}
+	s.add(*r)
+	return nil
+}
+
+// IsAdmitted implements Store
+func (s *MemoryStore) IsAdmitted(key ssh.PublicKey) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.admitted[normalizeKey(key)]
+}
+
+// Redemptions implements Store
+func (s *MemoryStore) Redemptions() []Redemption {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Redemption{}, s.redemptions...)
+}
+
+// FileStore is a Store persisted as a JSON file, rewritten on every redemption
+type FileStore struct {
+	path string
+	mem  *MemoryStore
+}
+
+// OpenFileStore loads the store at path, which is created on first redemption
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, mem: NewMemoryStore()}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invitation store: %w", err)
+	}
+
+	var redemptions []Redemption
+	if err := json.Unmarshal(data, &redemptions); err != nil {
+		return nil, fmt.Errorf("failed to parse invitation store %s: %w", path, err)
+	}
+	for _, r := range redemptions {
+		s.mem.add(r)
+	}
+	return s, nil
+}
+
+// Redeem implements Store; the redemption is only kept if it could be saved
+func (s *FileStore) Redeem(token *Token, key ssh.PublicKey, at time.Time) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	r, err := s.mem.check(token, key, at)
+	if err != nil || r == nil {
+		return err
+	}
+
+	if err := s.save(append(append([]Redemption{}, s.mem.redemptions...), *r)); err != nil {
+		return err
+	}
+	s.mem.add(*r)
+	return nil
+}
+
+// IsAdmitted implements Store
+func (s *FileStore) IsAdmitted(key ssh.PublicKey) bool {
+	return s.mem.IsAdmitted(key)
+}
+
+// Redemptions implements Store
+func (s *FileStore) Redemptions() []Redemption {
+	return s.mem.Redemptions()
+}
+
+// save atomically replaces the file with the given redemptions
+func (s *FileStore) save(redemptions []Redemption) error {
+	data, err := json.MarshalIndent(redemptions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode invitation store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write invitation store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write invitation store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write invitation store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write invitation store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package ldapserver
+
+import (
+	"fmt"
+	"lilidap/internal/bitset"
+	"lilidap/internal/derived"
+	"lilidap/internal/registry"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Derived identities come from only derived.KEY_HASH_BIT_LENGTH bits of the
+// key hash, so two keys can end up with the same uidNumber, telephoneNumber
+// and displayName, by birthday luck or because someone ground a key to match
+// a victim's. Every key seen for the first time is checked against the
+// registry, and collisions are resolved according to a CollisionPolicy.
+
+// CollisionPolicy decides what happens to a newcomer whose derived identity
+// collides with that of a key already in the registry
+type CollisionPolicy int
+
+const (
+	// SuffixCollisions gives the newcomer a disambiguating suffix, recorded in the registry
+	SuffixCollisions CollisionPolicy = iota
+	// RejectCollisions refuses the newcomer's bind
+	RejectCollisions
+)
+
+// ParseCollisionPolicy reads a policy name as used on the command line
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch name {
+	case "suffix":
+		return SuffixCollisions, nil
+	case "reject":
+		return RejectCollisions, nil
+	}
+	return 0, fmt.Errorf("unknown collision policy %q (want suffix or reject)", name)
+}
+
+func (p CollisionPolicy) String() string {
+	if p == RejectCollisions {
+		return "reject"
+	}
+	return "suffix"
+}
+
+// Collision describes a derived attribute value shared by two verified keys
+type Collision struct {
+	Attribute  string    `json:"attribute"`        // uidNumber, gidNumber, telephoneNumber, displayName or displayName;lang-XX
+	Value      string    `json:"value"`            // the value both keys derive
+	Scheme     string    `json:"scheme,omitempty"` // version of the scheme deriving a name, first one if several
+	Existing   string    `json:"existing"`         // fingerprint of the key that had the value first
+	Newcomer   string    `json:"newcomer"`         // fingerprint of the key that now derives it
+	Resolution string    `json:"resolution"`       // "rejected" or "suffix N"
+	At         time.Time `json:"at"`
+}
+
+// identity is the part of a derived identity that must be unique
+type identity struct {
+	uidNumber   int
+	gidNumber   int
+	phoneNumber string
+	// names holds the display names in every served scheme and language,
+	// which may differ in more than spelling when a scheme or language
+	// re-rolls or swaps syllables
+	names []name
+}
+
+// name is a display name as published in one scheme
+type name struct {
+	scheme    *derived.Scheme
+	attribute string // displayName for English, displayName;lang-XX for the others
+	value     string
+}
+
+// identityOf derives the identity of a key in every served scheme, with the
+// suffixes given; the numbers are the same in every scheme
+func (s *LDAPServer) identityOf(pubKey ssh.PublicKey, suffixes derived.Suffixes) identity {
+	attrs := s.derive(pubKey, s.primaryScheme()).WithSuffixes(suffixes)
+	id := identity{uidNumber: attrs.PosixUserID(), gidNumber: attrs.PosixGroupID(), phoneNumber: attrs.PhoneNumber()}
+	for _, scheme := range s.schemes {
+		attrs := s.derive(pubKey, scheme).WithSuffixes(suffixes)
+		for _, lang := range attrs.SupportedLanguages() {
+			attribute := "displayName"
+			if lang != "en" {
+				attribute += ";lang-" + lang
+			}
+			id.names = append(id.names, name{scheme, attribute, attrs.DisplayName(lang)})
+		}
+	}
+	return id
+}
+
+// identityOfRecord returns the identity stored in a record, deriving it
+// afresh for records written before identities were stored or with other
+// derivation settings. Records that do not say what they were derived with
+// cannot be trusted to match the current settings. Only the English name of
+// the primary scheme is stored, so the others are always derived, with the
+// record's suffixes.
+func (s *LDAPServer) identityOfRecord(record *registry.Record) (identity, bool) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record.Key))
+	if err != nil {
+		return identity{}, false
+	}
+	id := s.identityOf(pubKey, suffixesOf(record))
+	if record.DisplayName != "" && record.Derivation == s.derivation() {
+		id.uidNumber, id.gidNumber, id.phoneNumber = record.UidNumber, record.GidNumber, record.PhoneNumber
+		for i, n := range id.names {
+			if n.scheme == s.primaryScheme() && n.attribute == "displayName" {
+				id.names[i].value = record.DisplayName
+			}
+		}
+	}
+	return id, true
+}
+
+// identityValues lists the values of an identity that must be unique
+func (s *LDAPServer) identityValues(id identity) []identityValue {
+	values := []identityValue{{"uidNumber", strconv.Itoa(id.uidNumber), nil}}
+	// gidNumbers are shared by everyone unless mapped into a range
+	if s.gidRange != nil {
+		values = append(values, identityValue{"gidNumber", strconv.Itoa(id.gidNumber), nil})
+	}
+	values = append(values, identityValue{"telephoneNumber", id.phoneNumber, nil})
+	for _, n := range id.names {
+		values = append(values, identityValue{n.attribute, n.value, n.scheme})
+	}
+	return values
+}
+
+// identityValue is a derived value that must be unique: numbers across the
+// directory, names within their scheme
+type identityValue struct {
+	attribute string
+	value     string
+	scheme    *derived.Scheme // nil for numbers, the same in every scheme
+}
+
+// key is where the identity index keeps the holders of the value. Names
+// differing in case only collide, since LDAP matches them regardless.
+func (v identityValue) key() string {
+	if v.scheme == nil {
+		return v.attribute + "\x00" + v.value
+	}
+	return v.scheme.Version + "\x00" + v.attribute + "\x00" + strings.ToLower(v.value)
+}
+
+// identityIndex finds the keys holding a derived value, so that checking a
+// newcomer does not derive the identity of every known key. It is only used
+// with admitMu held.
+type identityIndex struct {
+	fingerprints map[string]string          // fingerprints of the indexed normalized keys
+	values       map[string][]string        // index keys of the values of each normalized key
+	holders      map[string]map[string]bool // normalized keys holding each value, by index key
+}
+
+func newIdentityIndex() *identityIndex {
+	return &identityIndex{fingerprints: map[string]string{}, values: map[string][]string{}, holders: map[string]map[string]bool{}}
+}
+
+// set indexes the values of a key's identity, in place of any it had
+func (idx *identityIndex) set(normalizedKey, fingerprint string, values []identityValue) {
+	for _, key := range idx.values[normalizedKey] {
+		delete(idx.holders[key], normalizedKey)
+	}
+	idx.fingerprints[normalizedKey] = fingerprint
+	idx.values[normalizedKey] = idx.values[normalizedKey][:0]
+	for _, value := range values {
+		key := value.key()
+		if idx.holders[key] == nil {
+			idx.holders[key] = map[string]bool{}
+		}
+		idx.holders[key][normalizedKey] = true
+		idx.values[normalizedKey] = append(idx.values[normalizedKey], key)
+	}
+}
+
+// indexIdentities indexes the identities of the records added since it last
+// ran. Identities the server stores are indexed as they are stored.
+func (s *LDAPServer) indexIdentities() {
+	for _, record := range s.registry.List() {
+		if _, indexed := s.identities.fingerprints[record.Key]; indexed {
+			continue
+		}
+		if id, ok := s.identityOfRecord(record); ok {
+			s.identities.set(record.Key, record.Fingerprint, s.identityValues(id))
+		}
+	}
+}
+
+// suffixesOf returns the suffixes a record gives the attributes of its key.
+// Records from before each attribute had its own give them all the same.
+func suffixesOf(record *registry.Record) derived.Suffixes {
+	if record.Suffixes != nil {
+		return *record.Suffixes
+	}
+	n := record.Suffix
+	return derived.Suffixes{UIDNumber: n, GIDNumber: n, TelephoneNumber: n, DisplayName: n}
+}
+
+// keyBitsOf returns the key bits stored in a record, deriving them afresh
+// for records without them or with other derivation settings
+func (s *LDAPServer) keyBitsOf(record *registry.Record, pubKey ssh.PublicKey) *bitset.BitSet {
+	if record.KeyBits != nil && record.Derivation == s.derivation() {
+		return record.KeyBits
+	}
+	return s.derive(pubKey, s.primaryScheme()).KeyBits()
+}
+
+// derivation sums up the settings identities are derived with, so that
+// stored identities can be told apart from stale ones
+func (s *LDAPServer) derivation() string {
+	uids, gids := "legacy", "shared"
+	if s.uidRange != nil {
+		uids = s.uidRange.String()
+	}
+	if s.gidRange != nil {
+		gids = s.gidRange.String()
+	}
+	derivation := fmt.Sprintf("scheme %s; uid %s; gid %s; phone %s; languages %s",
+		s.primaryScheme(), uids, gids, s.phoneFormat, s.languages.Digest())
+	if len(s.salt) > 0 {
+		derivation += "; salt " + derived.SaltDigest(s.salt)
+	}
+	return derivation
+}
+
+// primaryScheme is the scheme whose identities must be unique. Other served
+// schemes reuse the suffixes it hands out.
+func (s *LDAPServer) primaryScheme() *derived.Scheme {
+	return s.schemes[0]
+}
+
+// derive derives the attributes of a key with a scheme and the server's settings
+func (s *LDAPServer) derive(pubKey ssh.PublicKey, scheme *derived.Scheme) *derived.UserAttributes {
+	return scheme.Derive(pubKey).WithSalt(s.salt).WithIDRanges(s.uidRange, s.gidRange).WithPhoneFormat(s.phoneFormat).WithLanguages(s.languages)
+}
+
+// attributesFor derives the attributes of a key with a scheme, including any
+// suffixes it was given when it collided with other keys
+func (s *LDAPServer) attributesFor(pubKey ssh.PublicKey, scheme *derived.Scheme) *derived.UserAttributes {
+	attrs := s.derive(pubKey, scheme)
+	if record, ok := s.registry.Get(pubKey); ok {
+		attrs = attrs.WithSuffixes(suffixesOf(record))
+	}
+	return attrs
+}
+
+// findCollisions lists the indexed keys other than pubKey sharing part of the
+// candidate identity. Names collide within a scheme, since each scheme is a
+// directory of its own.
+func (s *LDAPServer) findCollisions(pubKey ssh.PublicKey, attrs *derived.UserAttributes) []Collision {
+	normalizedKey := registry.NormalizeKey(pubKey)
+	newcomer := ssh.FingerprintSHA256(pubKey)
+
+	var collisions []Collision
+	// Schemes that name alike would report the same collision each
+	reported := map[string]bool{}
+	for _, value := range s.identityValues(s.identityOf(pubKey, attrs.Suffixes())) {
+		for holder := range s.identities.holders[value.key()] {
+			same := holder + "\x00" + value.attribute + "\x00" + strings.ToLower(value.value)
+			if holder == normalizedKey || reported[same] {
+				continue
+			}
+			reported[same] = true
+			collision := Collision{Attribute: value.attribute, Value: value.value, Existing: s.identities.fingerprints[holder], Newcomer: newcomer}
+			if value.scheme != nil {
+				collision.Scheme = value.scheme.Version
+			}
+			collisions = append(collisions, collision)
+		}
+	}
+	return collisions
+}
+
+// reportCollisions logs the collisions and passes them on to the admins' reporter
+func (s *LDAPServer) reportCollisions(collisions []Collision, resolution string, at time.Time) {
+	for _, collision := range collisions {
+		collision.Resolution = resolution
+		collision.At = at
+		log.Printf("⚠️  COLLISION: %s=%s derived by %s and %s; %s",
+			collision.Attribute, collision.Value, collision.Existing, collision.Newcomer, resolution)
+		if s.onCollision != nil {
+			s.onCollision(collision)
+		}
+	}
+}
+
+// disambiguate gives each colliding attribute the lowest suffix setting it
+// apart from every known key, leaving the other attributes alone, and
+// reports the collisions with how they were resolved
+func (s *LDAPServer) disambiguate(pubKey ssh.PublicKey, attrs *derived.UserAttributes, collisions []Collision, now time.Time) (*derived.UserAttributes, error) {
+	// Each known key rules out at most one suffix of an attribute per
+	// scheme and language, so running past that means the ID ranges are full
+	limit := len(s.identities.fingerprints)*len(s.schemes)*len(attrs.SupportedLanguages()) + 2
+	for _, attribute := range derived.DerivedAttributes {
+		on := collisionsOn(collisions, attribute)
+		if len(on) == 0 {
+			continue
+		}
+		suffix := 2
+		for len(collisionsOn(s.findCollisions(pubKey, attrs.Disambiguate(attribute, suffix)), attribute)) > 0 {
+			suffix++
+			if suffix > limit {
+				s.reportCollisions(on, "rejected, no free values", now)
+				return nil, fmt.Errorf("no free %s left", attribute)
+			}
+		}
+		attrs = attrs.Disambiguate(attribute, suffix)
+		s.reportCollisions(on, fmt.Sprintf("suffix %d", suffix), now)
+	}
+	return attrs, nil
+}
+
+// collisionsOn returns the collisions of one attribute, in any language
+func collisionsOn(collisions []Collision, attribute string) []Collision {
+	var on []Collision
+	for _, collision := range collisions {
+		if collision.Attribute == attribute || strings.HasPrefix(collision.Attribute, attribute+";") {
+			on = append(on, collision)
+		}
+	}
+	return on
+}
+
+// storeIdentity records the identity given to a key, and indexes it, logging
+// any failure
+func (s *LDAPServer) storeIdentity(pubKey ssh.PublicKey, attrs *derived.UserAttributes, now time.Time) bool {
+	record, err := s.registry.Update(pubKey, func(record *registry.Record) error {
+		record.DisplayName = attrs.DisplayName("en")
+		record.PhoneNumber = attrs.PhoneNumber()
+		record.UidNumber = attrs.PosixUserID()
+		record.GidNumber = attrs.PosixGroupID()
+		suffixes := attrs.Suffixes()
+		record.Suffixes = &suffixes
+		record.Suffix = 0
+		record.Scheme = attrs.Scheme().Version
+		record.Derivation = s.derivation()
+		record.KeyBits = attrs.KeyBits()
+		return nil
+	}, now)
+	if err != nil {
+		log.Printf("⚠️  Failed to record %s in registry: %v", ssh.FingerprintSHA256(pubKey), err)
+		return false
+	}
+	if id, ok := s.identityOfRecord(record); ok {
+		s.identities.set(record.Key, record.Fingerprint, s.identityValues(id))
+	}
+	return true
+}
+
+// admit records a verified key in the registry. A key seen for the first time
+// has its derived identity checked against every known key, and an error is
+// returned if it collides and the policy is to reject it.
+func (s *LDAPServer) admit(pubKey ssh.PublicKey, hostPort string, now time.Time) error {
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+
+	// A key admitted before the derivation settings changed has its identity
+	// derived and checked afresh too, but having been let in once it is only
+	// ever given suffixes, never refused
+	record, known := s.registry.Get(pubKey)
+	if !known || record.Derivation != s.derivation() {
+		attrs := s.derive(pubKey, s.primaryScheme())
+		s.indexIdentities()
+		if collisions := s.findCollisions(pubKey, attrs); len(collisions) > 0 {
+			if !known && s.collisionPolicy == RejectCollisions {
+				s.reportCollisions(collisions, "rejected", now)
+				return fmt.Errorf("derived identity collides with that of another key")
+			}
+			var err error
+			if attrs, err = s.disambiguate(pubKey, attrs, collisions, now); err != nil {
+				return err
+			}
+		}
+		if !s.storeIdentity(pubKey, attrs, now) {
+			return nil
+		}
+	}
+	s.assignExtension(pubKey, now)
+
+	if _, err := s.registry.Touch(pubKey, hostPort, now); err != nil {
+		log.Printf("⚠️  Failed to record %s in registry: %v", ssh.FingerprintSHA256(pubKey), err)
+	}
+	return nil
+}
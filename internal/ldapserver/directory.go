@@ -0,0 +1,223 @@
+package ldapserver
+
+import (
+	"fmt"
+	"lilidap/internal/bitset"
+	"lilidap/internal/derived"
+	"log"
+	"strings"
+
+	"github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"golang.org/x/crypto/ssh"
+)
+
+// The directory lists every key in the registry, so that people can be
+// looked up by their derived attributes, e.g. (uid=u1m4k7p2o). Searches are
+// based at a naming context (dc=<version>,dc=bivvi) or at its ou=campers;
+// keys that never bound here are not listed, since nothing is known of them.
+// Anonymous clients may only look up campers by uid or name, not list them
+// all, unless the server allows anonymous listing.
+//
+// Display names decode back to the key bits they were generated from, so a
+// search for (displayName=lutbousnifkeit) only derives the entries of keys
+// with those bits, and cn=lutbousnifkeit,ou=campers,... names a camper as
+// well as the key itself does.
+
+// parseContainerDN returns the scheme of a naming context or ou=campers DN,
+// and whether the DN is ou=campers
+func (s *LDAPServer) parseContainerDN(dn string) (*derived.Scheme, bool, error) {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	campers := len(parts) == 3 && parts[0] == "ou=campers"
+	if campers {
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "dc=") || parts[1] != "dc=bivvi" {
+		return nil, false, fmt.Errorf("no such object %s", dn)
+	}
+	scheme := s.servedScheme(strings.TrimPrefix(parts[0], "dc="))
+	if scheme == nil {
+		return nil, false, fmt.Errorf("version %s is not served here (try %s)", parts[0], strings.Join(s.namingContexts(), " or "))
+	}
+	return scheme, campers, nil
+}
+
+// searchDirectory answers searches based at a naming context or ou=campers
+func (s *LDAPServer) searchDirectory(w ldap.ResponseWriter, searchReq *message.SearchRequest, viewer ssh.PublicKey) {
+	baseDN := string(searchReq.BaseObject())
+	scheme, campers, err := s.parseContainerDN(baseDN)
+	if err != nil {
+		log.Printf("❌ SEARCH REJECTED: %v", err)
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
+		w.Write(res)
+		return
+	}
+
+	context := fmt.Sprintf("dc=%s,dc=bivvi", scheme.DC())
+	contextEntry := &entry{dn: context}
+	contextEntry.add("objectClass", "top", "domain")
+	contextEntry.add("dc", scheme.DC())
+	campersEntry := &entry{dn: "ou=campers," + context}
+	campersEntry.add("objectClass", "top", "organizationalUnit")
+	campersEntry.add("ou", "campers")
+
+	photos := wantsPhotos(searchReq.Attributes())
+	scope := int(searchReq.Scope())
+	var candidates []*entry
+	switch {
+	case !campers && scope == ldap.SearchRequestScopeBaseObject:
+		candidates = []*entry{contextEntry}
+	case !campers && scope == ldap.SearchRequestSingleLevel:
+		candidates = []*entry{campersEntry}
+	case !campers:
+		candidates = append([]*entry{contextEntry, campersEntry}, s.campers(scheme, searchReq.Filter(), viewer, photos)...)
+	case scope == ldap.SearchRequestScopeBaseObject:
+		candidates = []*entry{campersEntry}
+	default:
+		candidates = s.campers(scheme, searchReq.Filter(), viewer, photos)
+	}
+
+	limit := int(searchReq.SizeLimit())
+	count := 0
+	for _, e := range candidates {
+		if !e.matches(searchReq.Filter()) {
+			continue
+		}
+		if limit > 0 && count == limit {
+			log.Printf("⚠️  SEARCH TRUNCATED: More than %d entries match %s", limit, searchReq.FilterString())
+			res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSizeLimitExceeded)
+			w.Write(res)
+			return
+		}
+		w.Write(e.message())
+		count++
+	}
+
+	log.Printf("✅ SEARCH COMPLETED: Returned %d entries for %s under %s", count, searchReq.FilterString(), baseDN)
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
+// campers returns the entries of every key in the registry that may use
+// this server, as viewer (nil if anonymous) may see them and with photos if
+// wanted, leaving out keys a filter on display names cannot match
+func (s *LDAPServer) campers(scheme *derived.Scheme, filter message.Filter, viewer ssh.PublicKey, photos bool) []*entry {
+	if viewer == nil && !s.anonymousListing && !exactLookup(filter) {
+		log.Printf("🙈 Not listing campers to an anonymous client")
+		return nil
+	}
+	names, narrowed := s.nameCandidates(filter)
+	records := s.registry.List()
+	entries := make([]*entry, 0, len(records))
+	for _, record := range records {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record.Key))
+		if err != nil || (narrowed && !hasBits(names, s.keyBitsOf(record, pubKey))) || s.checkAccess(pubKey) != nil {
+			continue
+		}
+		attrs := s.attributesFor(pubKey, scheme)
+		entries = append(entries, s.userEntry(s.entryDN(pubKey, attrs), pubKey, attrs, s.maySeeKey(viewer, pubKey), photos))
+	}
+	return entries
+}
+
+// exactLookup reports whether a filter only matches campers whose uid or
+// name it gives in full, as when looking up someone one already knows
+func exactLookup(filter message.Filter) bool {
+	switch f := filter.(type) {
+	case message.FilterAnd:
+		for _, sub := range f {
+			if exactLookup(sub) {
+				return true
+			}
+		}
+	case message.FilterOr:
+		for _, sub := range f {
+			if !exactLookup(sub) {
+				return false
+			}
+		}
+		return len(f) > 0
+	case message.FilterEqualityMatch:
+		attribute := strings.ToLower(string(f.AttributeDesc()))
+		return attribute == "uid" || attribute == "cn" || attribute == "displayname" || strings.HasPrefix(attribute, "displayname;lang-")
+	}
+	return false
+}
+
+// nameCandidates returns the key bits of the display names a filter asserts
+// equality with, and whether every matching entry must have one of them
+func (s *LDAPServer) nameCandidates(filter message.Filter) ([]*bitset.BitSet, bool) {
+	switch f := filter.(type) {
+	case message.FilterAnd:
+		// Any narrowing condition narrows the conjunction
+		for _, sub := range f {
+			if names, ok := s.nameCandidates(sub); ok {
+				return names, true
+			}
+		}
+	case message.FilterOr:
+		var names []*bitset.BitSet
+		for _, sub := range f {
+			subNames, ok := s.nameCandidates(sub)
+			if !ok {
+				return nil, false
+			}
+			names = append(names, subNames...)
+		}
+		return names, len(f) > 0
+	case message.FilterEqualityMatch:
+		return s.nameBits(string(f.AttributeDesc()), string(f.AssertionValue()))
+	case message.FilterApproxMatch:
+		return s.nameBits(string(f.AttributeDesc()), string(f.AssertionValue()))
+	}
+	return nil, false
+}
+
+// nameBits returns the key bits a value of an attribute carrying display
+// names could come from
+func (s *LDAPServer) nameBits(attribute, value string) ([]*bitset.BitSet, bool) {
+	attribute = strings.ToLower(attribute)
+	if attribute != "cn" && attribute != "displayname" && !strings.HasPrefix(attribute, "displayname;lang-") {
+		return nil, false
+	}
+	return derived.NameBits(value, s.languages)
+}
+
+func hasBits(sets []*bitset.BitSet, bits *bitset.BitSet) bool {
+	for _, set := range sets {
+		if set.Equals(bits) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveName finds the camper whose common or display name, in any
+// language, is name
+func (s *LDAPServer) resolveName(name string, scheme *derived.Scheme) (ssh.PublicKey, error) {
+	names, narrowed := derived.NameBits(name, s.languages)
+	var found []ssh.PublicKey
+	for _, record := range s.registry.List() {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record.Key))
+		if err != nil || (narrowed && !hasBits(names, s.keyBitsOf(record, pubKey))) || s.checkAccess(pubKey) != nil {
+			continue
+		}
+		attrs := s.attributesFor(pubKey, scheme)
+		for _, lang := range attrs.SupportedLanguages() {
+			if strings.EqualFold(attrs.CommonName(lang), name) || strings.EqualFold(attrs.DisplayName(lang), name) {
+				found = append(found, pubKey)
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("nobody is called %s", name)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("%d campers are called %s", len(found), name)
+}
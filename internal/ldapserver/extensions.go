@@ -0,0 +1,132 @@
+package ldapserver
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"lilidap/internal/derived"
+	"lilidap/internal/registry"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions are short numbers for dialling by hand, given out on each
+// network in the order keys first bind. Unlike derived numbers they differ
+// from one network to the next, but the registry keeps them stable for a
+// key on its network.
+
+// ExtensionRange is an inclusive range of extension numbers
+type ExtensionRange struct {
+	First, Last int
+}
+
+// maxExtension keeps extensions short enough to be worth having
+const maxExtension = 999999
+
+// ParseExtensionRange reads a range written first-last, e.g. 200-999
+func ParseExtensionRange(s string) (ExtensionRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return ExtensionRange{}, fmt.Errorf("extension range %q must be written first-last", s)
+	}
+	var r ExtensionRange
+	var err error
+	if r.First, err = strconv.Atoi(strings.TrimSpace(first)); err != nil {
+		return ExtensionRange{}, fmt.Errorf("extension range %q: %w", s, err)
+	}
+	if r.Last, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+		return ExtensionRange{}, fmt.Errorf("extension range %q: %w", s, err)
+	}
+	return r, r.Validate()
+}
+
+// Validate checks that the range is non-empty and holds short numbers
+func (r ExtensionRange) Validate() error {
+	if r.First < 1 || r.Last > maxExtension || r.First > r.Last {
+		return fmt.Errorf("extension range %s must lie within 1-%d, first to last", r, maxExtension)
+	}
+	return nil
+}
+
+// CheckDialPlan checks that no extension can be confused with a derived
+// number: a phone system matching dialled digits as they come in would
+// connect an extension starting with the prefix of derived numbers before
+// the rest of a derived number could be dialled, and one that the prefix
+// starts with would make derived numbers undialable.
+func (r ExtensionRange) CheckDialPlan(format derived.PhoneFormat) error {
+	if format.Prefix == "" {
+		return fmt.Errorf("extensions %s need derived numbers to have a phone prefix to tell them apart", r)
+	}
+	for n := r.First; n <= r.Last; n++ {
+		extension := strconv.Itoa(n)
+		if strings.HasPrefix(extension, format.Prefix) || strings.HasPrefix(format.Prefix, extension) {
+			return fmt.Errorf("extension %s of %s overlaps derived numbers starting with %s", extension, r, format.Prefix)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether an extension lies within the range
+func (r ExtensionRange) Contains(extension string) bool {
+	n, err := strconv.Atoi(extension)
+	return err == nil && strconv.Itoa(n) == extension && n >= r.First && n <= r.Last
+}
+
+func (r ExtensionRange) String() string {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// assignExtension gives a key the lowest free extension unless it has one
+// in the range. Callers hold admitMu, so no two keys can be given the same one.
+func (s *LDAPServer) assignExtension(pubKey ssh.PublicKey, now time.Time) {
+	if s.extensions == nil {
+		return
+	}
+	if record, ok := s.registry.Get(pubKey); ok && record.Extension != "" {
+		if s.extensions.Contains(record.Extension) {
+			return
+		}
+		log.Printf("☎️  Extension %s of %s is outside %s now", record.Extension, ssh.FingerprintSHA256(pubKey), s.extensions)
+	}
+
+	taken := map[string]bool{}
+	for _, record := range s.registry.List() {
+		if record.Extension != "" {
+			taken[record.Extension] = true
+		}
+	}
+	for n := s.extensions.First; n <= s.extensions.Last; n++ {
+		extension := strconv.Itoa(n)
+		if taken[extension] {
+			continue
+		}
+		_, err := s.registry.Update(pubKey, func(record *registry.Record) error {
+			record.Extension = extension
+			return nil
+		}, now)
+		if err != nil {
+			log.Printf("⚠️  Failed to record extension of %s in registry: %v", ssh.FingerprintSHA256(pubKey), err)
+		} else {
+			log.Printf("☎️  Extension %s given to %s", extension, ssh.FingerprintSHA256(pubKey))
+		}
+		return
+	}
+	log.Printf("⚠️  No free extension left in %s for %s", s.extensions, ssh.FingerprintSHA256(pubKey))
+}
+
+// extensionOf returns the extension given to a key, if any. One left outside
+// the range by a change of configuration is not published; the key gets a
+// new one when it next binds.
+func (s *LDAPServer) extensionOf(pubKey ssh.PublicKey) string {
+	if s.extensions == nil {
+		return ""
+	}
+	record, ok := s.registry.Get(pubKey)
+	if !ok || !s.extensions.Contains(record.Extension) {
+		return ""
+	}
+	return record.Extension
+}
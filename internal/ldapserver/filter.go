@@ -0,0 +1,160 @@
+package ldapserver
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lor00x/goldap/message"
+)
+
+// attribute is one attribute of an entry, with its values
+type attribute struct {
+	name   string
+	values []string
+}
+
+// entry is a directory entry before it is written out, so that it can be
+// matched against search filters
+type entry struct {
+	dn    string
+	attrs []attribute
+
+	// matchers override case-insensitive equality for some attributes,
+	// keyed by lowercase attribute name
+	matchers map[string]func(asserted, value string) bool
+}
+
+func (e *entry) add(name string, values ...string) {
+	e.attrs = append(e.attrs, attribute{name, values})
+}
+
+// get returns the values of an attribute, whose name is case-insensitive
+func (e *entry) get(name string) []string {
+	for _, attr := range e.attrs {
+		if strings.EqualFold(attr.name, name) {
+			return attr.values
+		}
+	}
+	return nil
+}
+
+// equal applies the equality matching rule of an attribute
+func (e *entry) equal(name, asserted, value string) bool {
+	if match, ok := e.matchers[strings.ToLower(name)]; ok {
+		return match(asserted, value)
+	}
+	return strings.EqualFold(asserted, value)
+}
+
+// message converts the entry into a search result
+func (e *entry) message() message.SearchResultEntry {
+	res := message.SearchResultEntry{}
+	res.SetObjectName(e.dn)
+	for _, attr := range e.attrs {
+		values := make([]message.AttributeValue, 0, len(attr.values))
+		for _, value := range attr.values {
+			values = append(values, message.AttributeValue(value))
+		}
+		res.AddAttribute(message.AttributeDescription(attr.name), values...)
+	}
+	return res
+}
+
+// matches evaluates an LDAP search filter against the entry. Ordering
+// filters compare numbers numerically and everything else case-insensitively;
+// approximate matches are treated as equality and extensible matches never match.
+func (e *entry) matches(filter message.Filter) bool {
+	switch f := filter.(type) {
+	case message.FilterAnd:
+		for _, sub := range f {
+			if !e.matches(sub) {
+				return false
+			}
+		}
+		return true
+	case message.FilterOr:
+		for _, sub := range f {
+			if e.matches(sub) {
+				return true
+			}
+		}
+		return false
+	case message.FilterNot:
+		return !e.matches(f.Filter)
+	case message.FilterPresent:
+		return len(e.get(string(f))) > 0
+	case message.FilterEqualityMatch:
+		return e.anyValue(string(f.AttributeDesc()), func(value string) bool {
+			return e.equal(string(f.AttributeDesc()), string(f.AssertionValue()), value)
+		})
+	case message.FilterApproxMatch:
+		return e.anyValue(string(f.AttributeDesc()), func(value string) bool {
+			return e.equal(string(f.AttributeDesc()), string(f.AssertionValue()), value)
+		})
+	case message.FilterGreaterOrEqual:
+		return e.anyValue(string(f.AttributeDesc()), func(value string) bool {
+			return compareValues(value, string(f.AssertionValue())) >= 0
+		})
+	case message.FilterLessOrEqual:
+		return e.anyValue(string(f.AttributeDesc()), func(value string) bool {
+			return compareValues(value, string(f.AssertionValue())) <= 0
+		})
+	case message.FilterSubstrings:
+		return e.anyValue(string(f.Type_()), func(value string) bool {
+			return matchSubstrings(strings.ToLower(value), f.Substrings())
+		})
+	}
+	return false
+}
+
+func (e *entry) anyValue(name string, match func(value string) bool) bool {
+	for _, value := range e.get(name) {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues orders two values, numerically if both are integers
+func compareValues(a, b string) int {
+	aNum, aErr := strconv.ParseInt(a, 10, 64)
+	bNum, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// matchSubstrings matches a lowercase value against initial, any and final parts
+func matchSubstrings(value string, substrings []message.Substring) bool {
+	for _, substring := range substrings {
+		switch part := substring.(type) {
+		case message.SubstringInitial:
+			prefix := strings.ToLower(string(part))
+			if !strings.HasPrefix(value, prefix) {
+				return false
+			}
+			value = value[len(prefix):]
+		case message.SubstringAny:
+			infix := strings.ToLower(string(part))
+			i := strings.Index(value, infix)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(infix):]
+		case message.SubstringFinal:
+			if !strings.HasSuffix(value, strings.ToLower(string(part))) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
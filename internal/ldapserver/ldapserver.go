@@ -2,13 +2,20 @@ package ldapserver
 
 import (
 	"fmt"
+	"lilidap/internal/allowlist"
+	"lilidap/internal/attrmap"
 	"lilidap/internal/derived"
+	"lilidap/internal/derived/syllables"
+	"lilidap/internal/invite"
+	"lilidap/internal/registry"
+	"lilidap/internal/revocation"
 	"lilidap/internal/sshclient"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/lor00x/goldap/message"
 	ldap "github.com/vjeantet/ldapserver"
@@ -17,27 +24,44 @@ import (
 
 // LDAP Server Implementation
 //
-// DN format: cn=<full-ssh-public-key>,ou=campers,dc=0_1_0,dc=bivvi
+// DN format: cn=<full-ssh-public-key>,ou=campers,dc=<version>,dc=bivvi
 // The CN contains the full SSH public key in OpenSSH authorized_keys format
 // Example: cn=ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC...,ou=campers,dc=0_1_0,dc=bivvi
+// Searches may also name a camper who has bound here by display name:
+// cn=vantumkeirrof,ou=campers,dc=0_1_0,dc=bivvi
+// or by uid or fingerprint, the DNs entries are published under when keys
+// are hidden (see WithEntryNaming):
+// uid=u1m4k7p2o,ou=campers,dc=0_1_0,dc=bivvi
+//
+// The version component (e.g. dc=0_1_0) picks the derivation scheme: each
+// served scheme is its own naming context, listed in the root DSE.
 //
 // User Attributes (all derived from SSH key hash):
-// - objectClass: inetOrgPerson, posixAccount
+// - objectClass: inetOrgPerson, posixAccount, ldapPublicKey, lilidapAccount
 // - uid: u1234abcd                 # POSIX username (base32-encoded hash)
-// - uidNumber: 753198499           # Numeric UID (from hash)
-// - gidNumber: 1001                # Constant group ID
+// - uidNumber: 753198499           # Numeric UID (from hash, mapped into the UID range)
+// - gidNumber: 1001                # Constant group ID, or per-user from the GID range
 // - homeDirectory: /home/u1234abcd # From uid
+// (gidNumber, homeDirectory and any extra attributes are templates, see WithAttributeMap)
 // - telephoneNumber: 8753198499    # VoIP number (from hash)
 // - displayName: vantumkeirrof     # Friendly name (syllabic)
 // - displayName;lang-XX: ...       # Locale-specific variants
 // - cn: vantumkeirrof              # Common Name (copy of displayName)
+// - sshPublicKey: ssh-ed25519 AAAA... # The key itself (openssh-lpk schema), unless hidden
+// - sshKeyFingerprint: SHA256:...  # Its fingerprint, unless the key is hidden
+// - sshKeyType: ssh-ed25519        # Its algorithm, unless the key is hidden
+// - fingerprintWords: topmost ...  # Its SHA-256 hash as 32 words, for reading aloud, unless the key is hidden
+// - jpegPhoto, thumbnailPhoto      # Identicon (from hash)
+// - accentColor: #3fbf7a           # Color of the identicon (from hash)
+//
+// The schema of the non-standard attributes is published at cn=Subschema.
 //
 // Authentication Flow:
 // 1. Client BIND with DN containing full SSH key + password=host:port
 // 2. Server validates SSH key ownership by connecting to host:port
 // 3. On success, client can SEARCH to get derived attributes
 //
-// Base32 encoding (for uid only):
+// Base32 encoding (for uid only, from scheme 0.2.0 on):
 // - Character set: o123456789abcdefghikmnpqrstvwxyz
 // - Omits confusable characters for visual clarity
 // - Applied only to uid attribute, not to DN
@@ -50,7 +74,43 @@ type LDAPServer struct {
 	sshAddr    string
 	sshPubKey  ssh.PublicKey
 	listenAddr string
-	sessions   sync.Map // Maps client address (string) → bound DN (string)
+	sessions   sync.Map           // Maps client address (string) → bound DN (string)
+	revoked    *revocation.List   // Optional list of keys that must be refused
+	allowlist  *allowlist.List    // Optional list of the only keys permitted (closed community)
+	invites    *invitations       // Optional invitations admitting keys not on the allowlist
+	registry   *registry.Registry // Every key that ever bound here (in-memory by default)
+
+	anonymousListing bool // Whether anonymous clients may list campers, not just look them up
+
+	collisionPolicy CollisionPolicy // What to do when derived identities collide
+	onCollision     func(Collision) // Optional reporter telling admins about collisions
+	admitMu         sync.Mutex      // Serializes collision checks of newcomers
+	identities      *identityIndex  // Keys by the derived values they hold, under admitMu
+
+	uidRange  *derived.IDRange    // Range uidNumber is mapped into (nil: legacy uidNumber)
+	gidRange  *derived.IDRange    // Range gidNumber is mapped into (nil: constant gidNumber)
+	schemes   []*derived.Scheme   // Derivation schemes served, the first one detecting collisions
+	languages *syllables.Registry // Languages names are generated in
+	salt      []byte              // Optional per-deployment salt making identities pseudonymous
+
+	naming          EntryNaming     // RDN user entries are published under
+	rdns            *rdnIndex       // Keys by the uid and fingerprint entries may be named by
+	serviceAccounts *allowlist.List // Keys that may see everyone's key when entries are not named by it
+
+	phoneFormat derived.PhoneFormat // How telephone numbers are derived
+	sipDomain   string              // Optional SIP domain for sipURI and labeledURI
+	extensions  *ExtensionRange     // Short numbers given out on first bind, if any
+
+	attributeMap *attrmap.Mapping // Templated attributes of user entries
+	photos       *photoCache      // Recently encoded identicons
+}
+
+// invitations holds what network invitation tokens must be for, who may
+// issue them and where redemptions are kept
+type invitations struct {
+	network string
+	admins  *allowlist.List
+	store   invite.Store
 }
 
 func getKeyInfo(pubKey ssh.PublicKey) (keyType, fingerprint string) {
@@ -58,21 +118,35 @@ func getKeyInfo(pubKey ssh.PublicKey) (keyType, fingerprint string) {
 }
 
 // NewServer creates a new LDAP server
-func NewServer(listenAddr string, sshPubKey ssh.PublicKey) *LDAPServer {
+func NewServer(listenAddr string, sshPubKey ssh.PublicKey, opts ...Option) *LDAPServer {
 	server := ldap.NewServer()
 
 	s := &LDAPServer{
-		server:     server,
-		sshAddr:    "localhost:22", // Default SSH server address
-		sshPubKey:  sshPubKey,
-		listenAddr: listenAddr,
+		server:       server,
+		sshAddr:      "localhost:22", // Default SSH server address
+		sshPubKey:    sshPubKey,
+		listenAddr:   listenAddr,
+		registry:     registry.NewInMemory(),
+		schemes:      derived.Schemes(),
+		languages:    syllables.Builtin(),
+		phoneFormat:  derived.DefaultPhoneFormat,
+		attributeMap: attrmap.Default(),
+		rdns:         newRDNIndex(),
+		identities:   newIdentityIndex(),
+		photos:       newPhotoCache(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	// Register handlers for specific LDAP operations
 	routes := ldap.NewRouteMux()
 	routes.Bind(s.handleBind)
+	routes.Search(s.handleRootDSE).BaseDn("").Scope(ldap.SearchRequestScopeBaseObject)
+	routes.Search(s.handleSubschema).BaseDn(subschemaDN).Scope(ldap.SearchRequestScopeBaseObject)
 	routes.Search(s.handleSearch)
 	routes.Extended(s.handleExtended).RequestName("1.3.6.1.4.1.4203.1.11.3")
+	routes.Extended(s.handleSafetyNumber).RequestName(safetyNumberOID)
 	server.Handle(routes)
 
 	return s
@@ -94,8 +168,10 @@ func (s *LDAPServer) handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 		}
 	}()
 
-	// Parse host:port from password
-	hostPort := bindReq.AuthenticationSimple().String()
+	// Parse host:port from password, optionally followed by an invitation token
+	password := strings.TrimSpace(bindReq.AuthenticationSimple().String())
+	hostPort, inviteToken, _ := strings.Cut(password, " ")
+	inviteToken = strings.TrimSpace(inviteToken)
 	host, portStr, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		log.Printf("❌ BIND REJECTED: Invalid host:port format: %v", err)
@@ -135,10 +211,10 @@ func (s *LDAPServer) handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	}
 
 	// Extract full SSH public key from CN in DN
-	// DN format: cn=<full-ssh-key>,ou=campers,dc=0_1_0,dc=bivvi
+	// DN format: cn=<full-ssh-key>,ou=campers,dc=<version>,dc=bivvi
 	// Example: cn=ssh-rsa AAAAB3NzaC1yc2E...,ou=campers,dc=0_1_0,dc=bivvi
 	dn := string(bindReq.Name())
-	cn, err := extractCN(dn)
+	cn, scheme, err := s.parseDN(dn)
 	if err != nil {
 		log.Printf("❌ BIND REJECTED: Invalid DN format: %v", err)
 		res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
@@ -158,6 +234,22 @@ func (s *LDAPServer) handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 
 	// Get key fingerprint for logging
 	keyType, fingerprint := getKeyInfo(pubKey)
+
+	// Refuse revoked or unlisted keys before bothering their SSH server,
+	// unless an unlisted key brings a valid invitation
+	var invitation *invite.Token
+	accessErr := s.checkAccess(pubKey)
+	if accessErr != nil && inviteToken != "" && s.mayBeInvited(pubKey) {
+		invitation, accessErr = s.verifyInvitation(inviteToken)
+	}
+	if accessErr != nil {
+		log.Printf("❌ BIND REJECTED: %s key %s: %v", keyType, fingerprint, accessErr)
+		res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
+		res.SetDiagnosticMessage(accessErr.Error())
+		w.Write(res)
+		return
+	}
+
 	log.Printf("   Validating %s key %s against SSH server %s:%d", keyType, fingerprint, host, port)
 
 	// Validate key against SSH server
@@ -175,14 +267,36 @@ func (s *LDAPServer) handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
+	// Only now that the key is proven is the invitation used up
+	if invitation != nil {
+		if err := s.invites.store.Redeem(invitation, pubKey, time.Now()); err != nil {
+			log.Printf("❌ BIND REJECTED: Invitation %s not redeemed: %v", invitation.ID, err)
+			res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
+			res.SetDiagnosticMessage(err.Error())
+			w.Write(res)
+			return
+		}
+		log.Printf("🎟️  INVITATION REDEEMED: %s key %s admitted with invitation %s", keyType, fingerprint, invitation.ID)
+	}
+
+	// Remember the key and where it was last validated, refusing newcomers
+	// whose identity collides with a known key if the policy says so
+	if err := s.admit(pubKey, hostPort, time.Now()); err != nil {
+		log.Printf("❌ BIND REJECTED: %s key %s: %v", keyType, fingerprint, err)
+		res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+
 	log.Printf("✅ BIND ACCEPTED: %s key %s authenticated successfully", keyType, fingerprint)
 
 	// Normalize the SSH key to ensure consistent representation
 	// MarshalAuthorizedKey returns the canonical form with a trailing newline
 	normalizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey)))
 
-	// Reconstruct the DN with the normalized key
-	normalizedDN := fmt.Sprintf("cn=%s,ou=campers,dc=0_1_0,dc=bivvi", normalizedKey)
+	// Reconstruct the DN with the normalized key, in the version bound with
+	normalizedDN := fmt.Sprintf("cn=%s,ou=campers,dc=%s,dc=bivvi", normalizedKey, scheme.DC())
 
 	// Store the normalized DN in the session for this client
 	s.sessions.Store(clientAddr, normalizedDN)
@@ -197,10 +311,25 @@ func (s *LDAPServer) handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 
 	log.Printf("🔍 SEARCH request from %s", clientAddr)
 
+	// A key revoked since it bound may not search on with its session
+	viewer, err := s.boundKey(clientAddr)
+	if err != nil {
+		log.Printf("❌ SEARCH REJECTED: %v", err)
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultInsufficientAccessRights)
+		w.Write(res)
+		return
+	}
+
+	// Searches based at a naming context or ou=campers list the directory
+	dn := string(searchReq.BaseObject())
+	if _, _, ok := entryRDN(dn); !ok {
+		s.searchDirectory(w, &searchReq, viewer)
+		return
+	}
+
 	// Extract full SSH public key from CN in base DN
 	// The CN contains the full SSH key in OpenSSH authorized_keys format
-	dn := string(searchReq.BaseObject())
-	cn, err := extractCN(dn)
+	rdn, value, scheme, err := s.parseEntryDN(dn)
 	if err != nil {
 		log.Printf("❌ SEARCH REJECTED: Invalid DN format: %v", err)
 		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultInvalidDNSyntax)
@@ -208,41 +337,171 @@ func (s *LDAPServer) handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
-	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cn))
+	var pubKey ssh.PublicKey
+	byKey := rdn == "cn" && strings.ContainsRune(value, ' ')
+	switch {
+	case byKey:
+		pubKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(value))
+		if err != nil {
+			log.Printf("❌ SEARCH REJECTED: Invalid SSH key: %v", err)
+			res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultInvalidDNSyntax)
+			w.Write(res)
+			return
+		}
+	case rdn == "cn":
+		// A friendly name, e.g. cn=lutbousnifkeit: the entry is returned
+		// under the DN it is published under
+		pubKey, err = s.resolveName(value, scheme)
+	default:
+		// uid=u1m4k7p2o or sshKeyFingerprint=SHA256:...
+		pubKey, err = s.resolveRDN(rdn, value, scheme)
+	}
 	if err != nil {
-		log.Printf("❌ SEARCH REJECTED: Invalid SSH key: %v", err)
-		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultInvalidDNSyntax)
+		log.Printf("❌ SEARCH REJECTED: %v", err)
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
+		w.Write(res)
+		return
+	}
+
+	keyType, fingerprint := getKeyInfo(pubKey)
+
+	// Revoked or unlisted keys have no entry
+	if err := s.checkAccess(pubKey); err != nil {
+		log.Printf("❌ SEARCH REJECTED: %s key %s: %v", keyType, fingerprint, err)
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
+		w.Write(res)
+		return
+	}
+	// Nor are there entries under a hidden key, to those who may not see
+	// it: the answer would tell them the key has an identity here
+	if (byKey || rdn == "sshkeyfingerprint") && !s.mayLookUpByKey(rdn, viewer, pubKey) {
+		log.Printf("❌ SEARCH REJECTED: %s key %s looked up by %s, which is hidden", keyType, fingerprint, rdn)
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
 		w.Write(res)
 		return
 	}
 
 	// Generate derived attributes
-	attrs := derived.FromPublicKey(pubKey)
+	attrs := s.attributesFor(pubKey, scheme)
+	// An entry looked up by its key comes back under the DN asked for,
+	// unless keys are hidden; others under the DN they are published under
+	if !byKey || s.naming != NameByKey {
+		dn = s.entryDN(pubKey, attrs)
+	}
 
-	keyType, fingerprint := getKeyInfo(pubKey)
-	log.Printf("   Returning attributes for %s key %s (uid=%s, displayName=%s)",
-		keyType, fingerprint, attrs.Username(), attrs.DisplayName("en"))
+	log.Printf("   Returning %s attributes for %s key %s (uid=%s, displayName=%s)",
+		scheme, keyType, fingerprint, attrs.Username(), attrs.DisplayName("en"))
 
 	// Return entry with derived attributes
-	e := ldap.NewSearchResultEntry(dn)
-	e.AddAttribute("objectClass", message.AttributeValue("inetOrgPerson"), message.AttributeValue("posixAccount"))
-	e.AddAttribute("uid", message.AttributeValue(attrs.Username()))
-	e.AddAttribute("uidNumber", message.AttributeValue(fmt.Sprintf("%d", attrs.PosixUserID())))
-	e.AddAttribute("gidNumber", message.AttributeValue("1001")) // Constant group ID
-	e.AddAttribute("homeDirectory", message.AttributeValue(fmt.Sprintf("/home/%s", attrs.Username())))
-	e.AddAttribute("telephoneNumber", message.AttributeValue(attrs.PhoneNumber()))
-	e.AddAttribute("displayName", message.AttributeValue(attrs.DisplayName("en")))
-	e.AddAttribute("cn", message.AttributeValue(attrs.DisplayName("en"))) // Common Name
-
-	// Generate locale-specific display names in this format:
-	//	displayName;lang-zh: 用户123
+	w.Write(s.userEntry(dn, pubKey, attrs, s.maySeeKey(viewer, pubKey), wantsPhotos(searchReq.Attributes())).message())
+
+	log.Printf("✅ SEARCH COMPLETED: Returned 1 entry")
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
+// userEntry builds the entry of a key from its derived attributes, with the
+// key and what identifies it only if showKey and the identicon only if photos
+func (s *LDAPServer) userEntry(dn string, pubKey ssh.PublicKey, attrs *derived.UserAttributes, showKey, photos bool) *entry {
+	scheme := attrs.Scheme()
+	e := &entry{dn: dn, matchers: map[string]func(asserted, value string) bool{
+		"uid": scheme.UsernameMatches,
+	}}
+	objectClasses := []string{"inetOrgPerson", "posixAccount", "lilidapAccount"}
+	if showKey {
+		// ldapPublicKey requires sshPublicKey
+		objectClasses = []string{"inetOrgPerson", "posixAccount", "ldapPublicKey", "lilidapAccount"}
+	}
+	e.add("objectClass", append(objectClasses, s.attributeMap.ObjectClasses...)...)
+	e.add("uid", attrs.Username())
+	e.add("uidNumber", fmt.Sprintf("%d", attrs.PosixUserID()))
+
+	// Operator-configured attributes, gidNumber and homeDirectory by default
+	values, err := s.attributeMap.Apply(attrs)
+	if err != nil {
+		log.Printf("⚠️  %s: %v", ssh.FingerprintSHA256(pubKey), err)
+	}
+	for _, value := range values {
+		e.add(value.Name, value.Value)
+	}
+	// The extension comes first, since PBXes take the first number as the user's extension
+	var numbers []string
+	if extension := s.extensionOf(pubKey); extension != "" {
+		numbers = append(numbers, extension)
+	}
+	numbers = append(numbers, attrs.PhoneNumber())
+	if e164 := attrs.E164(); e164 != attrs.PhoneNumber() {
+		numbers = append(numbers, e164)
+	}
+	e.add("telephoneNumber", numbers...)
+	if s.sipDomain != "" {
+		e.add("sipURI", attrs.SIPURI(s.sipDomain))
+		e.add("labeledURI", attrs.SIPURI(s.sipDomain)+" SIP")
+	}
+	// The fingerprint, type and words give the key away as surely as the
+	// key itself: anyone can match them against keys published elsewhere
+	if showKey {
+		addKeyAttributes(e, pubKey)
+		e.add("fingerprintWords", attrs.WordFingerprint())
+	}
+	s.addAvatarAttributes(e, attrs, photos)
+	e.add("displayName", attrs.DisplayName("en"))
+	e.add("cn", attrs.CommonName("en")) // Common Name
+	if scheme.SplitsNames() {
+		e.add("givenName", attrs.GivenName("en"))
+		e.add("sn", attrs.Surname("en")) // Surname
+	}
+
+	// Generate locale-specific names in this format:
+	//	displayName;lang-zh: 农山中（55466）
 	for _, lang := range attrs.SupportedLanguages() {
-		e.AddAttribute(message.AttributeDescription(fmt.Sprintf("displayName;lang-%s", lang)), message.AttributeValue(attrs.DisplayName(lang)))
+		e.add(fmt.Sprintf("displayName;lang-%s", lang), attrs.DisplayName(lang))
+		if scheme.SplitsNames() {
+			e.add(fmt.Sprintf("givenName;lang-%s", lang), attrs.GivenName(lang))
+			e.add(fmt.Sprintf("sn;lang-%s", lang), attrs.Surname(lang))
+		}
 	}
 
+	// Groups granted by the allowlist, as group DNs
+	if groups := s.groupsOf(pubKey); len(groups) > 0 {
+		values := make([]string, 0, len(groups))
+		for _, group := range groups {
+			values = append(values, fmt.Sprintf("cn=%s,ou=groups,dc=%s,dc=bivvi", group, scheme.DC()))
+		}
+		e.add("memberOf", values...)
+	}
+	return e
+}
+
+// handleRootDSE answers base searches of the empty DN (RFC 4512), telling
+// clients which versions are served and what the server supports
+func (s *LDAPServer) handleRootDSE(w ldap.ResponseWriter, m *ldap.Message) {
+	log.Printf("🔍 ROOT DSE request from %s", m.Client.Addr().String())
+
+	contexts := s.namingContexts()
+	values := make([]message.AttributeValue, 0, len(contexts))
+	for _, context := range contexts {
+		values = append(values, message.AttributeValue(context))
+	}
+
+	e := ldap.NewSearchResultEntry("")
+	e.AddAttribute("objectClass", message.AttributeValue("top"))
+	e.AddAttribute("namingContexts", values...)
+	e.AddAttribute("defaultNamingContext", message.AttributeValue(contexts[0]))
+	e.AddAttribute("supportedLDAPVersion", message.AttributeValue("3"))
+	e.AddAttribute("supportedExtension", message.AttributeValue("1.3.6.1.4.1.4203.1.11.3"), message.AttributeValue(safetyNumberOID))
+	e.AddAttribute("subschemaSubentry", message.AttributeValue(subschemaDN))
+	e.AddAttribute("vendorName", message.AttributeValue("LiliDAP"))
+	// Which identities the entries carry: the same on every network, or
+	// pseudonyms of this one. Nothing derived from the salt is published,
+	// since it would let anyone check guesses at it.
+	if len(s.salt) > 0 {
+		e.AddAttribute("lilidapIdentity", message.AttributeValue("pseudonymous"))
+	} else {
+		e.AddAttribute("lilidapIdentity", message.AttributeValue("global"))
+	}
 	w.Write(e)
 
-	log.Printf("✅ SEARCH COMPLETED: Returned 1 entry")
 	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
 	w.Write(res)
 }
@@ -267,8 +526,15 @@ func (s *LDAPServer) handleExtended(w ldap.ResponseWriter, m *ldap.Message) {
 	}
 
 	// Retrieve the bound DN from the session
-	boundDNInterface, ok := s.sessions.Load(clientAddr)
-	if !ok {
+	boundDN, err := s.sessionDN(clientAddr)
+	if err != nil {
+		log.Printf("❌ WHOAMI REJECTED: %v", err)
+		res := ldap.NewExtendedResponse(ldap.LDAPResultInsufficientAccessRights)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+	if boundDN == "" {
 		log.Printf("❌ WHOAMI REJECTED: No bound session found for %s", clientAddr)
 		res := ldap.NewExtendedResponse(ldap.LDAPResultOperationsError)
 		res.SetDiagnosticMessage("Not authenticated - no bound session")
@@ -276,7 +542,8 @@ func (s *LDAPServer) handleExtended(w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
-	boundDN := boundDNInterface.(string)
+	// Hidden keys stay hidden here too
+	boundDN = s.publishedDN(boundDN)
 	// RFC 4532: authzId format should be "dn:<distinguished-name>"
 	authzId := "dn:" + boundDN
 
@@ -292,26 +559,139 @@ func (s *LDAPServer) handleExtended(w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
-// extractCN extracts the CN value from a DN string
-// DN format: cn=<value>,ou=campers,dc=0_1_0,dc=bivvi
-func extractCN(dn string) (string, error) {
+// isRevoked checks the key against the revocation list, if one is configured
+func (s *LDAPServer) isRevoked(pubKey ssh.PublicKey) bool {
+	return s.revoked != nil && s.revoked.IsRevoked(pubKey)
+}
+
+// errRevoked is why revoked keys may not use this server
+var errRevoked = fmt.Errorf("SSH key has been revoked")
+
+// checkAccess returns why a key may not use this server, or nil if it may
+func (s *LDAPServer) checkAccess(pubKey ssh.PublicKey) error {
+	if s.isRevoked(pubKey) {
+		return errRevoked
+	}
+	if s.allowlist != nil {
+		if _, err := s.allowlist.Check(pubKey, time.Now()); err != nil {
+			if s.mayBeInvited(pubKey) && s.invites.store.IsAdmitted(pubKey) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// mayBeInvited reports whether invitations can admit a key: only keys the
+// allowlist does not know, not those whose entry an admin let expire
+func (s *LDAPServer) mayBeInvited(pubKey ssh.PublicKey) bool {
+	if s.invites == nil || s.isRevoked(pubKey) {
+		return false
+	}
+	if s.allowlist != nil {
+		if _, listed := s.allowlist.Lookup(pubKey); listed {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionDN returns the DN a client bound with, or "" if it has not bound.
+// Revoking a key ends its sessions: the session of a key revoked since it
+// bound is forgotten and errRevoked returned.
+func (s *LDAPServer) sessionDN(clientAddr string) (string, error) {
+	boundDN, ok := s.sessions.Load(clientAddr)
+	if !ok {
+		return "", nil
+	}
+	if s.revoked != nil {
+		if pubKey, err := s.keyOfDN(boundDN.(string)); err == nil && s.isRevoked(pubKey) {
+			s.sessions.Delete(clientAddr)
+			return "", errRevoked
+		}
+	}
+	return boundDN.(string), nil
+}
+
+// verifyInvitation checks that a token was signed by a current admin and is still valid
+func (s *LDAPServer) verifyInvitation(encoded string) (*invite.Token, error) {
+	if s.invites == nil {
+		return nil, fmt.Errorf("invitations are not accepted by this server")
+	}
+	now := time.Now()
+	return invite.Verify(encoded, s.invites.network, func(issuer ssh.PublicKey) bool {
+		_, err := s.invites.admins.Check(issuer, now)
+		return err == nil
+	}, now)
+}
+
+// groupsOf returns the groups the allowlist grants the key, if any
+func (s *LDAPServer) groupsOf(pubKey ssh.PublicKey) []string {
+	if s.allowlist == nil {
+		return nil
+	}
+	if entry, ok := s.allowlist.Lookup(pubKey); ok {
+		return entry.Groups
+	}
+	return nil
+}
+
+// parseDN extracts the CN value and the derivation scheme from a DN string
+// DN format: cn=<value>,ou=campers,dc=<version>,dc=bivvi
+func (s *LDAPServer) parseDN(dn string) (string, *derived.Scheme, error) {
 	if !strings.HasPrefix(dn, "cn=") {
-		return "", fmt.Errorf("DN must start with cn=")
+		return "", nil, fmt.Errorf("DN must start with cn=")
+	}
+	_, cn, scheme, err := s.parseEntryDN(dn)
+	return cn, scheme, err
+}
+
+// parseEntryDN extracts the RDN attribute (lowercase) and value and the
+// derivation scheme from the DN of an entry, which may name the key (cn=),
+// a display name (cn=), the uid (uid=) or the fingerprint (sshKeyFingerprint=)
+func (s *LDAPServer) parseEntryDN(dn string) (string, string, *derived.Scheme, error) {
+	attribute, value, ok := entryRDN(dn)
+	if !ok {
+		return "", "", nil, fmt.Errorf("DN must start with cn=, uid= or sshKeyFingerprint=")
 	}
 	parts := strings.Split(dn, ",")
 	if len(parts) != 4 {
-		return "", fmt.Errorf("DN must have exactly 4 parts")
+		return "", "", nil, fmt.Errorf("DN must have exactly 4 parts")
 	}
 	if parts[1] != "ou=campers" {
-		return "", fmt.Errorf("second part must be ou=campers")
+		return "", "", nil, fmt.Errorf("second part must be ou=campers")
 	}
-	if parts[2] != "dc=0_1_0" {
-		return "", fmt.Errorf("third part must be dc=0_1_0")
+	if !strings.HasPrefix(parts[2], "dc=") {
+		return "", "", nil, fmt.Errorf("third part must be dc=<version>")
+	}
+	scheme := s.servedScheme(strings.TrimPrefix(parts[2], "dc="))
+	if scheme == nil {
+		return "", "", nil, fmt.Errorf("version %s is not served here (try %s)", parts[2], strings.Join(s.namingContexts(), " or "))
 	}
 	if parts[3] != "dc=bivvi" {
-		return "", fmt.Errorf("fourth part must be dc=bivvi")
+		return "", "", nil, fmt.Errorf("fourth part must be dc=bivvi")
+	}
+	return attribute, value, scheme, nil
+}
+
+// servedScheme returns the served scheme for a dc=X_Y_Z version, or nil
+func (s *LDAPServer) servedScheme(dc string) *derived.Scheme {
+	for _, scheme := range s.schemes {
+		if scheme.DC() == dc {
+			return scheme
+		}
 	}
-	return strings.TrimPrefix(parts[0], "cn="), nil
+	return nil
+}
+
+// namingContexts returns the base DN of every served scheme
+func (s *LDAPServer) namingContexts() []string {
+	contexts := make([]string, 0, len(s.schemes))
+	for _, scheme := range s.schemes {
+		contexts = append(contexts, fmt.Sprintf("dc=%s,dc=bivvi", scheme.DC()))
+	}
+	return contexts
 }
 
 // Start starts the LDAP server
@@ -324,6 +704,11 @@ func (s *LDAPServer) Stop() {
 	s.server.Stop()
 }
 
+// Registry returns the registry of keys that have bound to this server
+func (s *LDAPServer) Registry() *registry.Registry {
+	return s.registry
+}
+
 // Addr returns the address the server is listening on
 func (s *LDAPServer) Addr() string {
 	if s.server.Listener != nil {
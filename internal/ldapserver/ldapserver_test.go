@@ -1,15 +1,32 @@
 package ldapserver
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
 	"fmt"
+	"lilidap/internal/allowlist"
+	"lilidap/internal/attrmap"
 	"lilidap/internal/derived"
+	"lilidap/internal/invite"
+	"lilidap/internal/registry"
+	"lilidap/internal/revocation"
+	"lilidap/internal/testutils"
 	"lilidap/internal/testutils/ssh_helpers"
 	"lilidap/internal/testutils/tcp_helpers"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
+	"github.com/lor00x/goldap/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -164,3 +181,1495 @@ func TestLDAPServer(t *testing.T) {
 		assert.Equal(fmt.Sprintf("/home/%s", username), entry.GetAttributeValue("homeDirectory"), "Should have correct homeDirectory")
 	})
 }
+
+// startTestServer runs an LDAP server with the given options until the test ends
+func startTestServer(t *testing.T, opts ...Option) string {
+	port, err := tcp_helpers.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(fmt.Sprintf("localhost:%d", port), nil, opts...)
+	go func() {
+		if err := server.Start(); err != nil {
+			t.Errorf("Failed to start LDAP server: %v", err)
+		}
+	}()
+	t.Cleanup(server.Stop)
+
+	tcp_helpers.WaitForPort(t, "localhost", port)
+	return server.Addr()
+}
+
+// keyDN builds the bind DN for a public key
+func keyDN(pubKey ssh.PublicKey) string {
+	keyBytes := ssh.MarshalAuthorizedKey(pubKey)
+	return fmt.Sprintf("cn=%s,ou=campers,dc=0_1_0,dc=bivvi", string(keyBytes[:len(keyBytes)-1]))
+}
+
+// compileFilter turns a filter string into the form the server receives,
+// by decoding a search request carrying it
+func compileFilter(t *testing.T, filter string) message.Filter {
+	packet, err := ldap.CompileFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go-ldap only encodes filters as part of a request, so wrap this one in
+	// a search request for goldap to decode
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, message.TagSearchRequest, nil, "SearchRequest")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "baseObject"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.ScopeWholeSubtree, "scope"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.NeverDerefAliases, "derefAliases"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "sizeLimit"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "timeLimit"))
+	op.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+	op.AppendChild(packet)
+	op.AppendChild(ber.NewSequence("attributes"))
+	request := ber.NewSequence("LDAPMessage")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "messageID"))
+	request.AppendChild(op)
+
+	decoded, err := message.ReadLDAPMessage(message.NewBytes(0, request.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchReq := decoded.ProtocolOp().(message.SearchRequest)
+	return searchReq.Filter()
+}
+
+// searchBase performs a base object search on the DN
+func searchBase(conn *ldap.Conn, dn string) (*ldap.SearchResult, error) {
+	return conn.Search(ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		nil,
+		nil,
+	))
+}
+
+func TestRevokedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		blocklist := filepath.Join(t.TempDir(), "revoked_keys")
+		if err := os.WriteFile(blocklist, ssh.MarshalAuthorizedKey(sshPubKey), 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := revocation.Load(blocklist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := startTestServer(t, WithRevocationList(list))
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		t.Run("Revoked key cannot bind", func(t *testing.T) {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.Error(err, "Should refuse a revoked key")
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		})
+
+		t.Run("Revoked key is hidden from search", func(t *testing.T) {
+			_, err := searchBase(conn, keyDN(sshPubKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "Expected noSuchObject, got %v", err)
+		})
+
+		t.Run("Key is accepted again once unrevoked", func(t *testing.T) {
+			if err := os.WriteFile(blocklist, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(list.Reload())
+
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+
+			result, err := searchBase(conn, keyDN(sshPubKey))
+			assert.NoError(err)
+			assert.Len(result.Entries, 1)
+		})
+
+		t.Run("Revoking a key ends its session", func(t *testing.T) {
+			if err := os.WriteFile(blocklist, ssh.MarshalAuthorizedKey(sshPubKey), 0644); err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(list.Reload())
+
+			_, err := searchBase(conn, keyDN(sshPubKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "Expected insufficientAccessRights, got %v", err)
+
+			// The session is over, so the client is anonymous from now on
+			_, err = conn.WhoAmI(nil)
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultOperationsError), "Expected operationsError, got %v", err)
+		})
+	})
+}
+
+func TestAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		allowed := filepath.Join(t.TempDir(), "allowed_keys")
+		line := `groups="staff" ` + string(ssh.MarshalAuthorizedKey(sshPubKey))
+		if err := os.WriteFile(allowed, []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := allowlist.Load(allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := startTestServer(t, WithAllowlist(list))
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, outsiderKey, _, err := ssh_helpers.GenerateKeys(1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("Listed key can bind", func(t *testing.T) {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+		})
+
+		t.Run("Unlisted key cannot bind", func(t *testing.T) {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(outsiderKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), "Expected invalidCredentials, got %v", err)
+		})
+
+		t.Run("Listed key has its groups", func(t *testing.T) {
+			result, err := searchBase(conn, keyDN(sshPubKey))
+			assert.NoError(err)
+			if assert.Len(result.Entries, 1) {
+				assert.Equal([]string{"cn=staff,ou=groups,dc=0_1_0,dc=bivvi"}, result.Entries[0].GetAttributeValues("memberOf"))
+			}
+		})
+
+		t.Run("Unlisted key is hidden from search", func(t *testing.T) {
+			_, err := searchBase(conn, keyDN(outsiderKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "Expected noSuchObject, got %v", err)
+		})
+	})
+}
+
+func TestInvitations(t *testing.T) {
+	assert := assert.New(t)
+
+	adminSigner, _, _, err := ssh_helpers.GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsiderSigner, _, _, err := ssh_helpers.GenerateKeys(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed_keys")
+	admins := filepath.Join(dir, "admin_keys")
+	if err := os.WriteFile(allowed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(admins, ssh.MarshalAuthorizedKey(adminSigner.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allowList, err := allowlist.Load(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminList, err := allowlist.Load(admins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := invite.NewMemoryStore()
+
+	addr := startTestServer(t, WithAllowlist(allowList), WithInvitations("camp", adminList, store))
+
+	token, _, err := invite.Mint(adminSigner, "camp", 1, time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedToken, _, err := invite.Mint(outsiderSigner, "camp", 1, time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	elsewhereToken, _, err := invite.Mint(adminSigner, "festival", 1, time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		bind := func(password string) error {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: password,
+			})
+			return err
+		}
+		hostPort := fmt.Sprintf("127.0.0.1:%d", sshPort)
+
+		t.Run("Newcomer without invitation is refused", func(t *testing.T) {
+			assert.Error(bind(hostPort))
+		})
+
+		t.Run("Invitation from a non-admin is refused", func(t *testing.T) {
+			assert.Error(bind(hostPort + " " + forgedToken))
+			assert.Empty(store.Redemptions())
+		})
+
+		t.Run("Invitation to another network is refused", func(t *testing.T) {
+			assert.Error(bind(hostPort + " " + elsewhereToken))
+			assert.Empty(store.Redemptions())
+		})
+
+		t.Run("Newcomer with invitation is admitted", func(t *testing.T) {
+			assert.NoError(bind(hostPort + " " + token))
+			if assert.Len(store.Redemptions(), 1) {
+				assert.Equal(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPubKey))), store.Redemptions()[0].Key)
+			}
+		})
+
+		t.Run("Admitted key no longer needs the invitation", func(t *testing.T) {
+			assert.NoError(bind(hostPort))
+			result, err := searchBase(conn, keyDN(sshPubKey))
+			assert.NoError(err)
+			assert.Len(result.Entries, 1)
+		})
+
+		t.Run("Expired allowlist entry is not overridden by the invitation", func(t *testing.T) {
+			line := `expiry-time="20200101" ` + string(ssh.MarshalAuthorizedKey(sshPubKey))
+			if err := os.WriteFile(allowed, []byte(line), 0644); err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(allowList.Reload())
+
+			assert.Error(bind(hostPort))
+			assert.Error(bind(hostPort+" "+token), "Nor can it be invited back in")
+			_, err := searchBase(conn, keyDN(sshPubKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "Expected noSuchObject, got %v", err)
+		})
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	reg, err := registry.Open(filepath.Join(t.TempDir(), "registry.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	addr := startTestServer(t, WithRegistry(reg))
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		t.Run("Failed bind is not recorded", func(t *testing.T) {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: "127.0.0.1:1",
+			})
+			assert.Error(err)
+			assert.Empty(reg.List())
+		})
+
+		t.Run("Successful binds are recorded", func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+					Username: keyDN(sshPubKey),
+					Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+				})
+				assert.NoError(err)
+			}
+
+			record, ok := reg.Get(sshPubKey)
+			if assert.True(ok, "Key should be in the registry") {
+				assert.Equal(fmt.Sprintf("127.0.0.1:%d", sshPort), record.LastAddr)
+				assert.Equal(2, record.Binds)
+				assert.False(record.FirstSeen.After(record.LastSeen))
+			}
+		})
+	})
+}
+
+func TestCollisions(t *testing.T) {
+	assert := assert.New(t)
+
+	otherKey, err := testutils.GetRandomPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plant makes otherKey a known key with the same identity as pubKey
+	plant := func(reg *registry.Registry, pubKey ssh.PublicKey) {
+		attrs := derived.FromPublicKey(pubKey)
+		_, err := reg.Update(otherKey, func(record *registry.Record) error {
+			record.DisplayName = attrs.DisplayName("en")
+			record.PhoneNumber = attrs.PhoneNumber()
+			record.UidNumber = attrs.PosixUserID()
+			record.Derivation = NewServer("", nil).derivation()
+			return nil
+		}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	suffixRegistry := registry.NewInMemory()
+	var mu sync.Mutex
+	var collisions []Collision
+	reported := func() []Collision {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Collision{}, collisions...)
+	}
+	suffixAddr := startTestServer(t, WithRegistry(suffixRegistry), WithCollisionReporter(func(c Collision) {
+		mu.Lock()
+		defer mu.Unlock()
+		collisions = append(collisions, c)
+	}))
+
+	rejectRegistry := registry.NewInMemory()
+	rejectAddr := startTestServer(t, WithRegistry(rejectRegistry), WithCollisionPolicy(RejectCollisions))
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		plant(suffixRegistry, sshPubKey)
+		plant(rejectRegistry, sshPubKey)
+		attrs := derived.FromPublicKey(sshPubKey)
+
+		t.Run("Newcomer gets a suffix", func(t *testing.T) {
+			conn, err := ldap.Dial("tcp", suffixAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+
+			record, ok := suffixRegistry.Get(sshPubKey)
+			if assert.True(ok) {
+				assert.Equal(&derived.Suffixes{UIDNumber: 2, TelephoneNumber: 2, DisplayName: 2}, record.Suffixes)
+				assert.Equal(attrs.DisplayName("en")+"2", record.DisplayName)
+				assert.True(derived.KeyBits(sshPubKey).Equals(record.KeyBits), "Key bits are stored with the identity")
+			}
+			assert.Len(reported(), 3, "uidNumber, telephoneNumber and displayName should be reported")
+			for _, c := range reported() {
+				assert.Equal(ssh.FingerprintSHA256(otherKey), c.Existing)
+				assert.Equal(ssh.FingerprintSHA256(sshPubKey), c.Newcomer)
+				assert.Equal("suffix 2", c.Resolution)
+			}
+
+			result, err := searchBase(conn, keyDN(sshPubKey))
+			if assert.NoError(err) && assert.Len(result.Entries, 1) {
+				entry := result.Entries[0]
+				assert.Equal(attrs.DisplayName("en")+"2", entry.GetAttributeValue("displayName"))
+				assert.Equal(strconv.Itoa(attrs.PosixUserID()+1), entry.GetAttributeValue("uidNumber"))
+			}
+		})
+
+		t.Run("Suffix is kept on later binds", func(t *testing.T) {
+			conn, err := ldap.Dial("tcp", suffixAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+			assert.Len(reported(), 3, "A known key should not be checked again")
+			record, _ := suffixRegistry.Get(sshPubKey)
+			assert.Equal(&derived.Suffixes{UIDNumber: 2, TelephoneNumber: 2, DisplayName: 2}, record.Suffixes)
+		})
+
+		t.Run("Stale identity is checked again", func(t *testing.T) {
+			_, err := suffixRegistry.Update(sshPubKey, func(record *registry.Record) error {
+				record.Derivation = "settings of old"
+				record.Suffixes = nil
+				return nil
+			}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := ldap.Dial("tcp", suffixAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+			assert.Len(reported(), 6, "Re-deriving a known key should check it again")
+			record, _ := suffixRegistry.Get(sshPubKey)
+			assert.Equal(&derived.Suffixes{UIDNumber: 2, TelephoneNumber: 2, DisplayName: 2}, record.Suffixes,
+				"Re-derived identity should be set apart again")
+		})
+
+		t.Run("Identity of unknown derivation is derived afresh", func(t *testing.T) {
+			s := NewServer("", nil)
+			record := &registry.Record{Key: registry.NormalizeKey(otherKey), DisplayName: "forged", UidNumber: 1001, PhoneNumber: "81"}
+			existing, ok := s.identityOfRecord(record)
+			if assert.True(ok) {
+				assert.Equal(s.identityOf(otherKey, derived.Suffixes{}), existing)
+			}
+		})
+
+		t.Run("Names collide in every scheme and language", func(t *testing.T) {
+			s := NewServer("", nil)
+			latest := s.schemes[len(s.schemes)-1]
+			s.identities.set("other", "SHA256:other", []identityValue{
+				{"displayName;lang-ja", attrs.DisplayName("ja"), s.primaryScheme()},
+				{"displayName", strings.ToUpper(latest.Derive(sshPubKey).DisplayName("en")), latest},
+			})
+			found := s.findCollisions(sshPubKey, attrs)
+			if assert.Len(found, 2) {
+				assert.Equal("displayName;lang-ja", found[0].Attribute)
+				assert.Equal(s.primaryScheme().Version, found[0].Scheme)
+				assert.Equal("SHA256:other", found[0].Existing)
+				assert.Equal("displayName", found[1].Attribute)
+				assert.Equal(latest.Version, found[1].Scheme)
+			}
+
+			elsewhere := NewServer("", nil)
+			elsewhere.identities.set("other", "SHA256:other", []identityValue{
+				{"displayName;lang-ja", attrs.DisplayName("ja"), latest},
+			})
+			assert.Empty(elsewhere.findCollisions(sshPubKey, attrs), "Names only collide within a scheme")
+
+			disambiguated, err := s.disambiguate(sshPubKey, attrs, found, time.Now())
+			if assert.NoError(err) {
+				assert.NotEqual(attrs.DisplayName("ja"), disambiguated.DisplayName("ja"))
+				assert.Equal(attrs.PosixUserID(), disambiguated.PosixUserID(), "Only the name should change")
+			}
+		})
+
+		t.Run("Stored identities replace indexed ones", func(t *testing.T) {
+			s := NewServer("", nil, WithRegistry(registry.NewInMemory()))
+			other := s.derive(otherKey, s.primaryScheme())
+			holders := func(uidNumber int) map[string]bool {
+				return s.identities.holders[identityValue{"uidNumber", strconv.Itoa(uidNumber), nil}.key()]
+			}
+
+			assert.True(s.storeIdentity(otherKey, other, time.Now()))
+			assert.Equal(map[string]bool{registry.NormalizeKey(otherKey): true}, holders(other.PosixUserID()))
+
+			suffixed := other.Disambiguate("uidNumber", 2)
+			assert.True(s.storeIdentity(otherKey, suffixed, time.Now()))
+			assert.Empty(holders(other.PosixUserID()), "The old uidNumber is free again")
+			assert.Equal(map[string]bool{registry.NormalizeKey(otherKey): true}, holders(suffixed.PosixUserID()))
+		})
+
+		t.Run("Newcomer is rejected", func(t *testing.T) {
+			conn, err := ldap.Dial("tcp", rejectAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+			_, ok := rejectRegistry.Get(sshPubKey)
+			assert.False(ok, "Rejected key should not be recorded")
+		})
+	})
+}
+
+func TestIDRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	otherKey, err := testutils.GetRandomPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uids := derived.IDRange{Min: 5000, Max: 5001}
+	gids := derived.IDRange{Min: 7000, Max: 7999}
+	reg := registry.NewInMemory()
+	addr := startTestServer(t, WithRegistry(reg), WithUIDRange(uids), WithGIDRange(gids))
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		attrs := derived.FromPublicKey(sshPubKey).WithIDRanges(&uids, &gids)
+
+		// otherKey already holds the uid the newcomer maps to
+		other := derived.FromPublicKey(otherKey)
+		_, err := reg.Update(otherKey, func(record *registry.Record) error {
+			record.DisplayName = other.DisplayName("en")
+			record.PhoneNumber = other.PhoneNumber()
+			record.UidNumber = attrs.PosixUserID()
+			record.GidNumber = 7999 - attrs.PosixGroupID() + 7000 // mirrored, so never the same
+			record.Derivation = NewServer("", nil, WithUIDRange(uids), WithGIDRange(gids)).derivation()
+			return nil
+		}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+			Username: keyDN(sshPubKey),
+			Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+		})
+		assert.NoError(err)
+
+		result, err := searchBase(conn, keyDN(sshPubKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			uid, _ := strconv.Atoi(entry.GetAttributeValue("uidNumber"))
+			gid, _ := strconv.Atoi(entry.GetAttributeValue("gidNumber"))
+			assert.True(uids.Contains(uint32(uid)), "uidNumber %d should be in %s", uid, uids)
+			assert.NotEqual(attrs.PosixUserID(), uid, "Taken uid should be probed past")
+			assert.True(gids.Contains(uint32(gid)), "gidNumber %d should be in %s", gid, gids)
+			assert.Equal(attrs.DisplayName("en"), entry.GetAttributeValue("displayName"), "Only the uid collided")
+			assert.Equal(attrs.PhoneNumber(), entry.GetAttributeValue("telephoneNumber"), "Only the uid collided")
+		}
+		record, _ := reg.Get(sshPubKey)
+		assert.Equal(&derived.Suffixes{UIDNumber: 2}, record.Suffixes)
+	})
+}
+
+func TestSchemes(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := startTestServer(t, WithSchemes(derived.V0_1_0))
+	conn, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Root DSE lists naming contexts", func(t *testing.T) {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			"",
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			nil,
+			nil,
+		))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			assert.Equal([]string{"dc=0_1_0,dc=bivvi"}, entry.GetAttributeValues("namingContexts"))
+			assert.Equal("dc=0_1_0,dc=bivvi", entry.GetAttributeValue("defaultNamingContext"))
+			assert.Equal("3", entry.GetAttributeValue("supportedLDAPVersion"))
+			assert.Equal("global", entry.GetAttributeValue("lilidapIdentity"))
+			assert.Empty(entry.GetAttributeValue("lilidapSaltID"))
+		}
+	})
+
+	t.Run("Served version is found", func(t *testing.T) {
+		result, err := searchBase(conn, keyDN(testKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			assert.Equal(derived.V0_1_0.Derive(testKey).Username(), result.Entries[0].GetAttributeValue("uid"))
+		}
+	})
+
+	t.Run("Unknown version is refused", func(t *testing.T) {
+		dn := strings.Replace(keyDN(testKey), "dc=0_1_0", "dc=9_9_9", 1)
+		_, err := searchBase(conn, dn)
+		assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidDNSyntax))
+
+		_, err = conn.SimpleBind(&ldap.SimpleBindRequest{Username: dn, Password: "127.0.0.1:22"})
+		if assert.Error(err) {
+			assert.Contains(err.Error(), "dc=9_9_9 is not served here")
+		}
+	})
+}
+
+func TestSalt(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.NewInMemory()
+	if _, err := reg.Touch(testKey, "10.0.0.1:22", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// entryOn looks the test key up anonymously on a network with a salt
+	entryOn := func(salt string) *ldap.Entry {
+		conn, err := ldap.Dial("tcp", startTestServer(t, WithRegistry(reg), WithSchemes(derived.V0_1_0), WithSalt([]byte(salt)), WithEntryNaming(NameByUID)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		pseudonym := derived.V0_1_0.Derive(testKey).WithSalt([]byte(salt))
+		result, err := searchBase(conn, fmt.Sprintf("uid=%s,ou=campers,dc=0_1_0,dc=bivvi", pseudonym.Username()))
+		if !assert.NoError(err) || !assert.Len(result.Entries, 1) {
+			t.FailNow()
+		}
+		return result.Entries[0]
+	}
+	salt := "camp-2026"
+
+	t.Run("Root DSE says identities are pseudonymous", func(t *testing.T) {
+		conn, err := ldap.Dial("tcp", startTestServer(t, WithSalt([]byte(salt))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		result, err := searchBase(conn, "")
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			assert.Equal("pseudonymous", entry.GetAttributeValue("lilidapIdentity"))
+			assert.Empty(entry.GetAttributeValue("lilidapSaltID"), "A salt ID would let anyone check guesses at the salt")
+		}
+	})
+
+	t.Run("Entries carry the pseudonyms", func(t *testing.T) {
+		global := derived.V0_1_0.Derive(testKey)
+		pseudonym := global.WithSalt([]byte(salt))
+		entry := entryOn(salt)
+		assert.Equal(pseudonym.Username(), entry.GetAttributeValue("uid"))
+		assert.Equal(pseudonym.DisplayName("en"), entry.GetAttributeValue("displayName"))
+		assert.Equal(pseudonym.PhoneNumber(), entry.GetAttributeValue("telephoneNumber"))
+	})
+
+	t.Run("Pseudonyms cannot be linked", func(t *testing.T) {
+		global := derived.V0_1_0.Derive(testKey)
+		here, there := entryOn(salt), entryOn("other-camp")
+		for _, attribute := range []string{"uid", "uidNumber", "displayName", "cn", "telephoneNumber", "accentColor"} {
+			assert.NotEqual(here.GetAttributeValue(attribute), there.GetAttributeValue(attribute), attribute)
+		}
+		assert.NotEqual(global.Username(), here.GetAttributeValue("uid"))
+		assert.NotContains(here.DN, registry.NormalizeKey(testKey))
+		for _, attribute := range []string{"sshPublicKey", "sshKeyFingerprint", "fingerprintWords"} {
+			assert.Empty(here.GetAttributeValues(attribute), "%s is the same on every network", attribute)
+		}
+	})
+
+	t.Run("Keys do not find their pseudonyms", func(t *testing.T) {
+		// Whoever holds a key from elsewhere could tie it to its pseudonym
+		for _, naming := range []EntryNaming{NameByUID, NameByKey} {
+			conn, err := ldap.Dial("tcp", startTestServer(t, WithRegistry(reg), WithSchemes(derived.V0_1_0), WithSalt([]byte(salt)), WithEntryNaming(naming)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			bases := []string{fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(testKey))}
+			if naming != NameByKey {
+				bases = append(bases, keyDN(testKey)) // not where the entry is published
+			}
+			for _, base := range bases {
+				_, err = searchBase(conn, base)
+				assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "%s with entries named by %s", base, naming)
+			}
+		}
+	})
+}
+
+func TestHiddenKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.NewInMemory()
+	if _, err := reg.Touch(testKey, "10.0.0.1:22", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	attrs := derived.V0_1_0.Derive(testKey)
+	uidDN := fmt.Sprintf("uid=%s,ou=campers,dc=0_1_0,dc=bivvi", attrs.Username())
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		services := filepath.Join(t.TempDir(), "services")
+		if err := os.WriteFile(services, ssh.MarshalAuthorizedKey(sshPubKey), 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := allowlist.Load(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		connect := func(opts ...Option) *ldap.Conn {
+			conn, err := ldap.Dial("tcp", startTestServer(t, append([]Option{WithRegistry(reg), WithSchemes(derived.V0_1_0)}, opts...)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		bind := func(conn *ldap.Conn) {
+			_, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+		}
+		find := func(conn *ldap.Conn, base string) *ldap.Entry {
+			result, err := searchBase(conn, base)
+			if !assert.NoError(err, base) || !assert.Len(result.Entries, 1, base) {
+				return &ldap.Entry{}
+			}
+			return result.Entries[0]
+		}
+
+		t.Run("Anonymous readers see pseudonymous DNs and no keys", func(t *testing.T) {
+			conn := connect(WithEntryNaming(NameByUID))
+			result, err := conn.Search(ldap.NewSearchRequest("ou=campers,dc=0_1_0,dc=bivvi",
+				ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, fmt.Sprintf("(uid=%s)", attrs.Username()), nil, nil))
+			if assert.NoError(err) && assert.Len(result.Entries, 1) {
+				entry := result.Entries[0]
+				assert.Equal(uidDN, entry.DN)
+				assert.NotContains(entry.GetAttributeValues("objectClass"), "ldapPublicKey")
+				for _, attribute := range []string{"sshPublicKey", "sshKeyFingerprint", "sshKeyType", "fingerprintWords"} {
+					assert.Empty(entry.GetAttributeValues(attribute), "%s gives the key away", attribute)
+				}
+			}
+
+			for _, base := range []string{uidDN, strings.ToUpper(uidDN[:4]) + uidDN[4:],
+				fmt.Sprintf("cn=%s,ou=campers,dc=0_1_0,dc=bivvi", attrs.DisplayName("en"))} {
+				entry := find(conn, base)
+				assert.Equal(uidDN, entry.DN, "%s is published under its uid", base)
+				assert.Empty(entry.GetAttributeValue("sshPublicKey"), base)
+			}
+			// Looking a key up would tell whether it has an identity here
+			for _, base := range []string{keyDN(testKey), fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(testKey))} {
+				_, err = searchBase(conn, base)
+				assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), base)
+			}
+
+			for _, probe := range []string{"(sshPublicKey=*)", "(sshKeyFingerprint=" + ssh.FingerprintSHA256(testKey) + ")", "(sshKeyType=*)", "(fingerprintWords=*)"} {
+				result, err = conn.Search(ldap.NewSearchRequest("ou=campers,dc=0_1_0,dc=bivvi",
+					ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, fmt.Sprintf("(&(uid=%s)%s)", attrs.Username(), probe), nil, nil))
+				if assert.NoError(err) {
+					assert.Empty(result.Entries, "Keys cannot be probed with %s", probe)
+				}
+			}
+			_, err = searchBase(conn, "uid=unobody,ou=campers,dc=0_1_0,dc=bivvi")
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject))
+		})
+
+		t.Run("Owners see their own key", func(t *testing.T) {
+			conn := connect(WithEntryNaming(NameByUID))
+			bind(conn)
+			own := find(conn, keyDN(sshPubKey))
+			assert.Equal(registry.NormalizeKey(sshPubKey), own.GetAttributeValue("sshPublicKey"))
+			assert.Equal(ssh.FingerprintSHA256(sshPubKey), own.GetAttributeValue("sshKeyFingerprint"))
+			assert.NotEmpty(own.GetAttributeValue("fingerprintWords"))
+			assert.Contains(own.GetAttributeValues("objectClass"), "ldapPublicKey")
+			assert.Empty(find(conn, uidDN).GetAttributeValue("sshPublicKey"), "Nobody else's")
+			_, err := searchBase(conn, keyDN(testKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "Nor can they look other keys up")
+		})
+
+		t.Run("Service accounts see every key", func(t *testing.T) {
+			conn := connect(WithEntryNaming(NameByUID), WithServiceAccounts(list))
+			bind(conn)
+			assert.Equal(registry.NormalizeKey(testKey), find(conn, uidDN).GetAttributeValue("sshPublicKey"))
+			assert.Equal(uidDN, find(conn, keyDN(testKey)).DN, "sshd looks keys up by key")
+			assert.Equal(uidDN, find(conn, fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(testKey))).DN)
+		})
+
+		t.Run("Fingerprint naming", func(t *testing.T) {
+			conn := connect(WithEntryNaming(NameByFingerprint))
+			fingerprintDN := fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(testKey))
+			assert.Equal(fingerprintDN, find(conn, uidDN).DN)
+			assert.Equal(fingerprintDN, find(conn, fingerprintDN).DN)
+
+			// Base64 fingerprints may hold a +, which joins RDNs unless escaped
+			var plusKey ssh.PublicKey
+			for i := 0; plusKey == nil; i++ {
+				seed := make([]byte, ed25519.SeedSize)
+				binary.BigEndian.PutUint32(seed, uint32(i))
+				pubKey, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+				require.NoError(t, err)
+				if strings.Contains(ssh.FingerprintSHA256(pubKey), "+") {
+					plusKey = pubKey
+				}
+			}
+			if _, err := reg.Touch(plusKey, "10.0.0.2:22", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			fingerprint := ssh.FingerprintSHA256(plusKey)
+			escapedDN := fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", strings.ReplaceAll(fingerprint, "+", `\+`))
+			_, err := searchBase(conn, keyDN(plusKey))
+			assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject), "Keys stay hidden")
+			for _, base := range []string{escapedDN, strings.ReplaceAll(escapedDN, `\+`, `\2B`),
+				fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", fingerprint)} {
+				assert.Equal(escapedDN, find(conn, base).DN, base)
+			}
+		})
+
+		t.Run("Keys are public by default", func(t *testing.T) {
+			conn := connect()
+			entry := find(conn, uidDN)
+			assert.Equal(keyDN(testKey), entry.DN)
+			assert.Equal(registry.NormalizeKey(testKey), entry.GetAttributeValue("sshPublicKey"))
+		})
+	})
+
+	t.Run("WhoAmI and safety numbers use published DNs", func(t *testing.T) {
+		s := NewServer("localhost:0", nil, WithRegistry(reg), WithEntryNaming(NameByUID))
+		assert.Equal(uidDN, s.publishedDN(keyDN(testKey)))
+		assert.Equal(keyDN(testKey), NewServer("localhost:0", nil).publishedDN(keyDN(testKey)))
+
+		otherKey, err := testutils.GetRandomPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The number would confirm a guess at the hidden key
+		_, code, err := s.safetyNumber(keyDN(otherKey), uidDN)
+		assert.Error(err)
+		assert.Equal(ldap.LDAPResultInsufficientAccessRights, code)
+		// Keys and fingerprints look like those nobody has
+		for _, target := range []string{keyDN(testKey), fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(testKey)),
+			fmt.Sprintf("sshKeyFingerprint=%s,ou=campers,dc=0_1_0,dc=bivvi", ssh.FingerprintSHA256(otherKey))} {
+			_, code, err = s.safetyNumber(keyDN(otherKey), target)
+			assert.Error(err)
+			assert.Equal(ldap.LDAPResultNoSuchObject, code, target)
+		}
+
+		services := filepath.Join(t.TempDir(), "services")
+		if err := os.WriteFile(services, ssh.MarshalAuthorizedKey(otherKey), 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := allowlist.Load(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = NewServer("localhost:0", nil, WithRegistry(reg), WithEntryNaming(NameByUID), WithServiceAccounts(list))
+		number, _, err := s.safetyNumber(keyDN(otherKey), uidDN)
+		if assert.NoError(err, "Service accounts see every key anyway") {
+			assert.Equal(derived.SafetyNumber(otherKey, testKey), number)
+		}
+	})
+
+	t.Run("Entry naming flag", func(t *testing.T) {
+		for _, naming := range []EntryNaming{NameByKey, NameByUID, NameByFingerprint} {
+			parsed, err := ParseEntryNaming(naming.String())
+			assert.NoError(err)
+			assert.Equal(naming, parsed)
+		}
+		_, err := ParseEntryNaming("cn")
+		assert.Error(err)
+	})
+}
+
+func TestDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := testutils.GetRandomPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registry.NewInMemory()
+	for _, key := range []ssh.PublicKey{testKey, otherKey} {
+		if _, err := reg.Touch(key, "127.0.0.1:22", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startTestServer(t, WithRegistry(reg), WithAnonymousListing())
+	conn, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	search := func(base string, scope int, filter string) []*ldap.Entry {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			base,
+			scope, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			nil,
+			nil,
+		))
+		if !assert.NoError(err) {
+			return nil
+		}
+		return result.Entries
+	}
+
+	v1 := derived.V0_1_0.Derive(testKey)
+	v2 := derived.V0_2_0.Derive(testKey)
+
+	t.Run("Subtree search lists containers and campers", func(t *testing.T) {
+		entries := search("dc=0_2_0,dc=bivvi", ldap.ScopeWholeSubtree, "(objectClass=*)")
+		assert.Len(entries, 4)
+		entries = search("dc=0_2_0,dc=bivvi", ldap.ScopeSingleLevel, "(objectClass=*)")
+		if assert.Len(entries, 1) {
+			assert.Equal("ou=campers,dc=0_2_0,dc=bivvi", entries[0].DN)
+		}
+	})
+
+	t.Run("Anonymous clients only look campers up", func(t *testing.T) {
+		closed, err := ldap.Dial("tcp", startTestServer(t, WithRegistry(reg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closed.Close()
+
+		for filter, want := range map[string]int{
+			"(objectClass=*)": 0,
+			"(uid=*)":         0,
+			fmt.Sprintf("(displayName=%s*)", v1.DisplayName("en")[:4]):                0,
+			fmt.Sprintf("(|(uid=%s)(uidNumber>=0))", v1.Username()):                   0,
+			fmt.Sprintf("(uid=%s)", v1.Username()):                                    1,
+			fmt.Sprintf("(&(objectClass=posixAccount)(cn=%s))", v1.DisplayName("en")): 1,
+			fmt.Sprintf("(|(uid=%s)(displayName=nobody))", v1.Username()):             1,
+		} {
+			result, err := closed.Search(ldap.NewSearchRequest("ou=campers,dc=0_1_0,dc=bivvi",
+				ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, filter, nil, nil))
+			if assert.NoError(err, filter) {
+				assert.Len(result.Entries, want, filter)
+			}
+		}
+	})
+
+	t.Run("Find by uid", func(t *testing.T) {
+		entries := search("ou=campers,dc=0_2_0,dc=bivvi", ldap.ScopeSingleLevel, fmt.Sprintf("(uid=%s)", v2.Username()))
+		if assert.Len(entries, 1) {
+			assert.Equal(strings.Replace(keyDN(testKey), "0_1_0", "0_2_0", 1), entries[0].DN)
+		}
+	})
+
+	t.Run("Find by uid typed with confusables", func(t *testing.T) {
+		typed := strings.ToUpper(strings.NewReplacer("o", "0", "1", "l").Replace(v2.Username()))
+		entries := search("ou=campers,dc=0_2_0,dc=bivvi", ldap.ScopeSingleLevel, fmt.Sprintf("(uid=%s)", typed))
+		if assert.Len(entries, 1, "%s should find %s", typed, v2.Username()) {
+			assert.Equal(v2.Username(), entries[0].GetAttributeValue("uid"))
+		}
+	})
+
+	t.Run("Filters combine", func(t *testing.T) {
+		name := v1.DisplayName("en")
+		entries := search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeWholeSubtree,
+			fmt.Sprintf("(&(objectClass=posixAccount)(displayName=%s*)(!(uid=nobody)))", name[:4]))
+		if assert.NotEmpty(entries) {
+			assert.Equal(v1.Username(), entries[0].GetAttributeValue("uid"))
+		}
+		assert.Empty(search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeWholeSubtree, "(uid=nobody)"))
+		assert.Len(search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeWholeSubtree,
+			fmt.Sprintf("(|(uid=%s)(uidNumber>=0))", v1.Username())), 2)
+	})
+
+	t.Run("Find by display name", func(t *testing.T) {
+		for _, filter := range []string{
+			fmt.Sprintf("(displayName=%s)", v1.DisplayName("en")),
+			fmt.Sprintf("(displayName;lang-ja=%s)", v1.DisplayName("ja")),
+			fmt.Sprintf("(cn=%s)", strings.ToUpper(v1.DisplayName("en"))),
+			fmt.Sprintf("(&(objectClass=posixAccount)(displayName;lang-zh=%s))", v1.DisplayName("zh")),
+			fmt.Sprintf("(|(displayName=%s)(cn=nobody))", v1.DisplayName("en")),
+		} {
+			entries := search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeSingleLevel, filter)
+			if assert.Len(entries, 1, filter) {
+				assert.Equal(keyDN(testKey), entries[0].DN)
+			}
+		}
+		assert.Empty(search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeSingleLevel, "(displayName=nobody)"))
+	})
+
+	t.Run("Display name filters narrow the search", func(t *testing.T) {
+		s := NewServer("localhost:0", nil, WithRegistry(reg), WithAnonymousListing())
+		name := v1.DisplayName("en")
+		for f, want := range map[string]int{
+			fmt.Sprintf("(displayName=%s)", name):           1,
+			fmt.Sprintf("(&(uid=*)(cn=%s))", name):          1,
+			"(displayName=nobody)":                          0,
+			fmt.Sprintf("(|(displayName=%s)(uid=x))", name): 2,
+			fmt.Sprintf("(!(displayName=%s))", name):        2,
+			fmt.Sprintf("(displayName=%s*)", name[:4]):      2,
+		} {
+			assert.Len(s.campers(derived.V0_1_0, compileFilter(t, f), nil, false), want, f)
+		}
+	})
+
+	t.Run("Friendly-name DN", func(t *testing.T) {
+		for _, name := range []string{v1.DisplayName("en"), v1.DisplayName("ko")} {
+			result, err := searchBase(conn, fmt.Sprintf("cn=%s,ou=campers,dc=0_1_0,dc=bivvi", name))
+			if assert.NoError(err) && assert.Len(result.Entries, 1) {
+				assert.Equal(keyDN(testKey), result.Entries[0].DN, "The entry is returned under its key DN")
+				assert.Equal(v1.Username(), result.Entries[0].GetAttributeValue("uid"))
+			}
+		}
+		_, err := searchBase(conn, "cn=nobody,ou=campers,dc=0_1_0,dc=bivvi")
+		assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject))
+	})
+
+	t.Run("Given name and surname", func(t *testing.T) {
+		v4 := derived.V0_4_0.Derive(testKey)
+		entries := search("ou=campers,dc=0_4_0,dc=bivvi", ldap.ScopeSingleLevel,
+			fmt.Sprintf("(displayName=%s)", v4.DisplayName("en")))
+		if assert.Len(entries, 1) {
+			e := entries[0]
+			assert.Equal(v4.GivenName("en")+" "+v4.Surname("en"), e.GetAttributeValue("displayName"))
+			assert.Equal(v4.GivenName("en"), e.GetAttributeValue("givenName"))
+			assert.Equal(v4.Surname("en"), e.GetAttributeValue("sn"))
+			assert.Equal(v1.DisplayName("en"), e.GetAttributeValue("cn"), "cn stays one word")
+			assert.Equal(v4.Surname("ko")+v4.GivenName("ko"), e.GetAttributeValue("displayName;lang-ko"))
+			assert.Equal(v4.GivenName("ja"), e.GetAttributeValue("givenName;lang-ja"))
+		}
+		entries = search("ou=campers,dc=0_1_0,dc=bivvi", ldap.ScopeSingleLevel, fmt.Sprintf("(cn=%s)", v1.DisplayName("en")))
+		if assert.Len(entries, 1) {
+			assert.Empty(entries[0].GetAttributeValue("givenName"), "Older versions have no givenName")
+		}
+
+		result, err := searchBase(conn, fmt.Sprintf("cn=%s,ou=campers,dc=0_4_0,dc=bivvi", v4.CommonName("en")))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			assert.Equal(v4.Username(), result.Entries[0].GetAttributeValue("uid"))
+		}
+	})
+
+	t.Run("Unknown context", func(t *testing.T) {
+		_, err := conn.Search(ldap.NewSearchRequest(
+			"dc=9_9_9,dc=bivvi",
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			nil,
+			nil,
+		))
+		assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject))
+	})
+}
+
+func TestPhoneFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	format := derived.PhoneFormat{Prefix: "7", Digits: 4, CheckDigit: true, CountryCode: "44"}
+	addr := startTestServer(t, WithPhoneFormat(format), WithSIPDomain("pbx.bivvi"))
+	conn, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := derived.FromPublicKey(testKey).WithPhoneFormat(format)
+
+	result, err := searchBase(conn, keyDN(testKey))
+	if assert.NoError(err) && assert.Len(result.Entries, 1) {
+		entry := result.Entries[0]
+		local := attrs.PhoneNumber()
+		assert.Len(local, 6)
+		assert.True(derived.LuhnValid(local), "%s should end with its check digit", local)
+		assert.Equal([]string{local, "+44" + local}, entry.GetAttributeValues("telephoneNumber"))
+		assert.Equal("sip:"+local+"@pbx.bivvi", entry.GetAttributeValue("sipURI"))
+		assert.Equal("sip:"+local+"@pbx.bivvi SIP", entry.GetAttributeValue("labeledURI"))
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Parse extension range", func(t *testing.T) {
+		r, err := ParseExtensionRange("200-999")
+		if assert.NoError(err) {
+			assert.Equal(ExtensionRange{200, 999}, r)
+		}
+		for _, bad := range []string{"200", "999-200", "0-99", "1000-1000000", "a-b"} {
+			_, err := ParseExtensionRange(bad)
+			assert.Error(err, bad)
+		}
+	})
+
+	t.Run("Extensions stay clear of derived numbers", func(t *testing.T) {
+		assert.NoError(ExtensionRange{200, 799}.CheckDialPlan(derived.DefaultPhoneFormat))
+		assert.NoError(ExtensionRange{10, 79}.CheckDialPlan(derived.PhoneFormat{Prefix: "81"}))
+		for r, format := range map[ExtensionRange]derived.PhoneFormat{
+			{200, 899}: derived.DefaultPhoneFormat,      // 800 starts like derived numbers
+			{1, 9}:     derived.DefaultPhoneFormat,      // 8 is the prefix itself
+			{5, 9}:     {Prefix: "81"},                  // 8 starts the prefix
+			{200, 299}: {Prefix: "", Digits: 4},         // derived numbers could be anything
+			{20, 30}:   {Prefix: "2", CheckDigit: true}, // 20 to 29 start with 2
+		} {
+			assert.Error(r.CheckDialPlan(format), "%s with prefix %q", r, format.Prefix)
+		}
+		assert.True(ExtensionRange{200, 299}.Contains("250"))
+		for _, outside := range []string{"199", "300", "", "0250", "2a0"} {
+			assert.False(ExtensionRange{200, 299}.Contains(outside), outside)
+		}
+	})
+
+	otherKey, err := testutils.GetRandomPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.NewInMemory()
+	_, err = reg.Update(otherKey, func(record *registry.Record) error {
+		record.Extension = "200"
+		return nil
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, WithRegistry(reg), WithExtensions(ExtensionRange{200, 299}))
+
+	ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}, func(sshPubKey ssh.PublicKey, sshPort int) {
+		conn, err := ldap.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// An extension from an earlier, wider range is neither published nor kept
+		_, err = reg.Update(sshPubKey, func(record *registry.Record) error {
+			record.Extension = "950"
+			return nil
+		}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := searchBase(conn, keyDN(sshPubKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			numbers := result.Entries[0].GetAttributeValues("telephoneNumber")
+			assert.Equal([]string{derived.FromPublicKey(sshPubKey).PhoneNumber()}, numbers)
+		}
+
+		// Binding again keeps the extension given on the first bind
+		for i := 0; i < 2; i++ {
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			assert.NoError(err)
+			if record, ok := reg.Get(sshPubKey); assert.True(ok) {
+				assert.Equal("201", record.Extension, "200 is taken")
+			}
+		}
+
+		result, err = searchBase(conn, keyDN(sshPubKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			numbers := result.Entries[0].GetAttributeValues("telephoneNumber")
+			assert.Equal([]string{"201", derived.FromPublicKey(sshPubKey).PhoneNumber()}, numbers)
+		}
+	})
+}
+
+func TestKeyAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := startTestServer(t)
+	conn, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Entry keeps the baseline attributes", func(t *testing.T) {
+		// As served before schemes existed (commit 8d46c76)
+		result, err := searchBase(conn, keyDN(testKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			for attribute, value := range map[string]string{
+				"uid":                 "uakmyrvel",
+				"uidNumber":           "930577240884",
+				"gidNumber":           "1001",
+				"homeDirectory":       "/home/uakmyrvel",
+				"telephoneNumber":     "8930577239884",
+				"displayName":         "lutbousnifkeit",
+				"cn":                  "lutbousnifkeit",
+				"displayName;lang-en": "lutbousnifkeit",
+			} {
+				assert.Equal([]string{value}, entry.GetAttributeValues(attribute), attribute)
+			}
+			assert.Subset(entry.GetAttributeValues("objectClass"), []string{"inetOrgPerson", "posixAccount"})
+		}
+	})
+
+	t.Run("Entry carries the key", func(t *testing.T) {
+		result, err := searchBase(conn, keyDN(testKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			assert.Contains(entry.GetAttributeValues("objectClass"), "ldapPublicKey")
+			published, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry.GetAttributeValue("sshPublicKey")))
+			if assert.NoError(err) {
+				assert.Equal(testKey.Marshal(), published.Marshal())
+			}
+			assert.Equal(ssh.FingerprintSHA256(testKey), entry.GetAttributeValue("sshKeyFingerprint"))
+			assert.Equal(testKey.Type(), entry.GetAttributeValue("sshKeyType"))
+			assert.Equal(derived.FromPublicKey(testKey).WordFingerprint(), entry.GetAttributeValue("fingerprintWords"))
+		}
+	})
+
+	t.Run("Entry carries the avatar", func(t *testing.T) {
+		attrs := derived.FromPublicKey(testKey)
+		photo, err := attrs.Avatar().JPEG(photoSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, requested := range [][]string{{"*"}, {"jpegPhoto", "thumbnailPhoto"}, {"*"}} {
+			result, err := conn.Search(ldap.NewSearchRequest(keyDN(testKey), ldap.ScopeBaseObject,
+				ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", requested, nil))
+			if assert.NoError(err) && assert.Len(result.Entries, 1) {
+				entry := result.Entries[0]
+				assert.Equal(photo, entry.GetRawAttributeValue("jpegPhoto"), "%v", requested)
+				assert.True(bytes.HasPrefix(entry.GetRawAttributeValue("thumbnailPhoto"), []byte{0xFF, 0xD8}), "thumbnailPhoto should be a JPEG")
+			}
+		}
+
+		result, err := searchBase(conn, keyDN(testKey))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			entry := result.Entries[0]
+			assert.Empty(entry.GetRawAttributeValue("jpegPhoto"), "Photos are only sent when asked for")
+			assert.Empty(entry.GetRawAttributeValue("thumbnailPhoto"), "Photos are only sent when asked for")
+			assert.Equal(attrs.AccentColor(), entry.GetAttributeValue("accentColor"))
+		}
+	})
+
+	t.Run("Avatar cache is bounded", func(t *testing.T) {
+		avatar := *derived.FromPublicKey(testKey).Avatar()
+		cache := newPhotoCache()
+		for size := 0; size < photoCacheSize; size++ {
+			cache.put(avatarKey{avatar, size}, []byte(strconv.Itoa(size)))
+		}
+		_, ok := cache.get(avatarKey{avatar, 0})
+		assert.True(ok)
+
+		cache.put(avatarKey{avatar, photoCacheSize}, []byte("new"))
+		assert.Equal(photoCacheSize, cache.recent.Len())
+		_, ok = cache.get(avatarKey{avatar, 1})
+		assert.False(ok, "The least recently used photo is evicted")
+		photo, ok := cache.get(avatarKey{avatar, 0})
+		assert.True(ok, "A photo used again is kept")
+		assert.Equal([]byte("0"), photo)
+	})
+
+	t.Run("Subschema describes the attributes", func(t *testing.T) {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			"", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{"subschemaSubentry"}, nil,
+		))
+		if !assert.NoError(err) || !assert.Len(result.Entries, 1) {
+			return
+		}
+		subschema := result.Entries[0].GetAttributeValue("subschemaSubentry")
+		assert.Equal("cn=Subschema", subschema)
+
+		result, err = conn.Search(ldap.NewSearchRequest(
+			subschema, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=subschema)", []string{"attributeTypes", "objectClasses"}, nil,
+		))
+		if assert.NoError(err) && assert.Len(result.Entries, 1) {
+			types := strings.Join(result.Entries[0].GetAttributeValues("attributeTypes"), "\n")
+			for _, name := range []string{"sshPublicKey", "sshKeyFingerprint", "sshKeyType", "fingerprintWords"} {
+				assert.Contains(types, "NAME '"+name+"'")
+			}
+			assert.Contains(strings.Join(result.Entries[0].GetAttributeValues("objectClasses"), "\n"), "NAME 'ldapPublicKey'")
+		}
+	})
+}
+
+func TestAttributeMap(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping, err := attrmap.Parse([]byte("attributes:\n  mail: '{{.Username}}@camp.lan'\n  loginShell: /bin/sh\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, WithAttributeMap(mapping))
+	conn, err := ldap.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := derived.FromPublicKey(testKey)
+
+	result, err := searchBase(conn, keyDN(testKey))
+	if assert.NoError(err) && assert.Len(result.Entries, 1) {
+		entry := result.Entries[0]
+		assert.Equal(attrs.Username()+"@camp.lan", entry.GetAttributeValue("mail"))
+		assert.Equal("/bin/sh", entry.GetAttributeValue("loginShell"))
+		assert.Equal("/home/"+attrs.Username(), entry.GetAttributeValue("homeDirectory"), "Defaults should stay")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := testutils.GetRandomPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Computed from both DNs", func(t *testing.T) {
+		s := NewServer("localhost:0", nil)
+		number, code, err := s.safetyNumber(keyDN(testKey), keyDN(otherKey))
+		if assert.NoError(err) {
+			assert.Equal(ldap.LDAPResultSuccess, code)
+			assert.Equal(derived.SafetyNumber(testKey, otherKey), number)
+		}
+
+		_, code, err = s.safetyNumber(keyDN(testKey), keyDN(testKey))
+		assert.Error(err)
+		assert.Equal(ldap.LDAPResultUnwillingToPerform, code)
+
+		_, code, err = s.safetyNumber(keyDN(testKey), "cn=nobody,ou=campers,dc=0_1_0,dc=bivvi")
+		assert.Error(err)
+		assert.Equal(ldap.LDAPResultInvalidDNSyntax, code)
+	})
+
+	t.Run("Operation needs a bound user and a target", func(t *testing.T) {
+		conn, err := ldap.Dial("tcp", startTestServer(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Extended(ldap.NewExtendedRequest(safetyNumberOID, nil))
+		assert.True(ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights), "%v", err)
+	})
+
+	t.Run("Operation answers over the wire", func(t *testing.T) {
+		addr := startTestServer(t)
+		ssh_helpers.WithSSHServer(t, 1024, &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				return &ssh.Permissions{}, nil
+			},
+		}, func(sshPubKey ssh.PublicKey, sshPort int) {
+			conn, err := ldap.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.SimpleBind(&ldap.SimpleBindRequest{
+				Username: keyDN(sshPubKey),
+				Password: fmt.Sprintf("127.0.0.1:%d", sshPort),
+			})
+			if !assert.NoError(err) {
+				return
+			}
+
+			target := ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, keyDN(otherKey), "requestValue")
+			res, err := conn.Extended(ldap.NewExtendedRequest(safetyNumberOID, target))
+			if assert.NoError(err) {
+				assert.Equal(safetyNumberOID, res.Name)
+				if assert.NotNil(res.Value, "The safety number is the response value") {
+					assert.Equal(derived.SafetyNumber(sshPubKey, otherKey), res.Value.Data.String())
+				}
+			}
+		})
+	})
+}
+
+func TestDisplayNames(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := ldap.Dial("tcp", startTestServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testKey, err := testutils.GetTestPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := derived.FromPublicKey(testKey)
+
+	result, err := searchBase(conn, keyDN(testKey))
+	if assert.NoError(err) && assert.Len(result.Entries, 1) {
+		for _, lang := range []string{"en", "ja", "ko", "zh"} {
+			assert.Equal(attrs.DisplayName(lang), result.Entries[0].GetAttributeValue("displayName;lang-"+lang))
+		}
+		assert.Equal("农山中（55466）", result.Entries[0].GetAttributeValue("displayName;lang-zh"))
+	}
+}
@@ -0,0 +1,163 @@
+package ldapserver
+
+import (
+	"lilidap/internal/allowlist"
+	"lilidap/internal/attrmap"
+	"lilidap/internal/derived"
+	"lilidap/internal/derived/syllables"
+	"lilidap/internal/invite"
+	"lilidap/internal/registry"
+	"lilidap/internal/revocation"
+)
+
+// Option configures optional LDAPServer behaviour
+type Option func(*LDAPServer)
+
+// WithRevocationList rejects binds from, and hides entries of, revoked keys
+func WithRevocationList(list *revocation.List) Option {
+	return func(s *LDAPServer) {
+		s.revoked = list
+	}
+}
+
+// WithAllowlist turns on closed-community mode: only keys on the list may bind,
+// and only their entries can be found
+func WithAllowlist(list *allowlist.List) Option {
+	return func(s *LDAPServer) {
+		s.allowlist = list
+	}
+}
+
+// WithInvitations lets keys not on the allowlist in with an invitation token
+// to the named network signed by one of the admins, recording redemptions in
+// the store
+func WithInvitations(network string, admins *allowlist.List, store invite.Store) Option {
+	return func(s *LDAPServer) {
+		s.invites = &invitations{network: network, admins: admins, store: store}
+	}
+}
+
+// WithRegistry records verified keys in the given registry instead of in memory
+func WithRegistry(reg *registry.Registry) Option {
+	return func(s *LDAPServer) {
+		s.registry = reg
+	}
+}
+
+// WithAnonymousListing lets anonymous clients list every camper, rather than
+// only look up those whose uid or name they already know
+func WithAnonymousListing() Option {
+	return func(s *LDAPServer) {
+		s.anonymousListing = true
+	}
+}
+
+// WithCollisionPolicy sets what happens to newcomers whose derived identity
+// collides with that of a known key (SuffixCollisions by default)
+func WithCollisionPolicy(policy CollisionPolicy) Option {
+	return func(s *LDAPServer) {
+		s.collisionPolicy = policy
+	}
+}
+
+// WithCollisionReporter calls report for every collision detected, so that
+// admins can be told about it
+func WithCollisionReporter(report func(Collision)) Option {
+	return func(s *LDAPServer) {
+		s.onCollision = report
+	}
+}
+
+// WithUIDRange maps every uidNumber into the range, rather than adding
+// derived.LegacyUIDBase to the key bits
+func WithUIDRange(r derived.IDRange) Option {
+	return func(s *LDAPServer) {
+		s.uidRange = &r
+	}
+}
+
+// WithGIDRange gives every user their own gidNumber, mapped into the range,
+// instead of the shared derived.DefaultGID
+func WithGIDRange(r derived.IDRange) Option {
+	return func(s *LDAPServer) {
+		s.gidRange = &r
+	}
+}
+
+// WithSchemes serves only the given derivation schemes, each under its own
+// naming context (all published schemes by default). The first one is used
+// to detect collisions.
+func WithSchemes(schemes ...*derived.Scheme) Option {
+	return func(s *LDAPServer) {
+		if len(schemes) > 0 {
+			s.schemes = schemes
+		}
+	}
+}
+
+// WithPhoneFormat derives telephone numbers in the given format
+// (derived.DefaultPhoneFormat by default)
+func WithPhoneFormat(format derived.PhoneFormat) Option {
+	return func(s *LDAPServer) {
+		s.phoneFormat = format
+	}
+}
+
+// WithSIPDomain publishes every telephone number as a SIP address at the
+// domain, in the sipURI and labeledURI attributes
+func WithSIPDomain(domain string) Option {
+	return func(s *LDAPServer) {
+		s.sipDomain = domain
+	}
+}
+
+// WithExtensions gives every key a short extension from the range on its
+// first bind, kept in the registry and published as its first telephoneNumber
+func WithExtensions(r ExtensionRange) Option {
+	return func(s *LDAPServer) {
+		s.extensions = &r
+	}
+}
+
+// WithAttributeMap builds the templated attributes of user entries with the
+// mapping (attrmap.Default() by default)
+func WithAttributeMap(m *attrmap.Mapping) Option {
+	return func(s *LDAPServer) {
+		s.attributeMap = m
+	}
+}
+
+// WithSalt derives pseudonymous identities, unlinkable to those the same
+// keys have on other networks, from the keys' HMAC with the salt (the global
+// identity by default)
+func WithSalt(salt []byte) Option {
+	return func(s *LDAPServer) {
+		s.salt = salt
+	}
+}
+
+// WithEntryNaming publishes user entries under the uid or the fingerprint
+// instead of the full key (NameByKey by default), showing the key only to
+// its owner and to service accounts
+func WithEntryNaming(naming EntryNaming) Option {
+	return func(s *LDAPServer) {
+		s.naming = naming
+	}
+}
+
+// WithServiceAccounts lets the listed keys see every entry's full key, as
+// services like sshd's AuthorizedKeysCommand need, when entries are not
+// named by it
+func WithServiceAccounts(list *allowlist.List) Option {
+	return func(s *LDAPServer) {
+		s.serviceAccounts = list
+	}
+}
+
+// WithLanguages generates names in the given languages rather than only the
+// built-in ones
+func WithLanguages(languages *syllables.Registry) Option {
+	return func(s *LDAPServer) {
+		s.languages = languages
+	}
+}
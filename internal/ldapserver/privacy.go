@@ -0,0 +1,280 @@
+package ldapserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"lilidap/internal/derived"
+	"lilidap/internal/registry"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Entries are named by the full SSH key by default, which lets anyone who
+// can search harvest every key on the network and look for it elsewhere.
+// With WithEntryNaming they are published under the uid or the key's
+// fingerprint instead, and the key itself is only shown to its owner and to
+// service accounts, such as the sshd of hosts that look keys up for
+// AuthorizedKeysCommand. Binds still name the key, which is the credential.
+
+// EntryNaming decides the RDN user entries are published under
+type EntryNaming int
+
+const (
+	// NameByKey publishes entries under cn=<full key>, for everyone to see
+	NameByKey EntryNaming = iota
+	// NameByUID publishes entries under uid=<uid>
+	NameByUID
+	// NameByFingerprint publishes entries under sshKeyFingerprint=SHA256:...
+	NameByFingerprint
+)
+
+// ParseEntryNaming reads a naming as used on the command line
+func ParseEntryNaming(name string) (EntryNaming, error) {
+	switch name {
+	case "key":
+		return NameByKey, nil
+	case "uid":
+		return NameByUID, nil
+	case "fingerprint":
+		return NameByFingerprint, nil
+	}
+	return NameByKey, fmt.Errorf("unknown entry naming %q (want key, uid or fingerprint)", name)
+}
+
+func (n EntryNaming) String() string {
+	switch n {
+	case NameByUID:
+		return "uid"
+	case NameByFingerprint:
+		return "fingerprint"
+	}
+	return "key"
+}
+
+// entryDN returns the DN the entry of a key is published under
+func (s *LDAPServer) entryDN(pubKey ssh.PublicKey, attrs *derived.UserAttributes) string {
+	var rdn string
+	switch s.naming {
+	case NameByUID:
+		rdn = "uid=" + escapeRDNValue(attrs.Username())
+	case NameByFingerprint:
+		// Fingerprints are base64, whose + joins RDNs unless escaped
+		rdn = "sshKeyFingerprint=" + escapeRDNValue(ssh.FingerprintSHA256(pubKey))
+	default:
+		rdn = "cn=" + registry.NormalizeKey(pubKey)
+	}
+	return fmt.Sprintf("%s,ou=campers,dc=%s,dc=bivvi", rdn, attrs.Scheme().DC())
+}
+
+// publishedDN returns the DN the entry of a bound key DN is published under
+func (s *LDAPServer) publishedDN(boundDN string) string {
+	if s.naming == NameByKey {
+		return boundDN
+	}
+	cn, scheme, err := s.parseDN(boundDN)
+	if err != nil {
+		return boundDN
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cn))
+	if err != nil {
+		return boundDN
+	}
+	return s.entryDN(pubKey, s.attributesFor(pubKey, scheme))
+}
+
+// maySeeKey reports whether a client bound with viewer (nil if anonymous)
+// may see the full key of an entry
+func (s *LDAPServer) maySeeKey(viewer, pubKey ssh.PublicKey) bool {
+	if s.naming == NameByKey {
+		return true
+	}
+	if viewer == nil {
+		return false
+	}
+	return derived.SameKey(viewer, pubKey) || s.isServiceAccount(viewer)
+}
+
+// mayLookUpByKey reports whether a client bound with viewer (nil if
+// anonymous) may find the entry of a key by an RDN attribute naming the
+// key, cn=<full key> or sshKeyFingerprint=..., rather than by its uid.
+// Where keys are hidden or identities salted, only those who may see the
+// key can, unless entries are published under that RDN: anyone else would
+// learn whether a key they found elsewhere has an identity here, and which.
+func (s *LDAPServer) mayLookUpByKey(rdn string, viewer, pubKey ssh.PublicKey) bool {
+	switch {
+	case rdn == "uid",
+		rdn == "cn" && s.naming == NameByKey,
+		rdn == "sshkeyfingerprint" && s.naming == NameByFingerprint,
+		s.naming == NameByKey && len(s.salt) == 0:
+		return true
+	}
+	return viewer != nil && (derived.SameKey(viewer, pubKey) || s.isServiceAccount(viewer))
+}
+
+// isServiceAccount reports whether a key is one of the service accounts
+func (s *LDAPServer) isServiceAccount(pubKey ssh.PublicKey) bool {
+	if s.serviceAccounts == nil {
+		return false
+	}
+	_, err := s.serviceAccounts.Check(pubKey, time.Now())
+	return err == nil
+}
+
+// boundKey returns the key a client bound with, or nil if it has not bound,
+// and errRevoked if the key has been revoked since
+func (s *LDAPServer) boundKey(clientAddr string) (ssh.PublicKey, error) {
+	boundDN, err := s.sessionDN(clientAddr)
+	if err != nil || boundDN == "" {
+		return nil, err
+	}
+	pubKey, err := s.keyOfDN(boundDN)
+	if err != nil {
+		return nil, nil
+	}
+	return pubKey, nil
+}
+
+// rdnIndex finds campers by the uid or fingerprint their entries are named
+// by, so that looking one up does not derive every record. Neither changes
+// once derived, and the registry only ever gains records.
+type rdnIndex struct {
+	mu      sync.Mutex
+	indexed map[string]bool     // normalized keys already indexed
+	keys    map[string][]string // normalized keys by indexKey
+}
+
+func newRDNIndex() *rdnIndex {
+	return &rdnIndex{indexed: map[string]bool{}, keys: map[string][]string{}}
+}
+
+// indexKey is where the index keeps the keys whose entry has an RDN value;
+// uids differ by scheme, fingerprints do not
+func indexKey(attribute, value string, scheme *derived.Scheme) string {
+	if attribute == "uid" {
+		return scheme.Version + "\x00uid\x00" + value
+	}
+	return attribute + "\x00" + value
+}
+
+// lookupRDN indexes the records added since it last ran, then returns the
+// normalized keys under each of the values
+func (s *LDAPServer) lookupRDN(attribute string, values []string, scheme *derived.Scheme) []string {
+	s.rdns.mu.Lock()
+	defer s.rdns.mu.Unlock()
+	for _, record := range s.registry.List() {
+		if s.rdns.indexed[record.Key] {
+			continue
+		}
+		s.rdns.indexed[record.Key] = true
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(record.Key))
+		if err != nil {
+			continue
+		}
+		add := func(key string) { s.rdns.keys[key] = append(s.rdns.keys[key], record.Key) }
+		add(indexKey("sshkeyfingerprint", ssh.FingerprintSHA256(pubKey), nil))
+		for _, served := range s.schemes {
+			add(indexKey("uid", s.derive(pubKey, served).Username(), served))
+		}
+	}
+	var keys []string
+	for _, value := range values {
+		keys = append(keys, s.rdns.keys[indexKey(attribute, value, scheme)]...)
+	}
+	return keys
+}
+
+// resolveRDN finds the camper whose uid or fingerprint, as named by the
+// RDN attribute, is value
+func (s *LDAPServer) resolveRDN(attribute, value string, scheme *derived.Scheme) (ssh.PublicKey, error) {
+	values := []string{value}
+	if attribute == "uid" {
+		values = derived.UsernameSpellings(value)
+	}
+	seen := map[string]bool{}
+	var found []ssh.PublicKey
+	for _, key := range s.lookupRDN(attribute, values, scheme) {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil || s.checkAccess(pubKey) != nil {
+			continue
+		}
+		if attribute == "uid" && !scheme.UsernameMatches(value, s.derive(pubKey, scheme).Username()) {
+			continue
+		}
+		found = append(found, pubKey)
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("nobody has %s %s", attribute, value)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("%d campers have %s %s", len(found), attribute, value)
+}
+
+// entryRDN returns the attribute, lowercase, and the unescaped value of the
+// RDN of a camper DN, and whether the DN names a camper at all
+func entryRDN(dn string) (string, string, bool) {
+	rdn, _, _ := strings.Cut(dn, ",")
+	attribute, value, ok := strings.Cut(rdn, "=")
+	attribute = strings.ToLower(strings.TrimSpace(attribute))
+	switch attribute {
+	case "cn", "uid", "sshkeyfingerprint":
+		value, unescaped := unescapeRDNValue(value)
+		return attribute, value, ok && unescaped
+	}
+	return "", "", false
+}
+
+// escapeRDNValue escapes the characters RFC 4514 reserves in attribute
+// values: a leading space or #, a trailing space, and "+,;<>\ anywhere
+func escapeRDNValue(value string) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`"+,;<>\`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// unescapeRDNValue undoes escapeRDNValue, and the \XX hex escapes RFC 4514
+// also allows, reporting whether the value was escaped properly. Values
+// without backslashes, such as full keys as clients have always sent them,
+// are taken as they are.
+func unescapeRDNValue(value string) (string, bool) {
+	if !strings.Contains(value, "\\") {
+		return value, true
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 < len(value) {
+			if decoded, err := hex.DecodeString(value[i+1 : i+3]); err == nil {
+				b.Write(decoded)
+				i += 2
+				continue
+			}
+		}
+		if i+1 == len(value) {
+			return "", false
+		}
+		i++
+		b.WriteByte(value[i])
+	}
+	return b.String(), true
+}
@@ -0,0 +1,133 @@
+package ldapserver
+
+import (
+	"fmt"
+	"log"
+
+	"lilidap/internal/derived"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"golang.org/x/crypto/ssh"
+)
+
+// safetyNumberOID names the extended operation computing the safety number
+// of the bound user and another camper, whose DN is the request value
+const safetyNumberOID = lilidapOID + ".3.1"
+
+// keyOfDN returns the key named by a camper DN, by its key, uid or fingerprint
+func (s *LDAPServer) keyOfDN(dn string) (ssh.PublicKey, error) {
+	rdn, value, scheme, err := s.parseEntryDN(dn)
+	if err != nil {
+		return nil, err
+	}
+	if rdn != "cn" {
+		return s.resolveRDN(rdn, value, scheme)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key: %w", err)
+	}
+	return pubKey, nil
+}
+
+// safetyNumber computes the safety number of the keys of two DNs, returning
+// an LDAP result code with any error
+func (s *LDAPServer) safetyNumber(boundDN, targetDN string) (string, int, error) {
+	bound, err := s.keyOfDN(boundDN)
+	if err != nil {
+		return "", ldap.LDAPResultOperationsError, err
+	}
+	rdn, _, _, err := s.parseEntryDN(targetDN)
+	if err != nil {
+		return "", ldap.LDAPResultInvalidDNSyntax, err
+	}
+	target, err := s.keyOfDN(targetDN)
+	if err != nil && rdn == "cn" {
+		return "", ldap.LDAPResultInvalidDNSyntax, err
+	}
+	// Hidden entries have no safety number either, nor do entries named by
+	// a key or fingerprint the bound user may not look up, alike
+	if err != nil || s.checkAccess(target) != nil || !s.mayLookUpByKey(rdn, bound, target) {
+		return "", ldap.LDAPResultNoSuchObject, fmt.Errorf("no such camper")
+	}
+	// The number comes from both keys, so anyone could test a guess at a
+	// hidden key by comparing it with the number the guess gives
+	if !s.maySeeKey(bound, target) {
+		return "", ldap.LDAPResultInsufficientAccessRights, fmt.Errorf("the key of %s is hidden from you", targetDN)
+	}
+	if derived.SameKey(bound, target) {
+		return "", ldap.LDAPResultUnwillingToPerform, fmt.Errorf("a safety number needs two different keys")
+	}
+	return derived.SafetyNumber(bound, target), ldap.LDAPResultSuccess, nil
+}
+
+// extendedResponse builds a successful extended response carrying a value.
+// goldap can read response values but not set them, so the response is
+// encoded with go-asn1-ber and read back. The value also goes in the
+// diagnostic message, for clients that only show that.
+func extendedResponse(name, value string) (message.ExtendedResponse, error) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, message.TagExtendedResponse, nil, "ExtendedResponse")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.LDAPResultSuccess, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "diagnosticMessage"))
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, message.TagExtendedResponseName, name, "responseName"))
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, message.TagExtendedResponseValue, value, "responseValue"))
+	packet := ber.NewSequence("LDAPMessage")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "messageID"))
+	packet.AppendChild(op)
+
+	msg, err := message.ReadLDAPMessage(message.NewBytes(0, packet.Bytes()))
+	if err != nil {
+		return message.ExtendedResponse{}, err
+	}
+	res, ok := msg.ProtocolOp().(message.ExtendedResponse)
+	if !ok {
+		return message.ExtendedResponse{}, fmt.Errorf("encoded %T, not an extended response", msg.ProtocolOp())
+	}
+	return res, nil
+}
+
+// handleSafetyNumber answers the safety number extended operation, with the
+// safety number as the response value
+func (s *LDAPServer) handleSafetyNumber(w ldap.ResponseWriter, m *ldap.Message) {
+	extReq := m.GetExtendedRequest()
+	clientAddr := m.Client.Addr().String()
+	log.Printf("🔢 SAFETY NUMBER request from %s", clientAddr)
+
+	reject := func(code int, err error) {
+		log.Printf("❌ SAFETY NUMBER REJECTED: %v", err)
+		res := ldap.NewExtendedResponse(code)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+	}
+
+	boundDN, err := s.sessionDN(clientAddr)
+	if err != nil {
+		reject(ldap.LDAPResultInsufficientAccessRights, err)
+		return
+	}
+	if boundDN == "" {
+		reject(ldap.LDAPResultInsufficientAccessRights, fmt.Errorf("not authenticated - bind first"))
+		return
+	}
+	if extReq.RequestValue() == nil {
+		reject(ldap.LDAPResultProtocolError, fmt.Errorf("the request value must be the DN of the other camper"))
+		return
+	}
+
+	number, code, err := s.safetyNumber(boundDN, string(*extReq.RequestValue()))
+	if err != nil {
+		reject(code, err)
+		return
+	}
+
+	res, err := extendedResponse(safetyNumberOID, number)
+	if err != nil {
+		reject(ldap.LDAPResultOperationsError, err)
+		return
+	}
+	log.Printf("✅ SAFETY NUMBER computed for %s", clientAddr)
+	w.Write(res)
+}
@@ -0,0 +1,174 @@
+package ldapserver
+
+import (
+	"container/list"
+	"log"
+	"strings"
+	"sync"
+
+	"lilidap/internal/derived"
+
+	"github.com/lor00x/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+	"golang.org/x/crypto/ssh"
+)
+
+// subschemaDN is the subschema subentry advertised in the root DSE (RFC 4512)
+const subschemaDN = "cn=Subschema"
+
+// lilidapOID is the arc of lilidap's own schema elements, a UUID-based OID
+// under 2.25 (ITU-T X.667) so that no registration is needed
+const lilidapOID = "2.25.46701984950001228389264208449730028129"
+
+// The subschema describes what lilidap publishes beyond the standard schemas
+// (core, cosine, inetOrgPerson and NIS): the openssh-lpk schema, for sshd's
+// AuthorizedKeysCommand, sssd and Gitea, and lilidap's own attributes.
+var (
+	schemaAttributeTypes = []string{
+		"( 1.3.6.1.4.1.24552.500.1.1.1.13 NAME 'sshPublicKey' DESC 'MANDATORY: OpenSSH Public key' EQUALITY octetStringMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.40 )",
+		"( " + lilidapOID + ".1.1 NAME 'sshKeyFingerprint' DESC 'SHA256 fingerprint of the OpenSSH public key' EQUALITY caseExactMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE NO-USER-MODIFICATION USAGE userApplications )",
+		"( " + lilidapOID + ".1.2 NAME 'sshKeyType' DESC 'Algorithm of the OpenSSH public key, e.g. ssh-ed25519' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE NO-USER-MODIFICATION USAGE userApplications )",
+		"( " + lilidapOID + ".1.3 NAME 'sipURI' DESC 'SIP address of the telephone number' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 NO-USER-MODIFICATION USAGE userApplications )",
+		"( " + lilidapOID + ".1.4 NAME 'accentColor' DESC 'Color of the identicon, as #rrggbb' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE NO-USER-MODIFICATION USAGE userApplications )",
+		"( " + lilidapOID + ".1.5 NAME 'fingerprintWords' DESC 'SHA-256 hash of the OpenSSH public key as words, for verification by voice' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE NO-USER-MODIFICATION USAGE userApplications )",
+		"( " + lilidapOID + ".1.6 NAME 'lilidapIdentity' DESC 'global, or pseudonymous when identities are derived with a per-deployment salt' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE NO-USER-MODIFICATION USAGE dSAOperation )",
+		"( 2.16.840.1.113730.3.1.35 NAME 'thumbnailPhoto' DESC 'Small picture, as in Active Directory' SYNTAX 1.3.6.1.4.1.1466.115.121.1.40 SINGLE-VALUE )",
+	}
+	schemaObjectClasses = []string{
+		"( 1.3.6.1.4.1.24552.500.1.1.2.0 NAME 'ldapPublicKey' DESC 'MANDATORY: OpenSSH LPK objectclass' SUP top AUXILIARY MUST ( sshPublicKey $ uid ) )",
+		"( " + lilidapOID + ".2.1 NAME 'lilidapAccount' DESC 'Identity derived from an SSH public key' SUP top AUXILIARY MAY ( sshKeyFingerprint $ sshKeyType $ sipURI $ accentColor $ thumbnailPhoto $ fingerprintWords ) )",
+	}
+)
+
+// addKeyAttributes publishes the key itself, in the openssh-lpk schema, and
+// its fingerprint and type
+func addKeyAttributes(e *entry, pubKey ssh.PublicKey) {
+	e.add("sshPublicKey", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))))
+	e.add("sshKeyFingerprint", ssh.FingerprintSHA256(pubKey))
+	e.add("sshKeyType", pubKey.Type())
+}
+
+// Avatar sizes in pixels: jpegPhoto for profile views, thumbnailPhoto for
+// contact lists, at the size Active Directory recommends
+const (
+	photoSize     = 128
+	thumbnailSize = 96
+)
+
+// addAvatarAttributes publishes the color of the identicon, and the
+// identicon itself if photos are wanted
+func (s *LDAPServer) addAvatarAttributes(e *entry, attrs *derived.UserAttributes, photos bool) {
+	if photos {
+		avatar := attrs.Avatar()
+		if photo, err := s.avatarJPEG(avatar, photoSize); err == nil {
+			e.add("jpegPhoto", string(photo))
+		}
+		if thumbnail, err := s.avatarJPEG(avatar, thumbnailSize); err == nil {
+			e.add("thumbnailPhoto", string(thumbnail))
+		}
+	}
+	e.add("accentColor", attrs.AccentColor())
+}
+
+// avatarKey identifies an encoded identicon in the server's cache
+type avatarKey struct {
+	avatar derived.Avatar
+	size   int
+}
+
+// photoCacheSize is how many encoded identicons the server keeps. Anyone may
+// look up any key, so the cache must not grow with the keys asked about.
+const photoCacheSize = 512
+
+// photoCache keeps the most recently used encoded identicons
+type photoCache struct {
+	mu      sync.Mutex
+	recent  *list.List                  // avatarPhotos, most recently used first
+	entries map[avatarKey]*list.Element // elements of recent
+}
+
+// avatarPhoto is an encoded identicon in the cache
+type avatarPhoto struct {
+	key   avatarKey
+	photo []byte
+}
+
+func newPhotoCache() *photoCache {
+	return &photoCache{recent: list.New(), entries: map[avatarKey]*list.Element{}}
+}
+
+func (c *photoCache) get(key avatarKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.recent.MoveToFront(element)
+	return element.Value.(*avatarPhoto).photo, true
+}
+
+// put caches a photo, evicting the least recently used beyond photoCacheSize
+func (c *photoCache) put(key avatarKey, photo []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(&avatarPhoto{key, photo})
+	for c.recent.Len() > photoCacheSize {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*avatarPhoto).key)
+	}
+}
+
+// avatarJPEG encodes an identicon once per size while it is in the cache,
+// since the same few campers are looked up over and over
+func (s *LDAPServer) avatarJPEG(avatar *derived.Avatar, size int) ([]byte, error) {
+	key := avatarKey{*avatar, size}
+	if photo, ok := s.photos.get(key); ok {
+		return photo, nil
+	}
+	photo, err := avatar.JPEG(size)
+	if err != nil {
+		return nil, err
+	}
+	s.photos.put(key, photo)
+	return photo, nil
+}
+
+// wantsPhotos reports whether a search asks for the identicons, by name or
+// with "*". They are large to send and costly to render, so unlike other
+// user attributes they are left out when no attributes are asked for.
+func wantsPhotos(attributes message.AttributeSelection) bool {
+	for _, attribute := range attributes {
+		switch strings.ToLower(string(attribute)) {
+		case "*", "jpegphoto", "thumbnailphoto":
+			return true
+		}
+	}
+	return false
+}
+
+// subschemaEntry builds the subschema subentry
+func subschemaEntry() *entry {
+	e := &entry{dn: subschemaDN}
+	e.add("objectClass", "top", "subentry", "subschema", "extensibleObject")
+	e.add("cn", "Subschema")
+	e.add("attributeTypes", schemaAttributeTypes...)
+	e.add("objectClasses", schemaObjectClasses...)
+	return e
+}
+
+// handleSubschema answers base searches of the subschema subentry
+func (s *LDAPServer) handleSubschema(w ldap.ResponseWriter, m *ldap.Message) {
+	log.Printf("🔍 SUBSCHEMA request from %s", m.Client.Addr().String())
+
+	searchReq := m.GetSearchRequest()
+	if e := subschemaEntry(); e.matches(searchReq.Filter()) {
+		w.Write(e.message())
+	}
+	w.Write(ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess))
+}
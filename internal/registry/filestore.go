@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a Store kept in a JSON-lines journal next to the server.
+// Every Put appends the full record, so a crash loses at most the last write,
+// and the journal is compacted to one line per key each time it is opened.
+type FileStore struct {
+	mu   sync.Mutex
+	mem  *MemoryStore
+	path string
+	file *os.File
+}
+
+// Open creates a registry backed by the journal at path
+func Open(path string) (*Registry, error) {
+	store, err := OpenFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(store), nil
+}
+
+// OpenFileStore loads and compacts the journal at path, creating it if needed
+func OpenFileStore(path string) (*FileStore, error) {
+	mem := NewMemoryStore()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read registry: %w", err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				// A torn final write from a crash; everything before it is fine
+				break
+			}
+			return nil, fmt.Errorf("failed to parse registry %s line %d: %w", path, i+1, err)
+		}
+		mem.records[record.Key] = &record
+	}
+
+	if err := compact(path, mem.List()); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry: %w", err)
+	}
+	return &FileStore{mem: mem, path: path, file: file}, nil
+}
+
+// compact atomically replaces the journal with one line per record
+func compact(path string, records []*Record) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode registry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to compact registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact registry: %w", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to compact registry: %w", err)
+	}
+	return nil
+}
+
+// Get implements Store
+func (s *FileStore) Get(key string) (*Record, bool) {
+	return s.mem.Get(key)
+}
+
+// Put implements Store; the record is only kept if it reached the journal
+func (s *FileStore) Put(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("registry is closed")
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return s.mem.Put(record)
+}
+
+// List implements Store
+func (s *FileStore) List() []*Record {
+	return s.mem.List()
+}
+
+// Close implements Store
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"lilidap/internal/bitset"
+	"lilidap/internal/derived"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ * This package remembers which keys have ever authenticated on this network,
+ * when, and from where. It is the server's memory across restarts, and feeds
+ * directory listing, presence and auditing.
+ *
+ * Storage is pluggable through the Store interface; the Registry on top of it
+ * serializes updates so that read-modify-write cycles are safe.
+ */
+
+// Record is what the registry knows about a verified key
+type Record struct {
+	Key         string    `json:"key"`         // normalized public key in authorized_keys format
+	Fingerprint string    `json:"fingerprint"` // SHA256 fingerprint, for humans and logs
+	FirstSeen   time.Time `json:"first_seen"`  // time of the first successful bind
+	LastSeen    time.Time `json:"last_seen"`   // time of the latest successful bind
+	LastAddr    string    `json:"last_addr"`   // host:port the key was last validated at
+	Binds       int       `json:"binds"`       // number of successful binds
+
+	// Identity derived when the key was first admitted, to detect collisions
+	DisplayName string `json:"display_name,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	UidNumber   int    `json:"uid_number,omitempty"`
+	GidNumber   int    `json:"gid_number,omitempty"`
+	Suffix      int    `json:"suffix,omitempty"`     // suffix of every attribute, as given on collisions before Suffixes
+	Scheme      string `json:"scheme,omitempty"`     // derivation scheme version of the fields above
+	Derivation  string `json:"derivation,omitempty"` // all the settings the fields above were derived with
+	Extension   string `json:"extension,omitempty"`  // short number given out on this network
+
+	// KeyBits are the hash bits the identity was derived from, which names
+	// decode back to. BitSets are not modified once stored.
+	KeyBits *bitset.BitSet `json:"key_bits,omitempty"`
+	// Suffixes disambiguate each attribute that collided with that of
+	// another key. They are not modified once stored either.
+	Suffixes *derived.Suffixes `json:"suffixes,omitempty"`
+}
+
+// Store is a storage backend for records, keyed by normalized public key
+type Store interface {
+	Get(key string) (*Record, bool)
+	Put(record *Record) error
+	List() []*Record
+	Close() error
+}
+
+// NormalizeKey returns the canonical authorized_keys form of a key, without comment
+func NormalizeKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// Registry tracks verified keys on top of a Store
+type Registry struct {
+	mu    sync.Mutex
+	store Store
+}
+
+// New creates a registry backed by the given store
+func New(store Store) *Registry {
+	return &Registry{store: store}
+}
+
+// NewInMemory creates a registry that forgets everything on restart
+func NewInMemory() *Registry {
+	return New(NewMemoryStore())
+}
+
+// Touch records a successful bind of the key, validated at addr
+func (r *Registry) Touch(key ssh.PublicKey, addr string, at time.Time) (*Record, error) {
+	return r.Update(key, func(record *Record) error {
+		record.LastSeen = at.UTC()
+		record.LastAddr = addr
+		record.Binds++
+		return nil
+	}, at)
+}
+
+// Update applies fn to the record for key, creating it if needed, and stores
+// the result unless fn fails. Updates are serialized.
+func (r *Registry) Update(key ssh.PublicKey, fn func(*Record) error, at time.Time) (*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	normalized := NormalizeKey(key)
+	record, ok := r.store.Get(normalized)
+	if !ok {
+		record = &Record{
+			Key:         normalized,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			FirstSeen:   at.UTC(),
+		}
+	}
+	if err := fn(record); err != nil {
+		return nil, err
+	}
+	if err := r.store.Put(record); err != nil {
+		return nil, err
+	}
+	return copyRecord(record), nil
+}
+
+// Get returns the record for the key, if it has ever been verified
+func (r *Registry) Get(key ssh.PublicKey) (*Record, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.store.Get(NormalizeKey(key))
+}
+
+// List returns all records, most recently seen first
+func (r *Registry) List() []*Record {
+	r.mu.Lock()
+	records := r.store.List()
+	r.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	return records
+}
+
+// Close releases the underlying store
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.store.Close()
+}
+
+func copyRecord(record *Record) *Record {
+	c := *record
+	return &c
+}
+
+// MemoryStore is a Store kept in a map
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]*Record
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*Record)}
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(key string) (*Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[key]
+	if !ok {
+		return nil, false
+	}
+	return copyRecord(record), true
+}
+
+// Put implements Store
+func (s *MemoryStore) Put(record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.Key] = copyRecord(record)
+	return nil
+}
+
+// List implements Store
+func (s *MemoryStore) List() []*Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]*Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, copyRecord(record))
+	}
+	return records
+}
+
+// Close implements Store
+func (s *MemoryStore) Close() error {
+	return nil
+}
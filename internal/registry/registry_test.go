@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lilidap/internal/bitset"
+	"lilidap/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRegistry(t *testing.T, reg *Registry) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+	otherKey, err := testutils.GetRandomPublicKey()
+	require.NoError(t, err)
+
+	first := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	later := first.Add(36 * time.Hour)
+
+	t.Run("Unknown key has no record", func(t *testing.T) {
+		_, ok := reg.Get(testKey)
+		assert.False(ok)
+	})
+
+	t.Run("First bind creates a record", func(t *testing.T) {
+		record, err := reg.Touch(testKey, "192.168.1.100:22", first)
+		require.NoError(t, err)
+		assert.Equal(NormalizeKey(testKey), record.Key)
+		assert.Equal("SHA256:", record.Fingerprint[:7])
+		assert.Equal(first, record.FirstSeen)
+		assert.Equal(first, record.LastSeen)
+		assert.Equal("192.168.1.100:22", record.LastAddr)
+		assert.Equal(1, record.Binds)
+	})
+
+	t.Run("Later bind keeps first seen", func(t *testing.T) {
+		_, err := reg.Touch(testKey, "10.0.0.7:2222", later)
+		require.NoError(t, err)
+		record, ok := reg.Get(testKey)
+		require.True(t, ok)
+		assert.Equal(first, record.FirstSeen)
+		assert.Equal(later, record.LastSeen)
+		assert.Equal("10.0.0.7:2222", record.LastAddr)
+		assert.Equal(2, record.Binds)
+	})
+
+	t.Run("List is most recent first", func(t *testing.T) {
+		_, err := reg.Touch(otherKey, "10.0.0.8:22", first.Add(time.Hour))
+		require.NoError(t, err)
+		records := reg.List()
+		if assert.Len(records, 2) {
+			assert.Equal(NormalizeKey(testKey), records[0].Key)
+			assert.Equal(NormalizeKey(otherKey), records[1].Key)
+		}
+	})
+
+	t.Run("Key bits are stored", func(t *testing.T) {
+		bits := bitset.FromInt(0xD8AAB9CF4C, 40)
+		_, err := reg.Update(testKey, func(record *Record) error {
+			record.KeyBits = bits
+			return nil
+		}, later)
+		require.NoError(t, err)
+		record, _ := reg.Get(testKey)
+		if assert.NotNil(record.KeyBits) {
+			assert.True(bits.Equals(record.KeyBits))
+		}
+	})
+
+	t.Run("Records are copies", func(t *testing.T) {
+		record, _ := reg.Get(testKey)
+		record.Binds = 1000
+		stored, _ := reg.Get(testKey)
+		assert.Equal(2, stored.Binds)
+	})
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewInMemory())
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.jsonl")
+	reg, err := Open(path)
+	require.NoError(t, err)
+	testRegistry(t, reg)
+	before := reg.List()
+	require.NoError(t, reg.Close())
+
+	t.Run("Records survive a restart", func(t *testing.T) {
+		reopened, err := Open(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.Equal(t, before, reopened.List())
+	})
+
+	t.Run("Journal is compacted on open", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, 2, countLines(data))
+	})
+
+	t.Run("Torn final write is ignored", func(t *testing.T) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"key":"ssh-ed25519 AAAA`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		reopened, err := Open(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.Len(t, reopened.List(), 2)
+	})
+}
+
+func countLines(data []byte) int {
+	count := 0
+	for _, b := range data {
+		if b == '\n' {
+			count++
+		}
+	}
+	return count
+}
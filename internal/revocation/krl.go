@@ -0,0 +1,223 @@
+package revocation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// OpenSSH Key Revocation List format, as described in PROTOCOL.krl
+// in the OpenSSH source tree
+const (
+	krlMagic         = 0x5353484b524c0a00 // "SSHKRL\n\0"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSectionSerialList   = 0x20
+	krlCertSectionSerialRange  = 0x21
+	krlCertSectionSerialBitmap = 0x22
+	krlCertSectionKeyID        = 0x23
+)
+
+// isKRL checks for the KRL magic number at the start of the data
+func isKRL(data []byte) bool {
+	return len(data) >= 8 && binary.BigEndian.Uint64(data) == krlMagic
+}
+
+// wireReader consumes SSH wire format values from a buffer
+type wireReader struct {
+	data []byte
+}
+
+func (r *wireReader) empty() bool {
+	return len(r.data) == 0
+}
+
+func (r *wireReader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+func (r *wireReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *wireReader) uint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *wireReader) string() ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(r.data)) < n {
+		return nil, fmt.Errorf("string length %d exceeds remaining data", n)
+	}
+	s := r.data[:n]
+	r.data = r.data[n:]
+	return s, nil
+}
+
+// parseKRL reads an OpenSSH binary KRL.
+// Signatures are not verified: the file is trusted because the operator put it there.
+func parseKRL(data []byte) (*revocations, error) {
+	r := &wireReader{data: data}
+
+	magic, err := r.uint64()
+	if err != nil || magic != krlMagic {
+		return nil, fmt.Errorf("bad KRL magic")
+	}
+	version, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != krlFormatVersion {
+		return nil, fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	// krl_version, generated_date, flags, reserved, comment
+	for i := 0; i < 3; i++ {
+		if _, err := r.uint64(); err != nil {
+			return nil, fmt.Errorf("truncated KRL header: %w", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.string(); err != nil {
+			return nil, fmt.Errorf("truncated KRL header: %w", err)
+		}
+	}
+
+	revs := newRevocations()
+	for !r.empty() {
+		sectionType, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if sectionType == krlSectionSignature {
+			// Signatures always come last and cover everything before them
+			break
+		}
+		sectionData, err := r.string()
+		if err != nil {
+			return nil, fmt.Errorf("section %d: %w", sectionType, err)
+		}
+		section := &wireReader{data: sectionData}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseCertSection(section)
+			if err != nil {
+				return nil, fmt.Errorf("certificate section: %w", err)
+			}
+			revs.certs = append(revs.certs, certs)
+		case krlSectionExplicitKey:
+			err = readStrings(section, revs.keys)
+		case krlSectionFingerprintSHA1:
+			err = readStrings(section, revs.sha1)
+		case krlSectionFingerprintSHA256:
+			err = readStrings(section, revs.sha256)
+		default:
+			return nil, fmt.Errorf("unsupported KRL section type %d", sectionType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("section %d: %w", sectionType, err)
+		}
+	}
+	return revs, nil
+}
+
+// readStrings adds every string in the section to the set
+func readStrings(section *wireReader, set map[string]bool) error {
+	for !section.empty() {
+		s, err := section.string()
+		if err != nil {
+			return err
+		}
+		set[string(s)] = true
+	}
+	return nil
+}
+
+func parseCertSection(section *wireReader) (*certRevocations, error) {
+	caKey, err := section.string()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := section.string(); err != nil { // reserved
+		return nil, err
+	}
+
+	certs := &certRevocations{caKey: caKey, keyIDs: make(map[string]bool)}
+	for !section.empty() {
+		subType, err := section.byte()
+		if err != nil {
+			return nil, err
+		}
+		subData, err := section.string()
+		if err != nil {
+			return nil, err
+		}
+		sub := &wireReader{data: subData}
+
+		switch subType {
+		case krlCertSectionSerialList:
+			for !sub.empty() {
+				serial, err := sub.uint64()
+				if err != nil {
+					return nil, err
+				}
+				certs.ranges = append(certs.ranges, serialRange{serial, serial})
+			}
+		case krlCertSectionSerialRange:
+			min, err := sub.uint64()
+			if err != nil {
+				return nil, err
+			}
+			max, err := sub.uint64()
+			if err != nil {
+				return nil, err
+			}
+			certs.ranges = append(certs.ranges, serialRange{min, max})
+		case krlCertSectionSerialBitmap:
+			offset, err := sub.uint64()
+			if err != nil {
+				return nil, err
+			}
+			bitmap, err := sub.string() // mpint
+			if err != nil {
+				return nil, err
+			}
+			certs.bitmaps = append(certs.bitmaps, serialBitmap{offset, new(big.Int).SetBytes(bitmap)})
+		case krlCertSectionKeyID:
+			for !sub.empty() {
+				keyID, err := sub.string()
+				if err != nil {
+					return nil, err
+				}
+				certs.keyIDs[string(keyID)] = true
+			}
+		default:
+			return nil, fmt.Errorf("unsupported certificate subsection type %d", subType)
+		}
+	}
+	return certs, nil
+}
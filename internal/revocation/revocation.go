@@ -0,0 +1,198 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"lilidap/internal/filewatch"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ * This package keeps track of SSH keys that must no longer be accepted,
+ * e.g. because the phone holding them was lost.
+ *
+ * Two file formats are accepted, and told apart by the KRL magic number:
+ *  - a plain blocklist in authorized_keys format, which may also contain
+ *    bare "SHA256:..." fingerprints (as printed by ssh-keygen -l)
+ *  - an OpenSSH binary Key Revocation List, as made by ssh-keygen -k
+ */
+
+// serialRange is an inclusive range of revoked certificate serials
+type serialRange struct {
+	min, max uint64
+}
+
+// serialBitmap revokes serial offset+i for every bit i set in bits
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+// certRevocations holds the certificate revocations issued for one CA
+type certRevocations struct {
+	caKey   []byte // marshaled CA key; empty means any CA
+	ranges  []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]bool
+}
+
+// revocations is the parsed content of a single revocation file
+type revocations struct {
+	keys   map[string]bool // marshaled public key blobs
+	sha1   map[string]bool // SHA1 hashes of public key blobs
+	sha256 map[string]bool // SHA256 hashes of public key blobs
+	certs  []*certRevocations
+}
+
+func newRevocations() *revocations {
+	return &revocations{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// List is a reloadable set of revoked keys backed by a file
+type List struct {
+	path string
+	mu   sync.RWMutex
+	revs *revocations
+}
+
+// Load reads a blocklist or KRL file into a new List
+func Load(path string) (*List, error) {
+	list := &List{path: path}
+	if err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Path returns the file backing the list
+func (l *List) Path() string {
+	return l.path
+}
+
+// Reload re-reads the backing file, keeping the old content on failure
+func (l *List) Reload() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read revocation list: %w", err)
+	}
+
+	var revs *revocations
+	if isKRL(data) {
+		revs, err = parseKRL(data)
+	} else {
+		revs, err = parseBlocklist(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse revocation list %s: %w", l.path, err)
+	}
+
+	l.mu.Lock()
+	l.revs = revs
+	l.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the list whenever its file changes, reporting reload errors
+// through onError. It returns a function that stops watching.
+func (l *List) Watch(interval time.Duration, onError func(error)) func() {
+	return filewatch.Watch([]string{l.path}, interval, func() {
+		if err := l.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// IsRevoked reports whether the key, or for certificates the underlying key,
+// its CA, its serial or its key ID, has been revoked
+func (l *List) IsRevoked(key ssh.PublicKey) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.revs.isRevoked(key)
+}
+
+func (r *revocations) isRevoked(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if r.isCertRevoked(cert) || r.isRevoked(cert.Key) || r.isRevoked(cert.SignatureKey) {
+			return true
+		}
+	}
+
+	blob := key.Marshal()
+	if r.keys[string(blob)] {
+		return true
+	}
+	sha1Sum := sha1.Sum(blob)
+	if r.sha1[string(sha1Sum[:])] {
+		return true
+	}
+	sha256Sum := sha256.Sum256(blob)
+	return r.sha256[string(sha256Sum[:])]
+}
+
+func (r *revocations) isCertRevoked(cert *ssh.Certificate) bool {
+	caKey := cert.SignatureKey.Marshal()
+	for _, section := range r.certs {
+		if len(section.caKey) > 0 && !bytes.Equal(section.caKey, caKey) {
+			continue
+		}
+		if section.keyIDs[cert.KeyId] {
+			return true
+		}
+		for _, rng := range section.ranges {
+			if cert.Serial >= rng.min && cert.Serial <= rng.max {
+				return true
+			}
+		}
+		for _, bitmap := range section.bitmaps {
+			if cert.Serial < bitmap.offset {
+				continue
+			}
+			bit := cert.Serial - bitmap.offset
+			if bit < uint64(bitmap.bits.BitLen()) && bitmap.bits.Bit(int(bit)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseBlocklist reads authorized_keys lines and bare SHA256 fingerprints
+func parseBlocklist(data []byte) (*revocations, error) {
+	revs := newRevocations()
+	for lineNo, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "SHA256:") {
+			hash, err := base64.RawStdEncoding.DecodeString(strings.Fields(line)[0][len("SHA256:"):])
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("line %d: invalid SHA256 fingerprint", lineNo+1)
+			}
+			revs.sha256[string(hash)] = true
+			continue
+		}
+
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo+1, err)
+		}
+		revs.keys[string(pubKey.Marshal())] = true
+	}
+	return revs, nil
+}
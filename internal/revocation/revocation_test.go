@@ -0,0 +1,219 @@
+package revocation
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lilidap/internal/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+// newCert issues a user certificate for key, signed by ca
+func newCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, serial uint64, keyID string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:         key,
+		Serial:      serial,
+		CertType:    ssh.UserCert,
+		KeyId:       keyID,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func sha1Sum(key ssh.PublicKey) []byte {
+	sum := sha1.Sum(key.Marshal())
+	return sum[:]
+}
+
+func writeFile(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "revoked")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+// krlBuilder assembles a KRL in SSH wire format
+type krlBuilder struct {
+	data []byte
+}
+
+func newKRLBuilder() *krlBuilder {
+	b := &krlBuilder{}
+	b.data = binary.BigEndian.AppendUint64(b.data, krlMagic)
+	b.data = binary.BigEndian.AppendUint32(b.data, krlFormatVersion)
+	b.data = binary.BigEndian.AppendUint64(b.data, 1)                         // krl_version
+	b.data = binary.BigEndian.AppendUint64(b.data, uint64(time.Now().Unix())) // generated_date
+	b.data = binary.BigEndian.AppendUint64(b.data, 0)                         // flags
+	b.data = appendString(b.data, nil)                                        // reserved
+	b.data = appendString(b.data, []byte("test KRL"))                         // comment
+	return b
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func (b *krlBuilder) section(sectionType byte, data []byte) *krlBuilder {
+	b.data = append(b.data, sectionType)
+	b.data = appendString(b.data, data)
+	return b
+}
+
+func TestBlocklist(t *testing.T) {
+	assert := assert.New(t)
+
+	testKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+	otherKey := newSigner(t).PublicKey()
+	fingerprintKey := newSigner(t).PublicKey()
+
+	path := writeFile(t, []byte("# lost phones\n"+
+		testutils.TestPublicKeyString+"\n\n"+
+		ssh.FingerprintSHA256(fingerprintKey)+" old laptop\n"))
+	list, err := Load(path)
+	require.NoError(t, err)
+
+	t.Run("Listed key is revoked", func(t *testing.T) {
+		assert.True(list.IsRevoked(testKey))
+	})
+
+	t.Run("Listed fingerprint is revoked", func(t *testing.T) {
+		assert.True(list.IsRevoked(fingerprintKey))
+	})
+
+	t.Run("Other key is not revoked", func(t *testing.T) {
+		assert.False(list.IsRevoked(otherKey))
+	})
+
+	t.Run("Certificate for a revoked key is revoked", func(t *testing.T) {
+		ca := newSigner(t)
+		signer := newSigner(t)
+		require.NoError(t, os.WriteFile(path, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644))
+		require.NoError(t, list.Reload())
+		assert.True(list.IsRevoked(newCert(t, ca, signer.PublicKey(), 1, "someone")))
+	})
+
+	t.Run("Invalid file is rejected and old content kept", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("not a key\n"), 0644))
+		assert.Error(list.Reload())
+		assert.False(list.IsRevoked(otherKey))
+	})
+}
+
+func TestKRL(t *testing.T) {
+	assert := assert.New(t)
+
+	explicitKey := newSigner(t).PublicKey()
+	sha1Key := newSigner(t).PublicKey()
+	sha256Key := newSigner(t).PublicKey()
+	innocentKey := newSigner(t).PublicKey()
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+
+	sha256Sum := sha256.Sum256(sha256Key.Marshal())
+
+	// certificate section for ca: serial 5, serials 10-20, serials 100+{0,3} and key ID "lost-phone"
+	var certSection []byte
+	certSection = appendString(certSection, ca.PublicKey().Marshal())
+	certSection = appendString(certSection, nil)
+	certSection = append(certSection, krlCertSectionSerialList)
+	certSection = appendString(certSection, binary.BigEndian.AppendUint64(nil, 5))
+	certSection = append(certSection, krlCertSectionSerialRange)
+	certSection = appendString(certSection, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 10), 20))
+	certSection = append(certSection, krlCertSectionSerialBitmap)
+	certSection = appendString(certSection, appendString(binary.BigEndian.AppendUint64(nil, 100), []byte{0x09}))
+	certSection = append(certSection, krlCertSectionKeyID)
+	certSection = appendString(certSection, appendString(nil, []byte("lost-phone")))
+
+	krl := newKRLBuilder().
+		section(krlSectionExplicitKey, appendString(nil, explicitKey.Marshal())).
+		section(krlSectionFingerprintSHA1, appendString(nil, sha1Sum(sha1Key))).
+		section(krlSectionFingerprintSHA256, appendString(nil, sha256Sum[:])).
+		section(krlSectionCertificates, certSection).
+		section(krlSectionSignature, nil)
+
+	list, err := Load(writeFile(t, krl.data))
+	require.NoError(t, err)
+
+	t.Run("Explicit key is revoked", func(t *testing.T) {
+		assert.True(list.IsRevoked(explicitKey))
+	})
+
+	t.Run("SHA1 fingerprint is revoked", func(t *testing.T) {
+		assert.True(list.IsRevoked(sha1Key))
+	})
+
+	t.Run("SHA256 fingerprint is revoked", func(t *testing.T) {
+		assert.True(list.IsRevoked(sha256Key))
+	})
+
+	t.Run("Unlisted key is not revoked", func(t *testing.T) {
+		assert.False(list.IsRevoked(innocentKey))
+	})
+
+	t.Run("Certificate serials", func(t *testing.T) {
+		testCases := map[uint64]bool{
+			4: false, 5: true, 6: false,
+			9: false, 10: true, 15: true, 20: true, 21: false,
+			100: true, 101: false, 103: true, 104: false,
+		}
+		for serial, revoked := range testCases {
+			cert := newCert(t, ca, innocentKey, serial, "someone")
+			assert.Equalf(revoked, list.IsRevoked(cert), "serial %d", serial)
+		}
+	})
+
+	t.Run("Certificate key ID", func(t *testing.T) {
+		assert.True(list.IsRevoked(newCert(t, ca, innocentKey, 1000, "lost-phone")))
+	})
+
+	t.Run("Serials only apply to their CA", func(t *testing.T) {
+		assert.False(list.IsRevoked(newCert(t, otherCA, innocentKey, 5, "lost-phone")))
+	})
+
+	t.Run("Bad magic falls back to blocklist parsing", func(t *testing.T) {
+		_, err := Load(writeFile(t, []byte("SSHKRL garbage")))
+		assert.Error(err)
+	})
+
+	t.Run("Unsupported version is rejected", func(t *testing.T) {
+		data := append([]byte{}, krl.data...)
+		binary.BigEndian.PutUint32(data[8:], 2)
+		_, err := Load(writeFile(t, data))
+		assert.Error(err)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	testKey, err := testutils.GetTestPublicKey()
+	require.NoError(t, err)
+
+	path := writeFile(t, nil)
+	list, err := Load(path)
+	require.NoError(t, err)
+	stop := list.Watch(10*time.Millisecond, func(err error) { t.Log(err) })
+	defer stop()
+
+	require.False(t, list.IsRevoked(testKey))
+	require.NoError(t, os.WriteFile(path, []byte(testutils.TestPublicKeyString+"\n"), 0644))
+	assert.Eventually(t, func() bool { return list.IsRevoked(testKey) }, time.Second, 10*time.Millisecond)
+}
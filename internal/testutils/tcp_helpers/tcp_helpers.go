@@ -1,8 +1,8 @@
 package tcp_helpers
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -26,7 +26,7 @@ func GetFreePort() (int, error) {
 func WaitForPort(t *testing.T, serverAddress string, port int) {
 	t.Log("waitForPort begins")
 	for {
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", serverAddress, port))
+		conn, err := net.Dial("tcp", net.JoinHostPort(serverAddress, strconv.Itoa(port)))
 		if err == nil {
 			t.Log("waitForPort success")
 			conn.Close()